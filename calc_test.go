@@ -1,17 +1,15 @@
 package calc
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"math"
-	"net/http"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/Barsenick/calculator/pkg/calc"
+	"github.com/Barsenick/calculator/pkg/client"
 	"github.com/google/uuid"
 )
 
@@ -23,22 +21,6 @@ type Test struct {
 	expectedStatusCode int
 }
 
-type CalcResponse struct {
-	ID    int    `json:"id"`
-	Error string `json:"error,omitempty"`
-}
-
-type ExpressionResponse struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
-	Result string `json:"result"`
-}
-
-type RegistrationResponse struct {
-	Status string `json:"status"`
-	Token  string `json:"token,omitempty"`
-}
-
 var tests = []Test{
 	{"Simple One Number 1",
 		"5",
@@ -224,8 +206,6 @@ var tests = []Test{
 		500},
 }
 
-var authToken = "Bearer "
-
 func TestCalcFunc(t *testing.T) {
 	for i, test := range tests {
 		result, err := calc.NormalCalc(test.expression)
@@ -241,159 +221,87 @@ func TestCalcFunc(t *testing.T) {
 	}
 }
 
-func TestWebCalc(t *testing.T) {
-	name := uuid.NewString()
-	request, err := http.NewRequest(http.MethodPost, "http://localhost:8070/api/v1/register", bytes.NewReader([]byte(`{"login":"`+name+`", "password": "test"}`)))
-	if err != nil {
-		panic(err)
-	}
-
-	client := &http.Client{}
-
-	response, err := client.Do(request)
-	if err != nil {
-		panic(err)
-	}
-
-	responseBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		panic(err)
-	}
-
-	var reg_resp RegistrationResponse
-
-	err = json.Unmarshal(responseBytes, &reg_resp)
-	if err != nil {
-		panic(err)
-	}
-
-	if reg_resp.Status != "200 OK" {
-		t.Fatalf("registration status is not ok: %v", reg_resp.Status)
-	}
-
-	request, err = http.NewRequest(http.MethodPost, "http://localhost:8070/api/v1/login", bytes.NewReader([]byte(`{"login":"`+name+`", "password": "test"}`)))
-	if err != nil {
-		panic(err)
+func TestEvaluateFunc(t *testing.T) {
+	for i, test := range tests {
+		result, err := calc.Evaluate(test.expression)
+		if test.wantError && err == nil {
+			t.Fatalf("Expected error; got %v in test #%v", result, i+1)
+		}
+		if !test.wantError && err != nil {
+			t.Fatalf("Unexpected error in test #%v: %v", i+1, err)
+		}
+		if result != test.expected {
+			t.Fatalf("Expected %v; got %v in test #%v", test.expected, result, i+1)
+		}
 	}
 
-	client = &http.Client{}
-
-	response, err = client.Do(request)
-	if err != nil {
-		panic(err)
+	result, err := calc.Evaluate("2*r^2", calc.WithVariable("r", 1.5), calc.WithPrecision(2))
+	if err != nil || result != 4.5 {
+		t.Fatalf("Expected 4.5; got %v, %v", result, err)
 	}
-
-	responseBytes, err = io.ReadAll(response.Body)
-	if err != nil {
-		panic(err)
+	if _, err := calc.Evaluate("r+1"); err == nil {
+		t.Fatal("Expected an error for an unknown variable")
 	}
+}
 
-	var login_resp RegistrationResponse
+func TestWebCalc(t *testing.T) {
+	ctx := context.Background()
+	name := uuid.NewString()
 
-	err = json.Unmarshal(responseBytes, &login_resp)
-	if err != nil {
-		panic(err)
+	api := client.New("http://localhost:8070")
+	if _, err := api.Register(ctx, name, "test-password-1"); err != nil {
+		t.Fatalf("registration failed: %v", err)
 	}
 
-	if login_resp.Status != "200 OK" {
-		t.Fatalf("login status is not ok: %v", login_resp.Status)
+	if _, err := api.Login(ctx, name, "test-password-1"); err != nil {
+		t.Fatalf("login failed: %v", err)
 	}
 
-	token := login_resp.Token
-	authToken += token
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			request, err1 := http.NewRequest(http.MethodPost, "http://localhost:8070/api/v1/calculate", bytes.NewReader([]byte(fmt.Sprintf(`{"expression":"%v"}`, tt.expression))))
-			if err1 != nil {
-				panic(err1)
+			id, err := api.Calculate(ctx, client.CalculateRequest{Expression: tt.expression})
+			if err != nil {
+				t.Fatal(err)
 			}
 
-			request.Header.Set("Content-Type", "application/json")
-			request.Header.Set("Authorization", authToken)
+			var er *client.Expression
+			for attempts := 0; ; attempts++ {
+				if attempts >= 10 {
+					t.Fatal("still pending after 10 attempts")
+				}
+
+				time.Sleep(50 * time.Millisecond)
+				er, err = api.Get(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Logf("%+v", *er)
 
-			client := &http.Client{}
-			response, err2 := client.Do(request)
-			if err2 != nil {
-				panic(err2)
+				if !er.Pending() {
+					break
+				}
 			}
-			defer response.Body.Close()
 
-			responseBytes, err3 := io.ReadAll(response.Body)
-			if err3 != nil {
-				panic(err3)
+			if er.Result == calc.Err422.Error() || er.Result == calc.Err500.Error() {
+				if !tt.wantError {
+					t.Fatalf("unexpected error")
+				}
+				return
 			}
 
-			var cr CalcResponse
-			err4 := json.Unmarshal(responseBytes, &cr)
-			if err4 != nil {
-				panic(err4)
+			resfloat, errfloat := strconv.ParseFloat(er.Result, 64)
+			if errfloat != nil {
+				t.Fatal(errfloat)
 			}
 
-			id := strconv.Itoa(cr.ID)
-
-			request2, err5 := http.NewRequest(http.MethodGet, "http://localhost:8070/api/v1/expressions?id="+id, nil)
-			if err5 != nil {
-				panic(err5)
+			if math.Abs(resfloat-tt.expected) > 0.0001 {
+				t.Fatalf("expected %v, got %v", tt.expected, resfloat)
 			}
-
-			haventGotResult := true
-			attempts := 0
-
-			for haventGotResult {
-				if attempts >= 10 {
-					t.Fatal("still pending after 10 attempts")
-				} else {
-					request2.Header.Set("Authorization", authToken)
-					time.Sleep(50 * time.Millisecond)
-					response2, err6 := client.Do(request2)
-					if err6 != nil {
-						panic(err6)
-					}
-					defer response2.Body.Close()
-					request2.Header.Set("Authorization", authToken)
-
-					response2Bytes, err7 := io.ReadAll(response2.Body)
-					if err7 != nil {
-						panic(err7)
-					}
-
-					var er ExpressionResponse
-					err8 := json.Unmarshal(response2Bytes, &er)
-					t.Log(string(response2Bytes))
-					t.Log(string(authToken))
-					if err8 != nil {
-						panic(err8)
-					}
-
-					if er.Result == "pending" {
-						attempts++
-						continue
-					} else if er.Result == calc.Err422.Error() || er.Result == calc.Err500.Error() {
-						if !tt.wantError {
-							t.Fatalf("unexpected error")
-						}
-						haventGotResult = false
-						break
-					}
-
-					resfloat, errfloat := strconv.ParseFloat(er.Result, 64)
-					if errfloat != nil {
-						panic(errfloat)
-					}
-
-					if math.Abs(resfloat-tt.expected) > 0.0001 {
-						t.Fatalf("expected %v, got %v", tt.expected, resfloat)
-					}
-					if er.Status != fmt.Sprint(tt.expectedStatusCode) {
-						t.Fatalf("expected %v, got %v", tt.expectedStatusCode, er.Status)
-					}
-					if tt.wantError && er.Status == "200" {
-						t.Fatalf("expected error, got success")
-					}
-					haventGotResult = false
-					break
-				}
+			if er.Status != fmt.Sprint(tt.expectedStatusCode) {
+				t.Fatalf("expected %v, got %v", tt.expectedStatusCode, er.Status)
+			}
+			if tt.wantError && er.Status == "200" {
+				t.Fatalf("expected error, got success")
 			}
 		})
 	}
@@ -0,0 +1,133 @@
+// calc evaluates expressions locally, with the same rules as the server.
+//
+//	calc [-precision N] [-math] [-var name=value]... [-f file]... [expression]...
+//
+// Every argument is an expression, and so is every line of the files. With
+// neither, the lines of the standard input are evaluated. Empty lines and
+// lines starting with # are skipped.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Barsenick/calculator/pkg/calc"
+)
+
+type variables map[string]float64
+
+func (v variables) String() string {
+	return fmt.Sprint(map[string]float64(v))
+}
+
+func (v variables) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return errors.New("expected name=value")
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	v[strings.TrimSpace(name)] = f
+	return nil
+}
+
+type files []string
+
+func (f *files) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *files) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func main() {
+	vars := variables{}
+	var inputs files
+	precision := flag.Int("precision", -1, "decimal places of the results, as many as needed if negative")
+	withMath := flag.Bool("math", false, "add pi, e and functions like sqrt and max")
+	flag.Var(vars, "var", "a variable as name=value, may be repeated")
+	flag.Var(&inputs, "f", "file of expressions, one per line, - for the standard input, may be repeated")
+	flag.Parse()
+
+	opts := []calc.Option{calc.WithVariables(vars), calc.WithPrecision(*precision)}
+	if *withMath {
+		opts = append(opts, calc.WithMath())
+	}
+	e := evaluator{opts: opts, precision: *precision, out: os.Stdout, errs: os.Stderr}
+
+	for _, expr := range flag.Args() {
+		e.evaluate("", expr)
+	}
+	for _, name := range inputs {
+		if err := e.evaluateFile(name); err != nil {
+			fmt.Fprintln(os.Stderr, "calc:", err)
+			os.Exit(2)
+		}
+	}
+	if flag.NArg() == 0 && len(inputs) == 0 {
+		e.evaluateLines("", os.Stdin)
+	}
+
+	if e.failed {
+		os.Exit(1)
+	}
+}
+
+type evaluator struct {
+	opts      []calc.Option
+	precision int
+	out, errs io.Writer
+	failed    bool
+}
+
+// evaluate prints the result, or the error prefixed with where the
+// expression comes from.
+func (e *evaluator) evaluate(where, expr string) {
+	res, err := calc.Evaluate(expr, e.opts...)
+	if err != nil {
+		e.failed = true
+		fmt.Fprintf(e.errs, "%s%s: %v\n", where, expr, err)
+		return
+	}
+	fmt.Fprintln(e.out, strconv.FormatFloat(res, 'f', e.precision, 64))
+}
+
+func (e *evaluator) evaluateFile(name string) error {
+	if name == "-" {
+		return e.evaluateLines("", os.Stdin)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return e.evaluateLines(name+":", f)
+}
+
+func (e *evaluator) evaluateLines(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		where := ""
+		if name != "" {
+			where = fmt.Sprintf("%s%d: ", name, n)
+		}
+		e.evaluate(where, line)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"golang.org/x/term"
+)
+
+// how long calc -wait lets the server wait before it starts polling
+const serverWait = 30 * time.Second
+
+const pollInterval = 200 * time.Millisecond
+
+func loginCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("login")
+	user := fs.String("user", "", "login of the user, asked for if empty")
+	register := fs.Bool("register", false, "create the user first")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *user == "" {
+		*user = c.cfg.Login
+	}
+	if *user == "" {
+		var err error
+		if *user, err = c.prompt("Login: "); err != nil {
+			return err
+		}
+	}
+
+	password := os.Getenv("CALCCTL_PASSWORD")
+	if password == "" {
+		var err error
+		if password, err = c.password("Password: "); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if *register {
+		_, err = c.api.Register(ctx, *user, password)
+	} else {
+		_, err = c.api.Login(ctx, *user, password)
+	}
+	var mfa *client.MFARequiredError
+	if errors.As(err, &mfa) {
+		code := os.Getenv("CALCCTL_MFA_CODE")
+		if code == "" {
+			if code, err = c.prompt("Code: "); err != nil {
+				return err
+			}
+		}
+		_, err = c.api.LoginMFA(ctx, mfa.Token, code)
+	}
+	if err != nil {
+		return err
+	}
+
+	// exec saves the tokens
+	c.cfg.Login = *user
+
+	fmt.Fprintf(c.stderr, "Logged in to %s as %s\n", c.cfg.Server, *user)
+	return nil
+}
+
+func logoutCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("logout")
+	all := fs.Bool("all", false, "end every session of the user, not only this one")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if c.api.Token == "" && c.api.RefreshToken == "" {
+		return errors.New("not logged in")
+	}
+	if err := c.api.Logout(ctx, *all); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stderr, "Logged out of %s\n", c.cfg.Server)
+	return nil
+}
+
+// passwdCommand changes the password, or asks for a reset link with -reset
+// and sets the password with the token of the link with -token.
+func passwdCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("passwd")
+	reset := fs.String("reset", "", "send a reset link to the email of this user")
+	token := fs.String("token", "", "set the password with the token of a reset link")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *reset != "" {
+		if err := c.api.RequestPasswordReset(ctx, *reset); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stderr, "If %s has an email address, a reset link was sent to it\n", *reset)
+		return nil
+	}
+
+	current := os.Getenv("CALCCTL_PASSWORD")
+	if current == "" && *token == "" {
+		var err error
+		if current, err = c.password("Current password: "); err != nil {
+			return err
+		}
+	}
+	password := os.Getenv("CALCCTL_NEW_PASSWORD")
+	if password == "" {
+		var err error
+		if password, err = c.password("New password: "); err != nil {
+			return err
+		}
+	}
+
+	if *token != "" {
+		if err := c.api.ResetPassword(ctx, *token, password); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stderr, "Password reset, log in with the new one")
+		return nil
+	}
+
+	if err := c.api.ChangePassword(ctx, current, password); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stderr, "Password changed, the other sessions are logged out")
+	return nil
+}
+
+// mfaCommand shows whether two-factor authentication is on, or sets it up
+// with -enroll and then -verify.
+func mfaCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("mfa")
+	enroll := fs.Bool("enroll", false, "create a TOTP secret for an authenticator app")
+	qrFile := fs.String("qr", "", "write the QR code of the new secret to this PNG file")
+	verify := fs.String("verify", "", "turn two-factor authentication on with a code of the new secret")
+	disable := fs.String("disable", "", "turn two-factor authentication off with a TOTP or recovery code")
+	recovery := fs.String("recovery-codes", "", "replace the recovery codes, with a TOTP code")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch {
+	case *enroll:
+		enrollment, err := c.api.EnrollTOTP(ctx)
+		if err != nil {
+			return err
+		}
+		if *qrFile != "" {
+			if err := os.WriteFile(*qrFile, enrollment.QRPNG, 0o600); err != nil {
+				return err
+			}
+		}
+		if c.output == "json" {
+			return c.printJSON(enrollment)
+		}
+		fmt.Fprintf(c.stdout, "Secret: %s\nURI: %s\n", enrollment.Secret, enrollment.URI)
+		fmt.Fprintln(c.stderr, "Add the secret to an authenticator app, then run calcctl mfa -verify CODE")
+		return nil
+	case *verify != "" || *recovery != "":
+		var codes []string
+		var err error
+		if *verify != "" {
+			codes, err = c.api.VerifyTOTP(ctx, *verify)
+		} else {
+			codes, err = c.api.RegenerateRecoveryCodes(ctx, *recovery)
+		}
+		if err != nil {
+			return err
+		}
+		if c.output == "json" {
+			return c.printJSON(client.RecoveryCodes{Codes: codes})
+		}
+		for _, code := range codes {
+			fmt.Fprintln(c.stdout, code)
+		}
+		fmt.Fprintln(c.stderr, "Keep the recovery codes somewhere safe, each of them logs you in once")
+		return nil
+	case *disable != "":
+		if err := c.api.DisableTOTP(ctx, *disable); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stderr, "Two-factor authentication is off")
+		return nil
+	}
+
+	status, err := c.api.MFAStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(status)
+	}
+	if !status.TOTPEnabled {
+		fmt.Fprintln(c.stdout, "Two-factor authentication is off")
+		return nil
+	}
+	fmt.Fprintf(c.stdout, "Two-factor authentication is on, %d recovery codes left\n", status.RecoveryCodesLeft)
+	return nil
+}
+
+func sessionsCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("sessions")
+	revoke := fs.String("revoke", "", "end the session with this ID")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *revoke != "" {
+		return c.api.RevokeSession(ctx, *revoke)
+	}
+
+	sessions, err := c.api.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printSessions(sessions)
+}
+
+func apiKeysCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("apikeys")
+	create := fs.String("create", "", "create a key with this name")
+	scopes := fs.String("scopes", "", "comma separated scopes of the new key, all if empty")
+	expires := fs.Duration("expires", 0, "lifetime of the new key, unlimited if 0")
+	revoke := fs.Int64("revoke", 0, "revoke the key with this ID")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch {
+	case *create != "":
+		req := client.APIKeyRequest{Name: *create}
+		if *scopes != "" {
+			req.Scopes = strings.Split(*scopes, ",")
+		}
+		if *expires > 0 {
+			req.Expires = time.Now().Add(*expires).Unix()
+		}
+		key, err := c.api.CreateAPIKey(ctx, req)
+		if err != nil {
+			return err
+		}
+		if c.output == "json" {
+			return c.printJSON(key)
+		}
+		fmt.Fprintln(c.stderr, "Copy the key now, it won't be shown again:")
+		_, err = fmt.Fprintln(c.stdout, key.Key)
+		return err
+
+	case *revoke != 0:
+		return c.api.RevokeAPIKey(ctx, *revoke)
+	}
+
+	keys, err := c.api.APIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printAPIKeys(keys)
+}
+
+func workspacesCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("workspaces")
+	use := fs.Int64("use", -1, "send the next commands to the workspace with this ID, 0 for the personal one")
+	create := fs.String("create", "", "create a workspace with this name")
+	invite := fs.Int64("invite", 0, "create an invite to the workspace with this ID")
+	role := fs.String("role", client.WorkspaceMember, "role of the invited user")
+	email := fs.String("email", "", "send the invite to this email, only its user may accept it")
+	accept := fs.String("accept", "", "join a workspace with the token of an invite")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch {
+	case *use >= 0:
+		c.cfg.Workspace = *use
+		return c.cfg.save()
+
+	case *create != "":
+		ws, err := c.api.CreateWorkspace(ctx, *create)
+		if err != nil {
+			return err
+		}
+		return c.printWorkspaces([]client.Workspace{*ws})
+
+	case *invite != 0:
+		inv, err := c.api.Invite(ctx, *invite, client.InviteRequest{Role: *role, Email: *email})
+		if err != nil {
+			return err
+		}
+		if c.output == "json" {
+			return c.printJSON(inv)
+		}
+		_, err = fmt.Fprintln(c.stdout, inv.URL)
+		return err
+
+	case *accept != "":
+		ws, err := c.api.AcceptInvite(ctx, *accept)
+		if err != nil {
+			return err
+		}
+		return c.printWorkspaces([]client.Workspace{*ws})
+	}
+
+	workspaces, err := c.api.Workspaces(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printWorkspaces(workspaces)
+}
+
+func calcCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("calc")
+	wait := fs.Bool("wait", false, "wait for the result")
+	timeout := fs.Duration("timeout", 0, "deadline of the evaluation, the server's default if 0")
+	priority := fs.Int("priority", 0, "priority of the expression among the user's expressions")
+	precision := fs.Int("precision", -2, "decimal places of the result, -1 for as many as needed, the workspace's default if unset")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("no expression given")
+	}
+
+	req := client.CalculateRequest{
+		Expression: strings.Join(args, " "),
+		Priority:   *priority,
+		TimeoutMS:  int(timeout.Milliseconds()),
+	}
+	if *precision != -2 {
+		req.Precision = precision
+	}
+
+	if !*wait {
+		id, err := c.api.Calculate(ctx, req)
+		if err != nil {
+			return err
+		}
+		return c.printID(id)
+	}
+
+	expr, err := c.api.CalculateAndWait(ctx, req, serverWait)
+	if errors.Is(err, client.ErrStillPending) {
+		expr, err = c.api.Wait(ctx, expr.ID, pollInterval)
+	}
+	if err != nil {
+		return err
+	}
+	return c.printExpression(expr)
+}
+
+// filterFlags adds the filters shared by list and export to fs.
+func filterFlags(fs *flag.FlagSet, opts *client.ListOptions) {
+	fs.StringVar(&opts.Status, "status", "", "comma separated pending, ok, error, cancelled or timeout")
+	fs.StringVar(&opts.From, "from", "", "only expressions created since, RFC 3339 or YYYY-MM-DD")
+	fs.StringVar(&opts.To, "to", "", "only expressions created before, RFC 3339 or YYYY-MM-DD")
+	fs.StringVar(&opts.Query, "q", "", "only expressions containing the text")
+	fs.StringVar(&opts.Order, "order", "", "asc or desc by creation time")
+}
+
+func listCommand(ctx context.Context, c *cli, args []string) error {
+	var opts client.ListOptions
+	fs := c.flagSet("list")
+	fs.IntVar(&opts.Limit, "limit", 0, "expressions per page")
+	fs.StringVar(&opts.Cursor, "cursor", "", "cursor of the next page")
+	filterFlags(fs, &opts)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	list, err := c.api.List(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return c.printList(list)
+}
+
+func showCommand(ctx context.Context, c *cli, args []string) error {
+	id, err := idArgument(c.flagSet("show"), args)
+	if err != nil {
+		return err
+	}
+
+	expr, err := c.api.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.printExpression(expr)
+}
+
+func cancelCommand(ctx context.Context, c *cli, args []string) error {
+	id, err := idArgument(c.flagSet("cancel"), args)
+	if err != nil {
+		return err
+	}
+
+	expr, err := c.api.Cancel(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.printExpression(expr)
+}
+
+// shareCommand creates a public link to the expression, or lists or revokes
+// its links.
+func shareCommand(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("share")
+	expires := fs.Duration("expires", 0, "lifetime of the new link, unlimited if 0")
+	list := fs.Bool("list", false, "list the links of the expression")
+	revoke := fs.Int64("revoke", 0, "revoke the link with this ID")
+	id, err := idArgument(fs, args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *list:
+		shares, err := c.api.Shares(ctx, id)
+		if err != nil {
+			return err
+		}
+		return c.printShares(shares)
+
+	case *revoke != 0:
+		return c.api.RevokeShare(ctx, id, *revoke)
+	}
+
+	var req client.ShareRequest
+	if *expires > 0 {
+		req.Expires = time.Now().Add(*expires).Unix()
+	}
+	share, err := c.api.Share(ctx, id, req)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(share)
+	}
+	fmt.Fprintln(c.stderr, "Anyone with the link can see the expression, copy it now, it won't be shown again:")
+	_, err = fmt.Fprintln(c.stdout, share.URL)
+	return err
+}
+
+func idArgument(fs *flag.FlagSet, args []string) (string, error) {
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return "", err
+	}
+	if len(args) != 1 {
+		fs.Usage()
+		return "", errors.New("expected one ID")
+	}
+	return args[0], nil
+}
+
+func exportCommand(ctx context.Context, c *cli, args []string) error {
+	var opts client.ListOptions
+	fs := c.flagSet("export")
+	format := fs.String("format", "csv", "csv, jsonl or xlsx")
+	file := fs.String("file", "", "file to write to, standard output if empty")
+	filterFlags(fs, &opts)
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	body, err := c.api.Export(ctx, *format, opts)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if *file == "" {
+		_, err = io.Copy(c.stdout, body)
+		return err
+	}
+
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *cli) prompt(text string) (string, error) {
+	fmt.Fprint(c.stderr, text)
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// password prompts for a password, which isn't echoed if stdin is a terminal.
+func (c *cli) password(text string) (string, error) {
+	if c.tty == nil {
+		return c.prompt(text)
+	}
+	fmt.Fprint(c.stderr, text)
+	password, err := term.ReadPassword(int(c.tty.Fd()))
+	fmt.Fprintln(c.stderr)
+	return string(password), err
+}
@@ -0,0 +1,213 @@
+// calcctl is a command-line client of the calculator.
+//
+//	calcctl [-server URL] [-o table|json] command [arguments]
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"golang.org/x/term"
+)
+
+const defaultServer = "http://localhost:8080"
+
+type cli struct {
+	api    *client.Client
+	cfg    *config
+	output string
+	stdin  *bufio.Reader
+	// tty is stdin if it is a terminal
+	tty    *os.File
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *cli, args []string) error
+}
+
+// commands is filled in init, as repl runs the other commands
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"login":      {"login [-user NAME]", loginCommand},
+		"logout":     {"logout [-all]", logoutCommand},
+		"passwd":     {"passwd [-reset LOGIN] [-token TOKEN]", passwdCommand},
+		"mfa":        {"mfa [-enroll [-qr FILE]] [-verify CODE] [-disable CODE] [-recovery-codes CODE]", mfaCommand},
+		"sessions":   {"sessions [-revoke ID]", sessionsCommand},
+		"apikeys":    {"apikeys [-create NAME [-scopes calculate,read] [-expires DURATION]] [-revoke ID]", apiKeysCommand},
+		"workspaces": {"workspaces [-use ID] [-create NAME] [-invite ID [-role ROLE] [-email EMAIL]] [-accept TOKEN]", workspacesCommand},
+		"calc":       {"calc [-wait] [-timeout DURATION] [-priority N] [-precision N] EXPRESSION", calcCommand},
+		"list":       {"list [-limit N] [-cursor CURSOR] [-status S] [-from T] [-to T] [-q TEXT] [-order asc|desc]", listCommand},
+		"show":       {"show ID", showCommand},
+		"cancel":     {"cancel ID", cancelCommand},
+		"share":      {"share [-expires DURATION] [-list] [-revoke SHARE] ID", shareCommand},
+		"export":     {"export [-format csv|jsonl|xlsx] [-file PATH] [filters of list]", exportCommand},
+		"repl":       {"repl", replCommand},
+	}
+}
+
+func main() {
+	// the first Ctrl-C cancels the running request, the next one kills calcctl
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "calcctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("calcctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", "", "address of the orchestrator, CALCCTL_SERVER or "+defaultServer+" by default")
+	output := fs.String("o", "table", "output format, table or json")
+	fs.Usage = func() { usage(fs) }
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+	if fs.NArg() == 0 {
+		usage(fs)
+		return errors.New("no command given")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *server != "":
+		cfg.Server = *server
+	case os.Getenv("CALCCTL_SERVER") != "":
+		cfg.Server = os.Getenv("CALCCTL_SERVER")
+	case cfg.Server == "":
+		cfg.Server = defaultServer
+	}
+
+	api := client.New(cfg.Server)
+	api.Token, api.RefreshToken = cfg.Token, cfg.RefreshToken
+	// CI jobs use an API key instead of logging in
+	api.APIKey = os.Getenv("CALCCTL_API_KEY")
+	api.Workspace = cfg.Workspace
+	if id := os.Getenv("CALCCTL_WORKSPACE"); id != "" {
+		if api.Workspace, err = strconv.ParseInt(id, 10, 64); err != nil {
+			return fmt.Errorf("invalid CALCCTL_WORKSPACE %q", id)
+		}
+	}
+
+	c := &cli{api: api, cfg: cfg, output: *output, stdin: bufio.NewReader(stdin), stdout: stdout, stderr: stderr}
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		c.tty = f
+	}
+	return c.exec(ctx, fs.Args())
+}
+
+func (c *cli) exec(ctx context.Context, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	err := cmd.run(ctx, c, args[1:])
+
+	// the client refreshes expired tokens on its own, keep the new ones
+	if c.api.Token != c.cfg.Token || c.api.RefreshToken != c.cfg.RefreshToken {
+		c.cfg.Token, c.cfg.RefreshToken = c.api.Token, c.api.RefreshToken
+		if saveErr := c.cfg.save(); saveErr != nil && err == nil {
+			err = fmt.Errorf("saving the token: %w", saveErr)
+		}
+	}
+
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		if c.api.APIKey != "" {
+			return fmt.Errorf("%w, check CALCCTL_API_KEY", err)
+		}
+		return fmt.Errorf("%w, log in with calcctl login", err)
+	}
+	return err
+}
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintln(fs.Output(), "usage: calcctl [-server URL] [-o table|json] command [arguments]")
+	fs.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(fs.Output(), "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintln(fs.Output(), "  "+commands[name].usage)
+	}
+}
+
+// parseFlags parses args which may mix flags with positional arguments, e.g.
+// calc "2+2" -wait. Everything after -- is positional, and so are negative
+// numbers like -1+3.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 {
+		n := slices.IndexFunc(args, negativeNumber)
+		if n < 0 {
+			n = len(args)
+		}
+		if err := fs.Parse(args[:n]); err != nil {
+			return nil, err
+		}
+
+		rest := fs.Args()
+		if consumed := n - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(append(positional, rest...), args[n:]...), nil
+		}
+		if len(rest) > 0 {
+			positional = append(positional, rest[0])
+			args = append(rest[1:len(rest):len(rest)], args[n:]...)
+			continue
+		}
+
+		positional = append(positional, args[n:min(n+1, len(args))]...)
+		args = args[min(n+1, len(args)):]
+	}
+	return positional, nil
+}
+
+func negativeNumber(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-' && strings.ContainsRune("0123456789.(", rune(arg[1]))
+}
+
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() { fmt.Fprintln(c.stderr, "usage: calcctl "+commands[name].usage) }
+	return fs
+}
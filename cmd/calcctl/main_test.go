@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Barsenick/calculator/pkg/client"
+)
+
+func TestParseFlags(t *testing.T) {
+	for _, test := range []struct {
+		args       []string
+		wait       bool
+		priority   int
+		positional []string
+	}{
+		{args: []string{"2+2"}, positional: []string{"2+2"}},
+		{args: []string{"-wait", "2+2"}, wait: true, positional: []string{"2+2"}},
+		{args: []string{"2+2", "-wait", "-priority", "3"}, wait: true, priority: 3, positional: []string{"2+2"}},
+		{args: []string{"-1+3", "-wait"}, wait: true, positional: []string{"-1+3"}},
+		{args: []string{"-priority=-2", "(1)"}, priority: -2, positional: []string{"(1)"}},
+		{args: []string{"-(2)", "-.5"}, positional: []string{"-(2)", "-.5"}},
+		{args: []string{"-wait", "--", "-priority"}, wait: true, positional: []string{"-priority"}},
+		{args: []string{"a", "b", "-wait", "c"}, wait: true, positional: []string{"a", "b", "c"}},
+	} {
+		fs := flag.NewFlagSet("calc", flag.ContinueOnError)
+		wait := fs.Bool("wait", false, "")
+		priority := fs.Int("priority", 0, "")
+		positional, err := parseFlags(fs, test.args)
+		if err != nil || *wait != test.wait || *priority != test.priority || !slices.Equal(positional, test.positional) {
+			t.Errorf("%q: got %v %d %q, %v", test.args, *wait, *priority, positional, err)
+		}
+	}
+
+	fs := flag.NewFlagSet("calc", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := parseFlags(fs, []string{"2+2", "-unknown"}); err == nil {
+		t.Error("expected an unknown flag to be refused")
+	}
+}
+
+func TestOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v1/login":
+			var creds client.Credentials
+			if json.NewDecoder(r.Body).Decode(&creds); creds.Login != "alice" || creds.Password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"status":"200 OK","token":"tok","refresh_token":"r1"}`))
+		case "GET /api/v1/expressions/7":
+			w.Write([]byte(`{"id":"7","status":"200","result":"4.000000","expression":"2+2","label":"sum","trace":[{"operation":"+","arg1":2,"arg2":2,"result":4}]}`))
+		case "GET /api/v1/expressions":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"expressions":[{"id":"7","status":"200","result":"4.000000","expression":"2+2"},{"id":"8","status":"201","result":"pending","expression":"1/3","label":"third"}],"next_cursor":"OA"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("CALCCTL_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	for _, env := range []string{"CALCCTL_SERVER", "CALCCTL_PASSWORD", "CALCCTL_API_KEY", "CALCCTL_WORKSPACE"} {
+		t.Setenv(env, "")
+	}
+	calcctl := func(stdin string, args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := run(context.Background(), append([]string{"-server", server.URL}, args...), strings.NewReader(stdin), &stdout, &stderr); err != nil {
+			t.Fatalf("%q: %v, %s", args, err, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	// without a terminal the password is read as a line of stdin
+	calcctl("alice\nsecret\n", "login")
+
+	want := `ID  STATUS   RESULT    EXPRESSION  LABEL  CREATED
+7   ok       4.000000  2+2                -
+8   pending  pending   1/3         third  -
+
+more with -cursor OA
+`
+	if got := calcctl("", "list"); got != want {
+		t.Errorf("unexpected table\n%s", got)
+	}
+	var list client.ExpressionList
+	if err := json.Unmarshal([]byte(calcctl("", "-o", "json", "list")), &list); err != nil || len(list.Expressions) != 2 || list.Expressions[1].Label != "third" || list.NextCursor != "OA" {
+		t.Errorf("unexpected JSON list %+v, %v", list, err)
+	}
+
+	want = `ID:          7
+Expression:  2+2
+Status:      ok
+Result:      4.000000
+Created:     -
+Finished:    -
+Label:       sum
+Step 1:      2 + 2 = 4
+`
+	if got := calcctl("", "show", "7"); got != want {
+		t.Errorf("unexpected expression\n%s", got)
+	}
+	var expr client.Expression
+	if err := json.Unmarshal([]byte(calcctl("", "-o", "json", "show", "7")), &expr); err != nil || expr.ID != "7" || expr.Result != "4.000000" || len(expr.Trace) != 1 {
+		t.Errorf("unexpected JSON expression %+v, %v", expr, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Barsenick/calculator/pkg/client"
+)
+
+var statusNames = map[string]string{
+	client.StatusPending:  "pending",
+	client.StatusOK:       "ok",
+	client.StatusInvalid:  "error",
+	client.StatusInternal: "error",
+}
+
+func statusName(status string) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return status
+}
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).Local().Format(time.DateTime)
+}
+
+func (c *cli) printJSON(v any) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) printID(id string) error {
+	if c.output == "json" {
+		return c.printJSON(map[string]string{"id": id})
+	}
+	_, err := fmt.Fprintln(c.stdout, id)
+	return err
+}
+
+func (c *cli) printExpression(expr *client.Expression) error {
+	if c.output == "json" {
+		return c.printJSON(expr)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", expr.ID)
+	fmt.Fprintf(tw, "Expression:\t%s\n", expr.Source)
+	fmt.Fprintf(tw, "Status:\t%s\n", statusName(expr.Status))
+	fmt.Fprintf(tw, "Result:\t%s\n", expr.Result)
+	fmt.Fprintf(tw, "Created:\t%s\n", formatTime(expr.Created))
+	fmt.Fprintf(tw, "Finished:\t%s\n", formatTime(expr.Finished))
+	if expr.Label != "" {
+		fmt.Fprintf(tw, "Label:\t%s\n", expr.Label)
+	}
+	if expr.Notes != "" {
+		fmt.Fprintf(tw, "Notes:\t%s\n", expr.Notes)
+	}
+	for i, step := range expr.Trace {
+		fmt.Fprintf(tw, "Step %d:\t%g %s %g = %g\n", i+1, step.Arg1, step.Operation, step.Arg2, step.Result)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printList(list *client.ExpressionList) error {
+	if c.output == "json" {
+		return c.printJSON(list)
+	}
+
+	if err := writeExpressionTable(c.stdout, list.Expressions); err != nil {
+		return err
+	}
+	if list.NextCursor != "" {
+		fmt.Fprintf(c.stdout, "\nmore with -cursor %s\n", list.NextCursor)
+	}
+	return nil
+}
+
+func writeExpressionTable(w io.Writer, exprs []client.Expression) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tRESULT\tEXPRESSION\tLABEL\tCREATED")
+	for _, expr := range exprs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", expr.ID, statusName(expr.Status), expr.Result, expr.Source, expr.Label, formatTime(expr.Created))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printAPIKeys(keys []client.APIKey) error {
+	if c.output == "json" {
+		return c.printJSON(keys)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+	for _, key := range keys {
+		scopes := strings.Join(key.Scopes, ",")
+		if scopes == "" {
+			scopes = "all"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Prefix, scopes, formatTime(key.Created), formatTime(key.Expires), formatTime(key.LastUsed))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printShares(shares []client.Share) error {
+	if c.output == "json" {
+		return c.printJSON(shares)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED BY\tCREATED\tEXPIRES")
+	for _, share := range shares {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", share.ID, share.CreatedBy, formatTime(share.Created), formatTime(share.Expires))
+	}
+	return tw.Flush()
+}
+
+// printWorkspaces marks the workspace the commands are sent to with *.
+func (c *cli) printWorkspaces(workspaces []client.Workspace) error {
+	if c.output == "json" {
+		return c.printJSON(workspaces)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tROLE\tCREATED")
+	for _, ws := range workspaces {
+		id := strconv.FormatInt(ws.ID, 10)
+		if ws.ID == c.api.Workspace || ws.Personal && c.api.Workspace == 0 {
+			id += " *"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, ws.Name, ws.Role, formatTime(ws.Created))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printSessions(sessions []client.Session) error {
+	if c.output == "json" {
+		return c.printJSON(sessions)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tIP\tUSER AGENT\tCREATED\tLAST USED\tEXPIRES")
+	for _, s := range sessions {
+		id := s.ID
+		if s.Current {
+			id += " *"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", id, s.IP, s.UserAgent, formatTime(s.Created), formatTime(s.LastUsed), formatTime(s.Expires))
+	}
+	return tw.Flush()
+}
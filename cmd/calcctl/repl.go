@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxHistory = 500
+
+const replHelp = `Type an expression to evaluate it and wait for the result, or a command:
+  list, show ID, cancel ID, export ...  the commands of calcctl
+  history                              the previous lines
+  !N, !!                               run line N or the last line again
+  help, exit`
+
+// replCommand evaluates expressions line by line. The lines are kept in the
+// history file next to the config, so they survive between sessions.
+func replCommand(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseFlags(c.flagSet("repl"), args); err != nil {
+		return err
+	}
+
+	history, err := openHistory()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.stderr, `calcctl repl, "help" lists the commands, Ctrl-D exits`)
+	for ctx.Err() == nil {
+		line, err := c.prompt("calc> ")
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(c.stderr)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "":
+			continue
+		case line == "exit" || line == "quit":
+			return nil
+		case line == "help":
+			fmt.Fprintln(c.stderr, replHelp)
+			continue
+		case line == "history":
+			for i, l := range history.lines {
+				fmt.Fprintf(c.stdout, "%4d  %s\n", i+1, l)
+			}
+			continue
+		case strings.HasPrefix(line, "!"):
+			if line, err = history.get(line[1:]); err != nil {
+				fmt.Fprintln(c.stderr, err)
+				continue
+			}
+			fmt.Fprintln(c.stderr, line)
+		}
+
+		history.add(line)
+		if err := c.replLine(ctx, line); err != nil {
+			fmt.Fprintln(c.stderr, "error:", err)
+		}
+	}
+	return nil
+}
+
+func (c *cli) replLine(ctx context.Context, line string) error {
+	fields := strings.Fields(line)
+	if _, ok := commands[fields[0]]; ok && fields[0] != "repl" {
+		return c.exec(ctx, fields)
+	}
+	return c.exec(ctx, []string{"calc", "-wait", "--", line})
+}
+
+type replHistory struct {
+	path  string
+	lines []string
+}
+
+func openHistory() (*replHistory, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &replHistory{path: filepath.Join(dir, "history")}
+	b, err := os.ReadFile(h.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	// the file only grows during a session, it is cut down when opened
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+		if err := os.WriteFile(h.path, []byte(strings.Join(h.lines, "\n")+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *replHistory) get(ref string) (string, error) {
+	if len(h.lines) == 0 {
+		return "", errors.New("the history is empty")
+	}
+	if ref == "!" {
+		return h.lines[len(h.lines)-1], nil
+	}
+
+	n, err := strconv.Atoi(ref)
+	if err != nil || n < 1 || n > len(h.lines) {
+		return "", fmt.Errorf("no line %q in the history", ref)
+	}
+	return h.lines[n-1], nil
+}
+
+// add appends the line to the history and its file. Failing to save the
+// history isn't worth interrupting the session for.
+func (h *replHistory) add(line string) {
+	h.lines = append(h.lines, line)
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[1:]
+	}
+
+	if os.MkdirAll(filepath.Dir(h.path), 0o700) != nil {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	orchestrator "github.com/Barsenick/calculator/internal/application/orchestrator"
@@ -15,6 +16,18 @@ func main() {
 
 	orchestrator.DB = db
 
+	if err := orchestrator.LoadSigningKeys(); err != nil {
+		log.Fatal("Error loading signing keys:", err)
+	}
+
+	if err := orchestrator.LoadOIDC(); err != nil {
+		log.Fatal("Error configuring OIDC:", err)
+	}
+
+	if err := orchestrator.BootstrapAdmin(context.TODO()); err != nil {
+		log.Fatal("Error creating the admin:", err)
+	}
+
 	app := orchestrator.New()
 
 	err = app.RunServer()
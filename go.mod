@@ -9,3 +9,10 @@ require (
 )
 
 require github.com/google/uuid v1.6.0
+
+require (
+	golang.org/x/term v0.31.0
+	rsc.io/qr v0.2.0
+)
+
+require golang.org/x/sys v0.32.0 // indirect
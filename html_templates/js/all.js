@@ -1,7 +1,39 @@
 function log_out() {
-    //document.cookie.split(";").forEach(function(c) { if (c.split("=")[0] === "token") {document.cookie = c.replace(/^ +/, "").replace(/=.*/, "=;expires=" + new Date().toUTCString() + ";path=/"); }});
-    delete_cookie("token")
-    window.location.pathname = "/login"
+    // the session cookies are HttpOnly, the server ends the session and clears them
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", window.location.protocol + "//" + window.location.host + "/api/v1/logout", true);
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            window.location.pathname = "/login"
+        }
+    };
+    xhr.send();
+}
+
+// requests which change something send the CSRF token, the server refuses
+// them otherwise when they are authenticated with the session cookie
+(function () {
+    var open = XMLHttpRequest.prototype.open;
+    XMLHttpRequest.prototype.open = function (method) {
+        open.apply(this, arguments);
+        if (["GET", "HEAD", "OPTIONS"].indexOf(method.toUpperCase()) === -1) {
+            var token = get_cookie("csrf_token");
+            if (token) {
+                this.setRequestHeader("X-CSRF-Token", token);
+            }
+        }
+    };
+})();
+
+function get_cookie(name) {
+    var cookies = document.cookie.split("; ");
+    for (var i = 0; i < cookies.length; i++) {
+        var pair = cookies[i].split("=");
+        if (pair[0] === name) {
+            return decodeURIComponent(pair.slice(1).join("="));
+        }
+    }
+    return "";
 }
 
 function set_cookie(name, value) {
@@ -9,4 +41,35 @@ function set_cookie(name, value) {
 }
 function delete_cookie(name) {
     document.cookie = name +'=; Path=/; Expires=Thu, 01 Jan 1970 00:00:01 GMT;';
-}
\ No newline at end of file
+}
+
+// the workspace switcher of the navigation, the pages send their requests
+// to the workspace of the workspace cookie
+(function () {
+    var select = document.getElementById("workspace-switcher");
+    if (!select) {
+        return;
+    }
+    var xhr = new XMLHttpRequest();
+    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/workspaces", true);
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState !== 4 || xhr.status !== 200) {
+            return;
+        }
+        var workspaces = JSON.parse(xhr.responseText).workspaces;
+        var current = get_cookie("workspace");
+        workspaces.forEach(function (ws) {
+            var option = document.createElement("option");
+            option.value = ws.id;
+            option.textContent = ws.personal ? "Personal" : ws.name + " (" + ws.role + ")";
+            option.selected = current ? String(ws.id) === current : ws.personal;
+            select.appendChild(option);
+        });
+    };
+    xhr.send();
+})();
+
+function switch_workspace(id) {
+    document.cookie = "workspace=" + encodeURIComponent(id) + "; Path=/; Max-Age=31536000; SameSite=Lax";
+    window.location.reload();
+}
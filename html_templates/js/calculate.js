@@ -63,8 +63,8 @@ function formatResult(result) {
         return num.toString();
     }
 
-    // Remove trailing zeros
-    return num.toFixed(6).replace(/\.?0+$/, '');
+    // Remove trailing zeros, the server rounds to the precision of the workspace
+    return String(result).replace(/\.?0+$/, '');
 }
 
 window.onload = function() {
@@ -1,3 +1,6 @@
+var eventSource = null;
+var annotatedId = null;
+
 function fetchExpression() {
     var expressionId = document.getElementById("expressionId").value;
 
@@ -7,7 +10,7 @@ function fetchExpression() {
     }
 
     var xhr = new XMLHttpRequest();
-    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/expressions?id=" + expressionId, true);
+    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + encodeURIComponent(expressionId), true);
     xhr.setRequestHeader("Content-Type", "application/json");
 
     xhr.onreadystatechange = function () {
@@ -16,11 +19,17 @@ function fetchExpression() {
                 try {
                     var response = JSON.parse(xhr.responseText);
                     displayExpression(response);
+                    displayAnnotations(response);
+                    subscribeExpression(response);
+                    document.getElementById("new-share").style.display = "none";
+                    fetchShares(response.id);
                 } catch (e) {
                     console.error("Error parsing JSON response:", e);
                 }
             } else {
                 console.error("Error:", xhr.statusText);
+                document.getElementById("expression-annotations").style.display = "none";
+                document.getElementById("expression-shares").style.display = "none";
                 displayError(xhr.status, xhr.statusText);
             }
         }
@@ -29,6 +38,33 @@ function fetchExpression() {
     xhr.send();
 }
 
+// Shows the changes pushed by the server until the expression is finished
+function subscribeExpression(expression) {
+    if (eventSource) {
+        eventSource.close();
+        eventSource = null;
+    }
+    if (expression.status !== "201") {
+        return;
+    }
+
+    eventSource = new EventSource("/api/v1/expressions/stream?id=" + encodeURIComponent(expression.id));
+
+    var onEvent = function (e) {
+        var update = JSON.parse(e.data);
+        displayExpression(update);
+        if (update.status !== "201") {
+            eventSource.close();
+            eventSource = null;
+            // the events don't carry the steps of the finished expression
+            fetchTrace(update.id);
+        }
+    };
+
+    eventSource.addEventListener("status", onEvent);
+    eventSource.addEventListener("progress", onEvent);
+}
+
 function displayExpression(expression) {
     document.getElementById("button").style.marginBottom = "20px";
     var detailsDiv = document.getElementById("expression-details");
@@ -45,17 +81,307 @@ function displayExpression(expression) {
         statusPara.style.color = "red";
     }
 
+    var sourcePara = document.createElement("p");
+    sourcePara.textContent = "Expression: " + (expression.expression || "");
+
     var resultPara = document.createElement("p");
     resultPara.textContent = "Result: " + formatResult(expression.result);
+    if (expression.status === "201" && expression.tasks_done) {
+        resultPara.textContent += " (" + expression.tasks_done + " operations done)";
+    }
 
     detailsDiv.appendChild(idPara);
+    detailsDiv.appendChild(sourcePara);
     detailsDiv.appendChild(statusPara);
     detailsDiv.appendChild(resultPara);
 
+    if (expression.trace && expression.trace.length > 0) {
+        var tracePara = document.createElement("p");
+        tracePara.textContent = "Steps:";
+        var traceList = document.createElement("ol");
+        expression.trace.forEach(function (step) {
+            var stepItem = document.createElement("li");
+            var stepCode = document.createElement("code");
+            stepCode.textContent = step.arg1 + " " + step.operation + " " + step.arg2 + " = " + step.result;
+            stepItem.appendChild(stepCode);
+            traceList.appendChild(stepItem);
+        });
+        detailsDiv.appendChild(tracePara);
+        detailsDiv.appendChild(traceList);
+    }
+
+    // Pending expressions can still be cancelled
+    if (expression.status === "201") {
+        var cancelButton = document.createElement("button");
+        cancelButton.textContent = "Cancel";
+        cancelButton.onclick = function () {
+            cancelExpression(expression.id);
+        };
+        detailsDiv.appendChild(cancelButton);
+    } else {
+        var rerunButton = document.createElement("button");
+        rerunButton.textContent = "Re-run";
+        rerunButton.onclick = function () {
+            rerunExpression(expression.id);
+        };
+        detailsDiv.appendChild(rerunButton);
+    }
+
+    var deleteButton = document.createElement("button");
+    deleteButton.textContent = "Delete";
+    deleteButton.onclick = function () {
+        deleteExpression(expression.id);
+    };
+    detailsDiv.appendChild(deleteButton);
+
     // Show the container
     detailsDiv.style.display = "block";
 }
 
+function cancelExpression(id) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + id + "/cancel", true);
+    xhr.setRequestHeader("Content-Type", "application/json");
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status === 200) {
+                try {
+                    var response = JSON.parse(xhr.responseText);
+                    displayExpression(response);
+                    subscribeExpression(response);
+                } catch (e) {
+                    console.error("Error parsing JSON response:", e);
+                }
+            } else {
+                console.error("Error:", xhr.statusText);
+                fetchExpression();
+            }
+        }
+    };
+
+    xhr.send();
+}
+
+function rerunExpression(id) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + id + "/rerun", true);
+    xhr.setRequestHeader("Content-Type", "application/json");
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status === 200) {
+                try {
+                    var response = JSON.parse(xhr.responseText);
+                    displayExpression(response);
+                    subscribeExpression(response);
+                } catch (e) {
+                    console.error("Error parsing JSON response:", e);
+                }
+            } else {
+                console.error("Error:", xhr.statusText);
+                fetchExpression();
+            }
+        }
+    };
+
+    xhr.send();
+}
+
+function deleteExpression(id) {
+    if (!confirm("Delete expression " + id + "?")) {
+        return;
+    }
+
+    var xhr = new XMLHttpRequest();
+    xhr.open("DELETE", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + id, true);
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status === 204) {
+                if (eventSource) {
+                    eventSource.close();
+                    eventSource = null;
+                }
+                document.getElementById("expression-annotations").style.display = "none";
+                document.getElementById("expression-shares").style.display = "none";
+                displayError(404, "Expression " + id + " was deleted");
+            } else {
+                console.error("Error:", xhr.statusText);
+                fetchExpression();
+            }
+        }
+    };
+
+    xhr.send();
+}
+
+// The label and the notes are shown apart from the details, so that the
+// updates pushed by the server don't reset what is being typed
+function displayAnnotations(expression) {
+    annotatedId = expression.id;
+    document.getElementById("label").value = expression.label || "";
+    document.getElementById("notes").value = expression.notes || "";
+    document.getElementById("expression-annotations").style.display = "block";
+}
+
+function saveAnnotations() {
+    var id = annotatedId;
+
+    var xhr = new XMLHttpRequest();
+    xhr.open("PATCH", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + id, true);
+    xhr.setRequestHeader("Content-Type", "application/json");
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status === 200) {
+                try {
+                    displayAnnotations(JSON.parse(xhr.responseText));
+                } catch (e) {
+                    console.error("Error parsing JSON response:", e);
+                }
+            } else {
+                console.error("Error:", xhr.statusText);
+                try {
+                    alert(JSON.parse(xhr.responseText).message);
+                } catch (e) {
+                    alert(xhr.statusText);
+                }
+            }
+        }
+    };
+
+    xhr.send(JSON.stringify({
+        label: document.getElementById("label").value,
+        notes: document.getElementById("notes").value
+    }));
+}
+
+// fetchTrace shows the expression again once it is finished, along with
+// its steps
+function fetchTrace(id) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + encodeURIComponent(id), true);
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4 && xhr.status === 200) {
+            try {
+                displayExpression(JSON.parse(xhr.responseText));
+            } catch (e) {
+                console.error("Error parsing JSON response:", e);
+            }
+        }
+    };
+
+    xhr.send();
+}
+
+function fetchShares(id) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + encodeURIComponent(id) + "/shares", true);
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status === 200) {
+                try {
+                    displayShares(id, JSON.parse(xhr.responseText).shares);
+                } catch (e) {
+                    console.error("Error parsing JSON response:", e);
+                }
+            } else {
+                console.error("Error:", xhr.statusText);
+            }
+        }
+    };
+
+    xhr.send();
+}
+
+function displayShares(id, shares) {
+    var sharesDiv = document.getElementById("shares");
+    sharesDiv.innerHTML = "";
+    document.getElementById("expression-shares").style.display = "block";
+
+    shares.forEach(function (share) {
+        var shareDiv = document.createElement("div");
+        shareDiv.className = "expression";
+
+        var sharePara = document.createElement("p");
+        sharePara.className = "small-text";
+        sharePara.textContent = "Link " + share.id + " by " + share.created_by + ", created " + new Date(share.created * 1000).toLocaleString() +
+            ", " + (share.expires ? "expires " + new Date(share.expires * 1000).toLocaleString() : "never expires");
+
+        var revokeButton = document.createElement("button");
+        revokeButton.textContent = "Revoke";
+        revokeButton.onclick = function () {
+            if (confirm("Revoke link " + share.id + "? It will stop working.")) {
+                revokeShare(id, share.id);
+            }
+        };
+
+        shareDiv.appendChild(sharePara);
+        shareDiv.appendChild(revokeButton);
+        sharesDiv.appendChild(shareDiv);
+    });
+}
+
+function createShare() {
+    var id = annotatedId;
+    var request = {};
+    var days = parseInt(document.getElementById("share-expiry").value, 10);
+    if (days > 0) {
+        request.expires = Math.floor(Date.now() / 1000) + days * 24 * 60 * 60;
+    }
+
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + encodeURIComponent(id) + "/shares", true);
+    xhr.setRequestHeader("Content-Type", "application/json");
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status === 201) {
+                try {
+                    document.getElementById("new-share-url").textContent = new URL(JSON.parse(xhr.responseText).url, window.location.href).href;
+                    document.getElementById("new-share").style.display = "block";
+                } catch (e) {
+                    console.error("Error parsing JSON response:", e);
+                }
+                fetchShares(id);
+            } else {
+                console.error("Error:", xhr.statusText);
+                try {
+                    alert(JSON.parse(xhr.responseText).message);
+                } catch (e) {
+                    alert(xhr.statusText);
+                }
+            }
+        }
+    };
+
+    xhr.send(JSON.stringify(request));
+}
+
+function revokeShare(id, shareId) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("DELETE", window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + encodeURIComponent(id) + "/shares/" + shareId, true);
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status !== 204) {
+                console.error("Error:", xhr.statusText);
+                try {
+                    alert(JSON.parse(xhr.responseText).message);
+                } catch (e) {
+                    alert(xhr.statusText);
+                }
+            }
+            fetchShares(id);
+        }
+    };
+
+    xhr.send();
+}
+
 function displayError(status, message) {
     document.getElementById("button").style.marginBottom = "20px";
     var detailsDiv = document.getElementById("expression-details");
@@ -89,8 +415,8 @@ function formatResult(result) {
         return num.toString();
     }
 
-    // Remove trailing zeros
-    return num.toFixed(6).replace(/\.?0+$/, '');
+    // Remove trailing zeros, the server rounds to the precision of the workspace
+    return String(result).replace(/\.?0+$/, '');
 }
 
 // Fetch expression when the page loads if ID is provided in the URL
@@ -1,6 +1,48 @@
+var currentExpressions = [];
+var nextCursor = "";
+var eventSource = null;
+
+function expressionsQuery(cursor) {
+    var params = new URLSearchParams();
+    params.set("limit", "50");
+    params.set("order", document.getElementById("order").value);
+    var search = document.getElementById("search").value;
+    if (search !== "") {
+        params.set("q", search);
+    }
+    var status = document.getElementById("status-filter").value;
+    if (status !== "") {
+        params.set("status", status);
+    }
+    if (cursor) {
+        params.set("cursor", cursor);
+    }
+    return params.toString();
+}
+
+// Downloads every expression matching the filters, not only the loaded pages
+function downloadExpressions() {
+    var params = new URLSearchParams(expressionsQuery(""));
+    params.delete("limit");
+    params.set("format", document.getElementById("export-format").value);
+    window.location.href = "/api/v1/expressions/export?" + params.toString();
+}
+
 function fetchExpressions() {
+    currentExpressions = [];
+    nextCursor = "";
+    fetchExpressionsPage("");
+}
+
+function loadMoreExpressions() {
+    if (nextCursor !== "") {
+        fetchExpressionsPage(nextCursor);
+    }
+}
+
+function fetchExpressionsPage(cursor) {
     var xhr = new XMLHttpRequest();
-    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/expressions", true);
+    xhr.open("GET", window.location.protocol + "//" + window.location.host + "/api/v1/expressions?" + expressionsQuery(cursor), true);
     xhr.setRequestHeader("Content-Type", "application/json");
 
     xhr.onreadystatechange = function () {
@@ -9,7 +51,9 @@ function fetchExpressions() {
                 try {
                     var response = JSON.parse(xhr.responseText);
                     if (response && Array.isArray(response.expressions)) {
-                        displayExpressions(response.expressions);
+                        currentExpressions = currentExpressions.concat(response.expressions);
+                        nextCursor = response.next_cursor || "";
+                        displayExpressions(currentExpressions);
                     } else {
                         console.error("Invalid response format:", response);
                         displayNoExpressions();
@@ -34,6 +78,7 @@ function displayExpressions(expressions) {
     var expressionsContainer = document.getElementById("expressions-container");
 
     expressionsDiv.innerHTML = ""; // Clear previous content
+    document.getElementById("load-more").style.display = nextCursor !== "" ? "inline-block" : "none";
 
     if (expressions.length === 0) {
         noExpressionsDiv.style.display = "block";
@@ -66,11 +111,24 @@ function displayExpressions(expressions) {
 
         idStatusDiv.appendChild(idPara);
         idStatusDiv.appendChild(statusPara);
+        if (expression.created_by) {
+            var creatorPara = document.createElement("p");
+            creatorPara.className = "small-text";
+            creatorPara.textContent = "By: " + expression.created_by;
+            idStatusDiv.appendChild(creatorPara);
+        }
+
+        var sourcePara = document.createElement("p");
+        sourcePara.textContent = "Expression: " + (expression.expression || "");
 
         var resultPara = document.createElement("p");
         resultPara.textContent = "Result: " + formatResult(expression.result);
+        if (expression.status === "201" && expression.tasks_done) {
+            resultPara.textContent += " (" + expression.tasks_done + " operations done)";
+        }
 
         expressionDiv.appendChild(idStatusDiv);
+        expressionDiv.appendChild(sourcePara);
         expressionDiv.appendChild(resultPara);
 
         // Remove margin-bottom for the last expression
@@ -106,9 +164,41 @@ function formatResult(result) {
         return num.toString();
     }
 
-    // Remove trailing zeros
-    return num.toFixed(6).replace(/\.?0+$/, '');
+    // Remove trailing zeros, the server rounds to the precision of the workspace
+    return String(result).replace(/\.?0+$/, '');
+}
+
+// Keeps the list up to date with the changes pushed by the server
+function subscribeExpressions() {
+    if (eventSource) {
+        eventSource.close();
+    }
+    eventSource = new EventSource("/api/v1/expressions/stream");
+
+    var onEvent = function (e) {
+        var update = JSON.parse(e.data);
+        var existing = currentExpressions.find(function (expression) {
+            return expression.id === update.id;
+        });
+        if (existing) {
+            existing.status = update.status;
+            existing.result = update.result;
+            existing.tasks_done = update.tasks_done;
+        } else if (document.getElementById("order").value === "desc") {
+            currentExpressions.unshift(update);
+        } else if (nextCursor === "") {
+            // new expressions belong at the end, which isn't loaded yet otherwise
+            currentExpressions.push(update);
+        }
+        displayExpressions(currentExpressions);
+    };
+
+    eventSource.addEventListener("status", onEvent);
+    eventSource.addEventListener("progress", onEvent);
 }
 
 // Fetch expressions when the page loads
-window.onload = fetchExpressions;
\ No newline at end of file
+window.onload = function() {
+    fetchExpressions();
+    subscribeExpressions();
+};
\ No newline at end of file
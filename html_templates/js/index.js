@@ -150,7 +150,7 @@ function fetchExpression() {
     }
 
     var xhr = new XMLHttpRequest();
-    var url = window.location.protocol + "//" + window.location.host + "/api/v1/expressions?id=" + expressionId;
+    var url = window.location.protocol + "//" + window.location.host + "/api/v1/expressions/" + encodeURIComponent(expressionId);
     xhr.open("GET", url, true);
     xhr.setRequestHeader("Content-Type", "application/json");
 
@@ -227,7 +227,7 @@ function formatResult(result) {
         return num.toString();
     }
 
-    return num.toFixed(6).replace(/\.?0+$/, '');
+    return String(result).replace(/\.?0+$/, '');
 }
 
 window.onload = function() {
@@ -1,14 +1,17 @@
-function login() {
-    var username = document.getElementById("username").value;
-    var password = document.getElementById("password").value;
+// mfaToken is the challenge of a login whose password was right, when the
+// account has two-factor authentication
+var mfaToken = "";
 
-    if (username === "" || password === "") {
-        alert("Please enter both username and password.");
-        return;
-    }
+function showMFAStep() {
+    document.getElementById("password-step").style.display = "none";
+    document.getElementById("mfa-step").style.display = "block";
+    document.getElementById("login-result").style.display = "none";
+    document.getElementById("mfa-code").focus();
+}
 
+function loginRequest(path, data) {
     var xhr = new XMLHttpRequest();
-    var url = window.location.protocol + "//" + window.location.host + "/api/v1/login";
+    var url = window.location.protocol + "//" + window.location.host + path;
     xhr.open("POST", url, true);
     xhr.setRequestHeader("Content-Type", "application/json");
 
@@ -17,17 +20,57 @@ function login() {
             document.getElementById("login-result").style.display = "block";
             var response = JSON.parse(xhr.responseText);
 
-            if (xhr.status === 200) {
-                document.cookie = "token=" + response.token + "; path=/";
+            if (xhr.status === 200 && response.status === "mfa_required") {
+                mfaToken = response.mfa_token;
+                showMFAStep();
+            } else if (xhr.status === 200) {
                 document.getElementById("login-result").textContent = "Login successful!";               
                 window.location.replace(window.location.protocol + "//" + window.location.host + "/calculate");
             } else {    
-                console.error("Error:", response.error);
-                document.getElementById("login-result").textContent = "Error: " + response.error;
+                console.error("Error:", response.message);
+                document.getElementById("login-result").textContent = "Error: " + response.message;
             }
         }
     };
 
-    var data = JSON.stringify({ login: username, password: password });
-    xhr.send(data);
-}
\ No newline at end of file
+    xhr.send(JSON.stringify(data));
+}
+
+function login() {
+    var username = document.getElementById("username").value;
+    var password = document.getElementById("password").value;
+
+    if (username === "" || password === "") {
+        alert("Please enter both username and password.");
+        return;
+    }
+
+    loginRequest("/api/v1/login", { login: username, password: password });
+}
+
+function loginMFA() {
+    var code = document.getElementById("mfa-code").value;
+    if (code === "") {
+        alert("Please enter a code.");
+        return;
+    }
+
+    loginRequest("/api/v1/login/mfa", { mfa_token: mfaToken, code: code });
+}
+
+// a login with the OIDC provider comes back with an error, or with a
+// challenge if the user has two-factor authentication
+(function () {
+    var error = new URLSearchParams(window.location.search).get("error");
+    if (error) {
+        document.getElementById("login-result").textContent = "Error: " + error;
+        document.getElementById("login-result").style.display = "block";
+    }
+
+    var token = new URLSearchParams(window.location.hash.substring(1)).get("mfa_token");
+    if (token) {
+        mfaToken = token;
+        history.replaceState(null, "", window.location.pathname);
+        showMFAStep();
+    }
+})();
@@ -3,6 +3,7 @@ function register() {
     document.getElementById("register-result").style.display = "block"
     var username = document.getElementById("username").value;
     var password = document.getElementById("password").value;
+    var email = document.getElementById("email").value;
 
     if (username === "" || password === "") {
         alert("Please enter both username and password.");
@@ -21,16 +22,19 @@ function register() {
             var response = JSON.parse(xhr.responseText);
 
             if (xhr.status === 200) {
-                document.cookie = "token=" + response.token + "; path=/";
                 document.getElementById("register-result").textContent = "Registration successful!";
                 window.location.replace(window.location.protocol + "//" + window.location.host + "/calculate");
             } else {
-                console.error("Error:", response.error);
-                document.getElementById("register-result").textContent = "Error: " + response.error;
+                console.error("Error:", response.message);
+                var message = response.message;
+                if (Array.isArray(response.details)) {
+                    message += ": the password " + response.details.join(", ");
+                }
+                document.getElementById("register-result").textContent = "Error: " + message;
             }
         }
     };
 
-    var data = JSON.stringify({ login: username, password: password });
+    var data = JSON.stringify({ login: username, password: password, email: email });
     xhr.send(data);
 }
\ No newline at end of file
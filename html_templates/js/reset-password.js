@@ -0,0 +1,63 @@
+var token = new URLSearchParams(window.location.search).get("token");
+if (token) {
+    document.getElementById("request-form").style.display = "none";
+    document.getElementById("confirm-form").style.display = "block";
+}
+
+function showResult(text) {
+    var result = document.getElementById("reset-result");
+    result.textContent = text;
+    result.style.display = "block";
+}
+
+function send(path, body, onSuccess) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", window.location.protocol + "//" + window.location.host + path, true);
+    xhr.setRequestHeader("Content-Type", "application/json");
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status >= 200 && xhr.status < 300) {
+                onSuccess();
+                return;
+            }
+            var message = xhr.statusText;
+            try {
+                var response = JSON.parse(xhr.responseText);
+                message = response.message;
+                if (Array.isArray(response.details)) {
+                    message += ": the password " + response.details.join(", ");
+                }
+            } catch (e) {}
+            console.error("Error:", message);
+            showResult("Error: " + message);
+        }
+    };
+
+    xhr.send(JSON.stringify(body));
+}
+
+function requestReset() {
+    var username = document.getElementById("username").value;
+    if (username === "") {
+        alert("Please enter your username.");
+        return;
+    }
+
+    send("/api/v1/password/reset", { login: username }, function () {
+        showResult("If the account has an email address, a reset link has been sent to it.");
+    });
+}
+
+function confirmReset() {
+    var password = document.getElementById("password").value;
+    if (password === "") {
+        alert("Please enter a new password.");
+        return;
+    }
+
+    send("/api/v1/password/reset/confirm", { token: token, new_password: password }, function () {
+        showResult("Password changed, you can log in now.");
+        document.getElementById("confirm-form").style.display = "none";
+    });
+}
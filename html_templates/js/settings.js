@@ -0,0 +1,398 @@
+function apiRequest(method, path, body, onSuccess) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, window.location.protocol + "//" + window.location.host + path, true);
+    xhr.setRequestHeader("Content-Type", "application/json");
+
+    xhr.onreadystatechange = function () {
+        if (xhr.readyState === 4) {
+            if (xhr.status >= 200 && xhr.status < 300) {
+                document.getElementById("settings-result").style.display = "none";
+                onSuccess(xhr.status === 204 ? null : JSON.parse(xhr.responseText));
+            } else {
+                var message = xhr.statusText;
+                try {
+                    var response = JSON.parse(xhr.responseText);
+                    message = response.message;
+                    if (Array.isArray(response.details)) {
+                        message += ": the password " + response.details.join(", ");
+                    }
+                } catch (e) {}
+                console.error("Error:", message);
+                var result = document.getElementById("settings-result");
+                result.textContent = "Error: " + message;
+                result.style.display = "block";
+            }
+        }
+    };
+
+    xhr.send(body === null ? null : JSON.stringify(body));
+}
+
+function formatTime(unix) {
+    return unix ? new Date(unix * 1000).toLocaleString() : "never";
+}
+
+// workspace is the workspace of the switcher, which this section manages
+var workspace = null;
+
+var roleRanks = { viewer: 1, member: 2, admin: 3, owner: 4 };
+
+function workspaceCan(role) {
+    return roleRanks[workspace.role] >= roleRanks[role];
+}
+
+function fetchWorkspace() {
+    apiRequest("GET", "/api/v1/workspaces", null, function (response) {
+        var current = get_cookie("workspace");
+        var listed = response.workspaces.filter(function (ws) {
+            return current ? String(ws.id) === current : ws.personal;
+        })[0] || response.workspaces[0];
+        apiRequest("GET", "/api/v1/workspaces/" + listed.id, null, showWorkspace);
+    });
+}
+
+function showWorkspace(ws) {
+    workspace = ws;
+    document.getElementById("workspace-info").textContent = ws.personal
+        ? "Your personal workspace, nobody else can see its expressions. Create a workspace to share them."
+        : ws.name + ", you are " + ws.role + ". Members see the expressions of each other.";
+
+    var admin = workspaceCan("admin");
+    document.getElementById("workspace-settings").style.display = admin ? "flex" : "none";
+    document.getElementById("workspace-invite").style.display = admin && !ws.personal ? "flex" : "none";
+    document.getElementById("workspace-actions").style.display = ws.personal ? "none" : "flex";
+    document.getElementById("workspace-delete").style.display = workspaceCan("owner") ? "inline-block" : "none";
+
+    apiRequest("GET", "/api/v1/workspaces/" + ws.id + "/settings", null, function (settings) {
+        document.getElementById("workspace-default-timeout").value = settings.default_timeout_ms;
+        document.getElementById("workspace-max-timeout").value = settings.max_timeout_ms;
+        document.getElementById("workspace-max-wait").value = settings.max_wait_ms;
+        document.getElementById("workspace-precision").value = settings.precision;
+    });
+
+    showMembers(ws);
+    if (admin && !ws.personal) {
+        fetchInvites();
+    } else {
+        document.getElementById("invites").innerHTML = "";
+    }
+}
+
+function showMembers(ws) {
+    var membersDiv = document.getElementById("members");
+    membersDiv.innerHTML = "";
+    if (ws.personal) {
+        return;
+    }
+
+    ws.members.forEach(function (member) {
+        var memberDiv = document.createElement("div");
+        memberDiv.className = "expression";
+
+        var namePara = document.createElement("p");
+        namePara.textContent = member.login + ", " + member.role;
+
+        var joinedPara = document.createElement("p");
+        joinedPara.className = "small-text";
+        joinedPara.textContent = "Joined " + formatTime(member.joined);
+
+        memberDiv.appendChild(namePara);
+        memberDiv.appendChild(joinedPara);
+
+        var manage = workspaceCan("admin") && (member.role !== "owner" || workspaceCan("owner"));
+        if (manage) {
+            var roleSelect = document.createElement("select");
+            ["viewer", "member", "admin", "owner"].forEach(function (role) {
+                if (workspaceCan(role)) {
+                    var option = document.createElement("option");
+                    option.value = role;
+                    option.textContent = role;
+                    option.selected = role === member.role;
+                    roleSelect.appendChild(option);
+                }
+            });
+            roleSelect.onchange = function () {
+                apiRequest("PATCH", "/api/v1/workspaces/" + ws.id + "/members/" + member.user_id, { role: roleSelect.value }, fetchWorkspace);
+            };
+
+            var removeButton = document.createElement("button");
+            removeButton.textContent = "Remove";
+            removeButton.onclick = function () {
+                if (confirm("Remove " + member.login + " from the workspace?")) {
+                    apiRequest("DELETE", "/api/v1/workspaces/" + ws.id + "/members/" + member.user_id, null, fetchWorkspace);
+                }
+            };
+
+            memberDiv.appendChild(roleSelect);
+            memberDiv.appendChild(removeButton);
+        }
+        membersDiv.appendChild(memberDiv);
+    });
+}
+
+function fetchInvites() {
+    apiRequest("GET", "/api/v1/workspaces/" + workspace.id + "/invites", null, function (response) {
+        var invitesDiv = document.getElementById("invites");
+        invitesDiv.innerHTML = "";
+
+        response.invites.forEach(function (invite) {
+            var inviteDiv = document.createElement("div");
+            inviteDiv.className = "expression";
+
+            var rolePara = document.createElement("p");
+            rolePara.textContent = "Invite as " + invite.role + (invite.email ? " for " + invite.email : "");
+
+            var expiresPara = document.createElement("p");
+            expiresPara.className = "small-text";
+            expiresPara.textContent = "Expires " + formatTime(invite.expires);
+
+            var revokeButton = document.createElement("button");
+            revokeButton.textContent = "Revoke";
+            revokeButton.onclick = function () {
+                apiRequest("DELETE", "/api/v1/workspaces/" + workspace.id + "/invites/" + invite.id, null, fetchInvites);
+            };
+
+            inviteDiv.appendChild(rolePara);
+            inviteDiv.appendChild(expiresPara);
+            inviteDiv.appendChild(revokeButton);
+            invitesDiv.appendChild(inviteDiv);
+        });
+    });
+}
+
+function createWorkspace() {
+    var request = { name: document.getElementById("workspace-name").value };
+    apiRequest("POST", "/api/v1/workspaces", request, function (ws) {
+        switch_workspace(ws.id);
+    });
+}
+
+function saveWorkspaceSettings() {
+    var number = function (id) {
+        var value = document.getElementById(id).value;
+        return value === "" ? undefined : parseInt(value, 10);
+    };
+    var request = {
+        default_timeout_ms: number("workspace-default-timeout"),
+        max_timeout_ms: number("workspace-max-timeout"),
+        max_wait_ms: number("workspace-max-wait"),
+        precision: number("workspace-precision")
+    };
+    apiRequest("PATCH", "/api/v1/workspaces/" + workspace.id + "/settings", request, fetchWorkspace);
+}
+
+function createInvite() {
+    var request = {
+        role: document.getElementById("invite-role").value,
+        email: document.getElementById("invite-email").value
+    };
+    apiRequest("POST", "/api/v1/workspaces/" + workspace.id + "/invites", request, function (invite) {
+        document.getElementById("new-invite-url").textContent = new URL(invite.url, window.location.href).href;
+        document.getElementById("new-invite").style.display = "block";
+        document.getElementById("invite-email").value = "";
+        fetchInvites();
+    });
+}
+
+function leaveWorkspace() {
+    if (confirm("Leave " + workspace.name + "? You will need a new invite to come back.")) {
+        apiRequest("DELETE", "/api/v1/workspaces/" + workspace.id + "/members/me", null, function () {
+            delete_cookie("workspace");
+            window.location.reload();
+        });
+    }
+}
+
+function deleteWorkspace() {
+    if (confirm("Delete " + workspace.name + " with all of its expressions? This can't be undone.")) {
+        apiRequest("DELETE", "/api/v1/workspaces/" + workspace.id, null, function () {
+            delete_cookie("workspace");
+            window.location.reload();
+        });
+    }
+}
+
+// invite links end in #invite=<token>
+function inviteToken() {
+    var match = window.location.hash.match(/^#invite=(.+)$/);
+    return match ? decodeURIComponent(match[1]) : "";
+}
+
+function acceptInvite() {
+    apiRequest("POST", "/api/v1/invites/accept", { token: inviteToken() }, function (ws) {
+        history.replaceState(null, "", window.location.pathname);
+        switch_workspace(ws.id);
+    });
+}
+
+function fetchKeys() {
+    apiRequest("GET", "/api/v1/apikeys", null, function (response) {
+        var keysDiv = document.getElementById("keys");
+        keysDiv.innerHTML = "";
+        if (response.api_keys.length === 0) {
+            keysDiv.textContent = "No API keys";
+            return;
+        }
+
+        response.api_keys.forEach(function (key) {
+            var keyDiv = document.createElement("div");
+            keyDiv.className = "expression";
+
+            var namePara = document.createElement("p");
+            namePara.textContent = key.name + " (" + key.prefix + "…)";
+
+            var scopesPara = document.createElement("p");
+            scopesPara.className = "small-text";
+            scopesPara.textContent = "Scopes: " + (key.scopes.length > 0 ? key.scopes.join(", ") : "all");
+
+            var usedPara = document.createElement("p");
+            usedPara.className = "small-text";
+            usedPara.textContent = "Created " + formatTime(key.created) + ", expires " + formatTime(key.expires) + ", last used " + formatTime(key.last_used);
+
+            var revokeButton = document.createElement("button");
+            revokeButton.textContent = "Revoke";
+            revokeButton.onclick = function () {
+                if (confirm("Revoke the key " + key.name + "? Programs using it will stop working.")) {
+                    apiRequest("DELETE", "/api/v1/apikeys/" + key.id, null, fetchKeys);
+                }
+            };
+
+            keyDiv.appendChild(namePara);
+            keyDiv.appendChild(scopesPara);
+            keyDiv.appendChild(usedPara);
+            keyDiv.appendChild(revokeButton);
+            keysDiv.appendChild(keyDiv);
+        });
+    });
+}
+
+function createKey() {
+    var scopes = [];
+    ["calculate", "read"].forEach(function (scope) {
+        if (document.getElementById("scope-" + scope).checked) {
+            scopes.push(scope);
+        }
+    });
+
+    var request = { name: document.getElementById("key-name").value, scopes: scopes };
+    var days = parseInt(document.getElementById("key-expiry").value, 10);
+    if (days > 0) {
+        request.expires = Math.floor(Date.now() / 1000) + days * 24 * 60 * 60;
+    }
+
+    apiRequest("POST", "/api/v1/apikeys", request, function (key) {
+        document.getElementById("new-key-value").textContent = key.key;
+        document.getElementById("new-key").style.display = "block";
+        document.getElementById("key-name").value = "";
+        fetchKeys();
+    });
+}
+
+function fetchSessions() {
+    apiRequest("GET", "/api/v1/sessions", null, function (response) {
+        var sessionsDiv = document.getElementById("sessions");
+        sessionsDiv.innerHTML = "";
+
+        response.sessions.forEach(function (session) {
+            var sessionDiv = document.createElement("div");
+            sessionDiv.className = "expression";
+
+            var agentPara = document.createElement("p");
+            agentPara.textContent = (session.user_agent || "Unknown client") + (session.current ? " (this session)" : "");
+
+            var usedPara = document.createElement("p");
+            usedPara.className = "small-text";
+            usedPara.textContent = session.ip + ", logged in " + formatTime(session.created) + ", last refreshed " + formatTime(session.last_used);
+
+            sessionDiv.appendChild(agentPara);
+            sessionDiv.appendChild(usedPara);
+
+            if (!session.current) {
+                var revokeButton = document.createElement("button");
+                revokeButton.textContent = "Log out";
+                revokeButton.onclick = function () {
+                    apiRequest("DELETE", "/api/v1/sessions/" + session.id, null, fetchSessions);
+                };
+                sessionDiv.appendChild(revokeButton);
+            }
+            sessionsDiv.appendChild(sessionDiv);
+        });
+    });
+}
+
+function changePassword() {
+    var request = {
+        current_password: document.getElementById("current-password").value,
+        new_password: document.getElementById("new-password").value
+    };
+
+    apiRequest("POST", "/api/v1/password/change", request, function () {
+        document.getElementById("current-password").value = "";
+        document.getElementById("new-password").value = "";
+        var result = document.getElementById("password-result");
+        result.textContent = "Password changed, your other sessions are logged out.";
+        result.style.display = "block";
+        fetchSessions();
+    });
+}
+
+function fetchMFA() {
+    apiRequest("GET", "/api/v1/mfa", null, function (status) {
+        document.getElementById("mfa-status").textContent = status.totp_enabled
+            ? "On. " + status.recovery_codes_left + " recovery codes left."
+            : "Off. Logins only need your password.";
+        document.getElementById("mfa-off").style.display = status.totp_enabled ? "none" : "flex";
+        document.getElementById("mfa-on").style.display = status.totp_enabled ? "flex" : "none";
+        if (status.totp_enabled) {
+            document.getElementById("mfa-enroll").style.display = "none";
+        }
+    });
+}
+
+function showRecoveryCodes(response) {
+    document.getElementById("mfa-recovery-codes").textContent = response.recovery_codes.join(" ");
+    document.getElementById("mfa-recovery").style.display = "block";
+    document.getElementById("mfa-code").value = "";
+    fetchMFA();
+}
+
+function enrollTOTP() {
+    apiRequest("POST", "/api/v1/mfa/totp", null, function (enrollment) {
+        document.getElementById("mfa-secret").textContent = enrollment.secret;
+        document.getElementById("mfa-qr").src = "data:image/png;base64," + enrollment.qr_png;
+        document.getElementById("mfa-enroll").style.display = "block";
+        document.getElementById("mfa-verify-code").focus();
+    });
+}
+
+function verifyTOTP() {
+    var request = { code: document.getElementById("mfa-verify-code").value };
+    apiRequest("POST", "/api/v1/mfa/totp/verify", request, function (response) {
+        document.getElementById("mfa-verify-code").value = "";
+        showRecoveryCodes(response);
+    });
+}
+
+function regenerateRecoveryCodes() {
+    var request = { code: document.getElementById("mfa-code").value };
+    apiRequest("POST", "/api/v1/mfa/recovery-codes", request, showRecoveryCodes);
+}
+
+function disableTOTP() {
+    var request = { code: document.getElementById("mfa-code").value };
+    if (confirm("Turn off two-factor authentication? Logins will only need your password.")) {
+        apiRequest("DELETE", "/api/v1/mfa/totp", request, function () {
+            document.getElementById("mfa-code").value = "";
+            document.getElementById("mfa-recovery").style.display = "none";
+            fetchMFA();
+        });
+    }
+}
+
+if (inviteToken()) {
+    document.getElementById("workspace-accept").style.display = "block";
+}
+fetchWorkspace();
+fetchKeys();
+fetchMFA();
+fetchSessions();
@@ -5,35 +5,35 @@ import (
 	"encoding/json"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"time"
 
+	"github.com/Barsenick/calculator/internal/application/task"
 	"github.com/Barsenick/calculator/pkg/calc"
+	"github.com/google/uuid"
 )
 
-func SolveOperation(op rune, arg1, arg2 float64) (float64, error) {
-	switch op {
-	case '+':
-		return arg1 + arg2, nil
-	case '-':
-		return arg1 - arg2, nil
-	case '*':
-		return arg1 * arg2, nil
-	case '/':
-		if arg2 == 0 {
-			return 0, calc.Err422
-		}
-		return arg1 / arg2, nil
-	case '^':
-		return math.Pow(arg1, arg2), nil
+// reportResult sends the result to the orchestrator. The orchestrator answers
+// 410 Gone when the expression was cancelled in the meantime.
+func reportResult(request *http.Request, taskID int, agentID string) {
+	request.Header.Set(task.AgentHeader, agentID)
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusGone {
+		log.Printf("task %v was cancelled, result discarded\n", taskID)
 	}
-	return 0, calc.Err422
 }
 
 func StartAgent() {
-	url := "http://localhost" + calc.Port + "/internal/task"
-	log.Println("agent started on " + url)
+	url := "http://localhost" + task.Port + "/internal/task"
+	agentID := uuid.NewString()
+	log.Println("agent " + agentID + " started on " + url)
 
 	for {
 		time.Sleep(10 * time.Millisecond)
@@ -42,6 +42,7 @@ func StartAgent() {
 			log.Println(err1.Error())
 			continue
 		}
+		request.Header.Set(task.AgentHeader, agentID)
 
 		client := &http.Client{}
 		response, err2 := client.Do(request)
@@ -51,28 +52,26 @@ func StartAgent() {
 		}
 
 		if response.StatusCode == 200 {
-			task := calc.Task{}
+			t := task.Task{}
 			bodyBytes, err := io.ReadAll(response.Body)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
 
-			err3 := json.Unmarshal(bodyBytes, &task)
+			err3 := json.Unmarshal(bodyBytes, &t)
 			if err3 != nil {
 				response.Body.Close()
 				log.Println(err3.Error())
 				continue
 			}
-			if task.Operation != 0 {
-				calc.Tasks.M.Lock()
-				id := len(calc.Tasks.Tasks) - 1
-				calc.Tasks.M.Unlock()
+			if t.Operation != 0 {
+				id := t.TaskID
 
 				c := make(chan string, 1)
 				var res float64
 				var errop error
 				go func() {
-					res, errop = SolveOperation(task.Operation, task.Arg1, task.Arg2)
+					res, errop = calc.SolveLocally(t.Operation, t.Arg1, t.Arg2)
 					if errop != nil {
 						c <- errop.Error()
 						return
@@ -83,7 +82,7 @@ func StartAgent() {
 				select {
 				case opRes := <-c:
 					if opRes != "success" {
-						tr := calc.TaskResult{TaskID: id, Result: 0, Error: opRes}
+						tr := task.TaskResult{TaskID: id, Result: 0, Error: opRes}
 						js, err5 := json.Marshal(tr)
 						if err5 != nil {
 							response.Body.Close()
@@ -96,10 +95,9 @@ func StartAgent() {
 							log.Println(err6.Error())
 							continue
 						}
-						client := &http.Client{}
-						client.Do(request)
+						reportResult(request, tr.TaskID, agentID)
 					} else {
-						tr := calc.TaskResult{TaskID: task.TaskID, Result: res}
+						tr := task.TaskResult{TaskID: t.TaskID, Result: res}
 						js, err5 := json.Marshal(tr)
 						if err5 != nil {
 							response.Body.Close()
@@ -112,12 +110,11 @@ func StartAgent() {
 							log.Println(err6.Error())
 							continue
 						}
-						client := &http.Client{}
-						client.Do(request)
+						reportResult(request, tr.TaskID, agentID)
 						response.Body.Close()
 					}
-				case <-time.After(time.Duration(task.OperationTime) * time.Millisecond):
-					tr := calc.TaskResult{TaskID: id, Result: 0, Error: calc.ErrTimeout.Error()}
+				case <-time.After(time.Duration(t.OperationTime) * time.Millisecond):
+					tr := task.TaskResult{TaskID: id, Result: 0, Error: task.ErrTimeout.Error()}
 					js, err5 := json.Marshal(tr)
 					if err5 != nil {
 						response.Body.Close()
@@ -128,8 +125,7 @@ func StartAgent() {
 						response.Body.Close()
 						continue
 					}
-					client := &http.Client{}
-					client.Do(request)
+					reportResult(request, tr.TaskID, agentID)
 				}
 			}
 		}
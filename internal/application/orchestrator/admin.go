@@ -0,0 +1,577 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrUserDisabled = errors.New("the account is disabled")
+	ErrSelfUpdate   = errors.New("admins can't demote, disable or delete themselves")
+)
+
+type AdminUser struct {
+	ID          int64  `json:"id"`
+	Login       string `json:"login"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	MFA         bool   `json:"mfa"`
+	Expressions int    `json:"expressions"`
+	// Cap and Weight are the scheduler settings an admin gave the user, nil
+	// if those of the environment apply
+	Cap    *int `json:"cap,omitempty"`
+	Weight *int `json:"weight,omitempty"`
+}
+
+type AdminUsers struct {
+	Users []AdminUser `json:"users"`
+}
+
+// AdminUserUpdate changes the role and/or the state of a user, fields that
+// are left out stay as they are. MFA can only be set to false, which turns
+// off the two-factor authentication of a user who lost their codes. Cap and
+// Weight are passed to Scheduler.SetCap and Scheduler.SetWeight.
+type AdminUserUpdate struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+	MFA      *bool   `json:"mfa"`
+	Cap      *int    `json:"cap"`
+	Weight   *int    `json:"weight"`
+}
+
+// AdminExpression is an expression of any user.
+type AdminExpression struct {
+	Expression
+	OwnerID int64 `json:"owner_id"`
+}
+
+type AdminStatus struct {
+	Queue   []QueueStats  `json:"queue"`
+	Agents  []AgentStatus `json:"agents"`
+	Running int           `json:"running_expressions"`
+}
+
+// TimingSettings are the Timings in milliseconds. In a PATCH, the fields
+// that are left out or 0 stay as they are.
+type TimingSettings struct {
+	DefaultTimeoutMS int64            `json:"default_timeout_ms,omitempty"`
+	MaxTimeoutMS     int64            `json:"max_timeout_ms,omitempty"`
+	MaxWaitMS        int64            `json:"max_wait_ms,omitempty"`
+	OperationsMS     map[string]int64 `json:"operations_ms,omitempty"`
+}
+
+// BootstrapAdmin makes ADMIN_LOGIN an admin, creating it with ADMIN_PASSWORD
+// (or the contents of ADMIN_PASSWORD_FILE) if it doesn't exist yet. The
+// password of an existing user is left alone.
+func BootstrapAdmin(ctx context.Context) error {
+	login := os.Getenv("ADMIN_LOGIN")
+	if login == "" {
+		return nil
+	}
+
+	user, err := selectUser(ctx, DB, login)
+	if err == sql.ErrNoRows {
+		password := os.Getenv("ADMIN_PASSWORD")
+		if file := os.Getenv("ADMIN_PASSWORD_FILE"); file != "" {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		if password == "" {
+			return fmt.Errorf("%s doesn't exist, ADMIN_PASSWORD or ADMIN_PASSWORD_FILE is required to create it", login)
+		}
+
+		hash, err := generate(password)
+		if err != nil {
+			return err
+		}
+		user = User{Name: login, Password: hash}
+		if user.ID, err = insertUser(ctx, DB, &user); err != nil {
+			return err
+		}
+		log.Printf("Created the admin %s\n", login)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = DB.ExecContext(ctx, "UPDATE users SET role = $1, disabled = 0 WHERE id = $2", RoleAdmin, user.ID)
+	return err
+}
+
+func getAdminUsers(ctx context.Context, DB *sql.DB, query string) ([]AdminUser, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT users.id, users.login, users.role, users.disabled,
+		EXISTS(SELECT 1 FROM totp WHERE totp.ownerID = users.id AND totp.enabled = 1),
+		(SELECT COUNT(*) FROM expressions WHERE expressions.ownerID = users.id),
+		users.schedulerCap, users.schedulerWeight
+	FROM users WHERE users.login LIKE ? ESCAPE '\' ORDER BY users.id
+	`, "%"+likeEscaper.Replace(query)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := rows.Scan(&u.ID, &u.Login, &u.Role, &u.Disabled, &u.MFA, &u.Expressions, &u.Cap, &u.Weight); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func updateUser(ctx context.Context, DB *sql.DB, user User) error {
+	_, err := DB.ExecContext(ctx, "UPDATE users SET role = $1, disabled = $2 WHERE id = $3", user.Role, user.Disabled, user.ID)
+	return err
+}
+
+// updateUserScheduling stores the scheduler settings of the user which
+// aren't nil, see loadUserScheduling.
+func updateUserScheduling(ctx context.Context, DB *sql.DB, userID int64, cap, weight *int) error {
+	_, err := DB.ExecContext(ctx, "UPDATE users SET schedulerCap = COALESCE($1, schedulerCap), schedulerWeight = COALESCE($2, schedulerWeight) WHERE id = $3", cap, weight, userID)
+	return err
+}
+
+// deleteUser removes the user with everything it owns, after stopping its
+// pending expressions and ending its sessions.
+func deleteUser(ctx context.Context, DB *sql.DB, id int64) error {
+	rows, err := DB.QueryContext(ctx, "SELECT id FROM expressions WHERE ownerID = $1 AND status = '201'", id)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for rows.Next() {
+		var exprID string
+		if err := rows.Scan(&exprID); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, exprID)
+	}
+	rows.Close()
+	for _, exprID := range pending {
+		Running.Cancel(exprID)
+	}
+
+	if err := revokeSessions(ctx, DB, id); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// the workspaces nobody else is a member of go with the user, the
+	// expressions the user sent to the others stay there
+	workspaces, err := soleMemberWorkspaces(ctx, DB, id)
+	if err != nil {
+		return err
+	}
+	for _, workspaceID := range workspaces {
+		if err := deleteWorkspace(ctx, DB, workspaceID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		// the earliest member becomes owner of the workspaces losing their last one
+		`UPDATE workspace_members SET role = 'owner' WHERE rowid IN (
+			SELECT (SELECT m.rowid FROM workspace_members m WHERE m.workspaceID = o.workspaceID AND m.userID != $1 ORDER BY m.joined, m.rowid LIMIT 1)
+			FROM workspace_members o WHERE o.userID = $1 AND o.role = 'owner'
+			AND NOT EXISTS (SELECT 1 FROM workspace_members p WHERE p.workspaceID = o.workspaceID AND p.userID != $1 AND p.role = 'owner'))`,
+		"DELETE FROM workspace_members WHERE userID = $1",
+		"DELETE FROM webhooks WHERE ownerID = $1",
+		"DELETE FROM sessions WHERE ownerID = $1",
+		"DELETE FROM apikeys WHERE ownerID = $1",
+		"DELETE FROM password_resets WHERE ownerID = $1",
+		"DELETE FROM totp WHERE ownerID = $1",
+		"DELETE FROM recovery_codes WHERE ownerID = $1",
+		"DELETE FROM oidc_identities WHERE ownerID = $1",
+		"DELETE FROM users WHERE id = $1",
+	} {
+		if _, err := tx.ExecContext(ctx, q, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func createSettingsTable(ctx context.Context, DB *sql.DB) error {
+	const settingsTable = `
+	CREATE TABLE IF NOT EXISTS settings(
+		name TEXT PRIMARY KEY,
+		value INTEGER
+	);`
+
+	if _, err := DB.ExecContext(ctx, settingsTable); err != nil {
+		return err
+	}
+
+	return loadTimings(ctx, DB)
+}
+
+// loadTimings applies the timings admins have set over those of the
+// environment.
+func loadTimings(ctx context.Context, DB *sql.DB) error {
+	rows, err := DB.QueryContext(ctx, "SELECT name, value FROM settings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	t := *CurrentTimings()
+	t.Operations = maps.Clone(t.Operations)
+	for rows.Next() {
+		var (
+			name string
+			ms   int64
+		)
+		if err := rows.Scan(&name, &ms); err != nil {
+			return err
+		}
+		setTiming(&t, name, time.Duration(ms)*time.Millisecond)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	timings.Store(&t)
+	return nil
+}
+
+// setTiming changes the timing named after its environment variable,
+// unknown names are ignored.
+func setTiming(t *Timings, name string, d time.Duration) {
+	switch name {
+	case timingDefaultTimeout:
+		t.DefaultTimeout = d
+	case timingMaxTimeout:
+		t.MaxTimeout = d
+	case timingMaxWait:
+		t.MaxWait = d
+	}
+	for op, opName := range operationTimingNames {
+		if opName == name {
+			t.Operations[op] = d
+		}
+	}
+}
+
+func timingSettings(t *Timings) TimingSettings {
+	s := TimingSettings{
+		DefaultTimeoutMS: t.DefaultTimeout.Milliseconds(),
+		MaxTimeoutMS:     t.MaxTimeout.Milliseconds(),
+		MaxWaitMS:        t.MaxWait.Milliseconds(),
+		OperationsMS:     make(map[string]int64),
+	}
+	for op, d := range t.Operations {
+		s.OperationsMS[string(op)] = d.Milliseconds()
+	}
+	return s
+}
+
+// SetTimings changes the timings given in s and stores them, so that they
+// outlive a restart. Expressions being evaluated keep their timings.
+func SetTimings(ctx context.Context, DB *sql.DB, s TimingSettings) (*Timings, error) {
+	t := *CurrentTimings()
+	t.Operations = maps.Clone(t.Operations)
+	changed := map[string]time.Duration{}
+
+	set := func(name string, ms int64) error {
+		if ms < 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+		if ms > 0 {
+			changed[name] = time.Duration(ms) * time.Millisecond
+			setTiming(&t, name, changed[name])
+		}
+		return nil
+	}
+	if err := set(timingDefaultTimeout, s.DefaultTimeoutMS); err != nil {
+		return nil, err
+	}
+	if err := set(timingMaxTimeout, s.MaxTimeoutMS); err != nil {
+		return nil, err
+	}
+	if err := set(timingMaxWait, s.MaxWaitMS); err != nil {
+		return nil, err
+	}
+	for op, ms := range s.OperationsMS {
+		name, ok := "", false
+		if ops := []rune(op); len(ops) == 1 {
+			name, ok = operationTimingNames[ops[0]]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %q, expected +, -, *, / or ^", op)
+		}
+		if err := set(name, ms); err != nil {
+			return nil, err
+		}
+	}
+	if t.DefaultTimeout > t.MaxTimeout {
+		return nil, errors.New("the default timeout can't be longer than the maximum timeout")
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for name, d := range changed {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT(name) DO UPDATE SET value = excluded.value", name, d.Milliseconds()); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	timings.Store(&t)
+	return &t, nil
+}
+
+// adminTargetUser returns the user of the path, answering 404 if there is
+// none and 409 if it is the admin itself and self isn't allowed.
+func adminTargetUser(w http.ResponseWriter, r *http.Request, self bool) (User, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		generateErrorResponse(w, "user not found", http.StatusNotFound)
+		return User{}, false
+	}
+
+	user, err := selectUserByID(r.Context(), DB, id)
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, "user not found", http.StatusNotFound)
+		return User{}, false
+	}
+	if err != nil {
+		internalError(w, err)
+		return User{}, false
+	}
+
+	if !self {
+		if uid, ok := requireUser(w, r); !ok {
+			return User{}, false
+		} else if uid == user.ID {
+			generateErrorResponse(w, ErrSelfUpdate.Error(), http.StatusConflict)
+			return User{}, false
+		}
+	}
+	return user, true
+}
+
+func ApiAdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := getAdminUsers(r.Context(), DB, r.URL.Query().Get("q"))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(AdminUsers{Users: users})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiAdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, ok := adminTargetUser(w, r, false)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := deleteUser(ctx, DB, user.ID); err != nil {
+			internalError(w, err)
+			return
+		}
+		log.Printf("Request %s deleted the user %d\n", w.Header().Get(RequestIDHeader), user.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req AdminUserUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+	if req.Role != nil {
+		if *req.Role != RoleUser && *req.Role != RoleAdmin {
+			generateErrorResponse(w, fmt.Sprintf("role must be %s or %s", RoleUser, RoleAdmin), http.StatusBadRequest)
+			return
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if req.MFA != nil && *req.MFA {
+		generateErrorResponse(w, "mfa can only be turned off, users enroll themselves", http.StatusBadRequest)
+		return
+	}
+	if req.Cap != nil && *req.Cap < 0 {
+		generateErrorResponse(w, "cap must be 0 (unlimited) or more", http.StatusBadRequest)
+		return
+	}
+	if req.Weight != nil && *req.Weight < 1 {
+		generateErrorResponse(w, "weight must be 1 or more", http.StatusBadRequest)
+		return
+	}
+
+	if err := updateUser(ctx, DB, user); err != nil {
+		internalError(w, err)
+		return
+	}
+	if req.Cap != nil || req.Weight != nil {
+		if err := updateUserScheduling(ctx, DB, user.ID, req.Cap, req.Weight); err != nil {
+			internalError(w, err)
+			return
+		}
+		if req.Cap != nil {
+			TaskScheduler.SetCap(user.ID, *req.Cap)
+		}
+		if req.Weight != nil {
+			TaskScheduler.SetWeight(user.ID, *req.Weight)
+		}
+	}
+	if req.MFA != nil {
+		if err := deleteTOTP(ctx, DB, user.ID); err != nil {
+			internalError(w, err)
+			return
+		}
+		log.Printf("Request %s turned off the two-factor authentication of user %d\n", w.Header().Get(RequestIDHeader), user.ID)
+	}
+	if user.Disabled {
+		if err := revokeSessions(ctx, DB, user.ID); err != nil && err != sql.ErrNoRows {
+			internalError(w, err)
+			return
+		}
+	}
+
+	users, err := getAdminUsers(ctx, DB, user.Name)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	for _, u := range users {
+		if u.ID == user.ID {
+			json, err := json.Marshal(u)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			fmt.Fprint(w, string(json))
+			return
+		}
+	}
+	generateErrorResponse(w, "user not found", http.StatusNotFound)
+}
+
+func ApiAdminUserExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminTargetUser(w, r, true)
+	if !ok {
+		return
+	}
+
+	filter, err := parseExpressionFilter(r.URL.Query())
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.OwnerID = user.ID
+	exprs, nextCursor, err := getExpressions(r.Context(), DB, filter)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(Expressions{Expressions: exprs, NextCursor: nextCursor})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiAdminExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	expr, err := selectExpression(r.Context(), DB, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, "expression not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(AdminExpression{Expression: expr, OwnerID: expr.OwnerID})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiAdminStatusHandler(w http.ResponseWriter, r *http.Request) {
+	Running.mu.Lock()
+	running := len(Running.m)
+	Running.mu.Unlock()
+
+	json, err := json.Marshal(AdminStatus{Queue: TaskScheduler.Stats(), Agents: Agents.List(), Running: running})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiAdminTimingsHandler(w http.ResponseWriter, r *http.Request) {
+	t := CurrentTimings()
+
+	if r.Method == http.MethodPatch {
+		var req TimingSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if t, err = SetTimings(r.Context(), DB, req); err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Request %s changed the timings\n", w.Header().Get(RequestIDHeader))
+	}
+
+	json, err := json.Marshal(timingSettings(t))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
@@ -0,0 +1,167 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	t.Setenv("ADMIN_LOGIN", "root")
+	t.Setenv("ADMIN_PASSWORD", "secret")
+	if err := BootstrapAdmin(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a second start keeps the admin as it is
+	if err := BootstrapAdmin(ctx); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := selectUser(ctx, DB, "root")
+	if err != nil || admin.Role != RoleAdmin {
+		t.Fatalf("expected root to be an admin, got %+v, %v", admin, err)
+	}
+
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	insertExpression(ctx, DB, &Expression{Status: "200", Result: "2", Source: "1+1", OwnerID: uid})
+
+	token := func(id int64) string {
+		s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Token
+	}
+	adminToken, userToken := token(admin.ID), token(uid)
+
+	handler := NewRouter()
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request(http.MethodGet, "/api/v1/admin/users", userToken, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected users to be refused, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/api/v1/queue", userToken, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the queue to be admin only, got %d", w.Code)
+	}
+
+	w := request(http.MethodGet, "/api/v1/admin/users?q=ali", adminToken, "")
+	var users AdminUsers
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil || len(users.Users) != 1 || users.Users[0].Expressions != 1 {
+		t.Fatalf("unexpected users %d %s", w.Code, w.Body)
+	}
+
+	alice := "/api/v1/admin/users/" + strconv.FormatInt(uid, 10)
+	if w := request(http.MethodPatch, "/api/v1/admin/users/"+strconv.FormatInt(admin.ID, 10), adminToken, `{"disabled": true}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected the admin not to disable itself, got %d", w.Code)
+	}
+	if w := request(http.MethodPatch, alice, adminToken, `{"role": "root"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown role to be refused, got %d", w.Code)
+	}
+	if w := request(http.MethodPatch, alice, adminToken, `{"disabled": true}`); w.Code != http.StatusOK {
+		t.Fatalf("expected alice to be disabled, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodGet, "/api/v1/expressions", userToken, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the sessions of alice to end, got %d", w.Code)
+	}
+
+	previousScheduler := TaskScheduler
+	TaskScheduler = NewScheduler()
+	t.Cleanup(func() { TaskScheduler = previousScheduler })
+	if w := request(http.MethodPatch, alice, adminToken, `{"weight": 0}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a weight of 0 to be refused, got %d", w.Code)
+	}
+	w = request(http.MethodPatch, alice, adminToken, `{"cap": 2, "weight": 3}`)
+	var updated AdminUser
+	if err := json.Unmarshal(w.Body.Bytes(), &updated); err != nil || w.Code != http.StatusOK || updated.Cap == nil || *updated.Cap != 2 || updated.Weight == nil || *updated.Weight != 3 {
+		t.Fatalf("unexpected user %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodPatch, alice, adminToken, `{"weight": 4}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the weight to change, got %d %s", w.Code, w.Body)
+	}
+	if TaskScheduler.capOf(uid) != 2 || TaskScheduler.weightOf(uid) != 4 {
+		t.Fatalf("expected the scheduler to apply cap 2 and weight 4, got %d and %d", TaskScheduler.capOf(uid), TaskScheduler.weightOf(uid))
+	}
+	// the settings outlive a restart
+	restarted := NewScheduler()
+	if err := loadUserScheduling(ctx, DB, restarted); err != nil || restarted.capOf(uid) != 2 || restarted.weightOf(uid) != 4 {
+		t.Fatalf("expected the stored settings to be loaded, got %d and %d, %v", restarted.capOf(uid), restarted.weightOf(uid), err)
+	}
+
+	w = request(http.MethodGet, alice+"/expressions", adminToken, "")
+	var exprs Expressions
+	if err := json.Unmarshal(w.Body.Bytes(), &exprs); err != nil || len(exprs.Expressions) != 1 {
+		t.Fatalf("unexpected expressions %d %s", w.Code, w.Body)
+	}
+	w = request(http.MethodGet, "/api/v1/admin/expressions/"+exprs.Expressions[0].ID, adminToken, "")
+	var expr AdminExpression
+	if err := json.Unmarshal(w.Body.Bytes(), &expr); err != nil || expr.OwnerID != uid {
+		t.Fatalf("unexpected expression %d %s", w.Code, w.Body)
+	}
+
+	if w := request(http.MethodDelete, alice, adminToken, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected alice to be deleted, got %d %s", w.Code, w.Body)
+	}
+	if _, err := selectUserByID(ctx, DB, uid); err != sql.ErrNoRows {
+		t.Fatalf("expected alice to be gone, got %v", err)
+	}
+	if _, err := selectExpression(ctx, DB, exprs.Expressions[0].ID); err != sql.ErrNoRows {
+		t.Fatalf("expected the expressions of alice to be gone, got %v", err)
+	}
+
+	if w := request(http.MethodGet, "/api/v1/admin/status", adminToken, ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSetTimings(t *testing.T) {
+	original := CurrentTimings()
+	t.Cleanup(func() { timings.Store(original) })
+	useTestDB(t)
+	ctx := context.Background()
+	previous := CurrentTimings()
+
+	tests := []TimingSettings{
+		{DefaultTimeoutMS: -1},
+		{OperationsMS: map[string]int64{"%": 10}},
+		{OperationsMS: map[string]int64{"": 10}},
+		{DefaultTimeoutMS: previous.MaxTimeout.Milliseconds() + 1},
+	}
+	for _, test := range tests {
+		if _, err := SetTimings(ctx, DB, test); err == nil {
+			t.Errorf("expected %+v to be refused", test)
+		}
+	}
+	if CurrentTimings() != previous {
+		t.Fatal("expected refused timings to be left alone")
+	}
+
+	if _, err := SetTimings(ctx, DB, TimingSettings{MaxWaitMS: 1234, OperationsMS: map[string]int64{"+": 7}}); err != nil {
+		t.Fatal(err)
+	}
+	current := CurrentTimings()
+	if current.MaxWait != 1234*time.Millisecond || current.Operations['+'] != 7*time.Millisecond || current.Operations['-'] != previous.Operations['-'] {
+		t.Fatalf("unexpected timings %+v", current)
+	}
+
+	// the stored timings are applied again on startup
+	timings.Store(previous)
+	if err := loadTimings(ctx, DB); err != nil {
+		t.Fatal(err)
+	}
+	if current := CurrentTimings(); current.MaxWait != 1234*time.Millisecond || current.Operations['+'] != 7*time.Millisecond {
+		t.Fatalf("expected the stored timings, got %+v", current)
+	}
+}
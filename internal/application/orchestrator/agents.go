@@ -0,0 +1,79 @@
+package application
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Barsenick/calculator/internal/application/task"
+)
+
+// agents poll for tasks every few milliseconds, one that hasn't for this
+// long is considered gone
+const (
+	agentOfflineAfter = 10 * time.Second
+	agentForgetAfter  = time.Hour
+)
+
+type AgentStatus struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	LastSeen int64  `json:"last_seen"`
+	Online   bool   `json:"online"`
+	// Busy is true while the agent computes a task.
+	Busy      bool `json:"busy"`
+	TasksDone int  `json:"tasks_done"`
+}
+
+type agentRegistry struct {
+	m  map[string]*AgentStatus
+	mu sync.Mutex
+}
+
+var Agents = agentRegistry{m: make(map[string]*AgentStatus)}
+
+// Seen records a request of the agent. Agents which don't send their ID
+// are told apart by their address.
+func (ar *agentRegistry) Seen(r *http.Request, busy, done bool) {
+	id := r.Header.Get(task.AgentHeader)
+	if id == "" || len(id) > 64 {
+		id = clientIP(r)
+	}
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	a, ok := ar.m[id]
+	if !ok {
+		a = &AgentStatus{ID: id}
+		ar.m[id] = a
+	}
+	a.Address = clientIP(r)
+	a.LastSeen = time.Now().Unix()
+	a.Busy = busy
+	if done {
+		a.TasksDone++
+	}
+}
+
+// List reports the agents seen within the last hour.
+func (ar *agentRegistry) List() []AgentStatus {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	now := time.Now()
+	agents := make([]AgentStatus, 0, len(ar.m))
+	for id, a := range ar.m {
+		lastSeen := time.Unix(a.LastSeen, 0)
+		if now.Sub(lastSeen) > agentForgetAfter {
+			delete(ar.m, id)
+			continue
+		}
+		status := *a
+		status.Online = now.Sub(lastSeen) <= agentOfflineAfter
+		agents = append(agents, status)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
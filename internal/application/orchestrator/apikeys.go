@@ -0,0 +1,312 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"github.com/golang-jwt/jwt"
+)
+
+// API keys let programs use the API without logging in. They are sent as
+// "Authorization: ApiKey <key>", and only their SHA-256 is stored, like the
+// refresh tokens. A key may be limited to scopes; a key without any has the
+// access of its user.
+
+const (
+	ScopeCalculate = client.ScopeCalculate
+	ScopeRead      = client.ScopeRead
+)
+
+const (
+	apiKeyPrefix      = "calc_"
+	maxAPIKeyName     = 100
+	maxAPIKeysPerUser = 50
+	// last_used is only written once a minute, not on every request
+	apiKeyUsedPrecision = time.Minute
+)
+
+var (
+	ErrInsufficientScope = errors.New("the API key lacks the scope of this request")
+	ErrAPIKeyNotAllowed  = errors.New("API keys can't be used here, log in instead")
+)
+
+type (
+	APIKey        = client.APIKey
+	APIKeyRequest = client.APIKeyRequest
+	APIKeyList    = client.APIKeyList
+)
+
+func createAPIKeysTable(ctx context.Context, DB *sql.DB) error {
+	const apiKeysTable = `
+	CREATE TABLE IF NOT EXISTS apikeys(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ownerID INTEGER,
+		name TEXT,
+		prefix TEXT,
+		hash TEXT UNIQUE,
+		scopes TEXT,
+		created INTEGER,
+		expires INTEGER DEFAULT 0,
+		lastUsed INTEGER DEFAULT 0,
+		revoked INTEGER DEFAULT 0,
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	_, err := DB.ExecContext(ctx, apiKeysTable)
+	return err
+}
+
+// calculateRoutes are the routes of the calculate scope, which evaluate
+// expressions.
+var calculateRoutes = map[string]bool{
+	"POST /api/v1/calculate":              true,
+	"POST /api/v1/calculate/batch":        true,
+	"POST /api/v1/expressions/import":     true,
+	"POST /api/v1/expressions/{id}/rerun": true,
+}
+
+// requiredScope is the scope the route of a request needs: the calculate
+// routes need calculate, reading needs read and anything else can't be done
+// with a scoped key at all, which "" tells.
+func requiredScope(r *http.Request) string {
+	if calculateRoutes[r.Pattern] {
+		return ScopeCalculate
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ScopeRead
+	}
+	return ""
+}
+
+func validateAPIKeyRequest(req *APIKeyRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if utf8.RuneCountInString(req.Name) > maxAPIKeyName {
+		return fmt.Errorf("name is longer than %d characters", maxAPIKeyName)
+	}
+
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if scope != ScopeCalculate && scope != ScopeRead {
+			return fmt.Errorf("unknown scope %q, expected %s or %s", scope, ScopeCalculate, ScopeRead)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	req.Scopes = scopes
+
+	if req.Expires != 0 && req.Expires <= time.Now().Unix() {
+		return errors.New("expires is in the past")
+	}
+	return nil
+}
+
+func insertAPIKey(ctx context.Context, DB *sql.DB, userID int64, req APIKeyRequest) (APIKey, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return APIKey{}, err
+	}
+
+	key := APIKey{
+		Name:    req.Name,
+		Scopes:  req.Scopes,
+		Created: time.Now().Unix(),
+		Expires: req.Expires,
+		Key:     apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b),
+	}
+	key.Prefix = key.Key[:len(apiKeyPrefix)+6]
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+
+	result, err := DB.ExecContext(ctx, `
+	INSERT INTO apikeys (ownerID, name, prefix, hash, scopes, created, expires) values ($1, $2, $3, $4, $5, $6, $7)
+	`, userID, key.Name, key.Prefix, hashSecret(key.Key), strings.Join(key.Scopes, ","), key.Created, key.Expires)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key.ID, err = result.LastInsertId()
+	return key, err
+}
+
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, int64, error) {
+	var (
+		key     APIKey
+		ownerID int64
+		scopes  string
+	)
+	if err := row.Scan(&key.ID, &ownerID, &key.Name, &key.Prefix, &scopes, &key.Created, &key.Expires, &key.LastUsed); err != nil {
+		return APIKey{}, 0, err
+	}
+	key.Scopes = []string{}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	return key, ownerID, nil
+}
+
+const apiKeyColumns = "id, ownerID, name, prefix, scopes, created, expires, lastUsed"
+
+// getUserAPIKeys lists the keys of the user which are neither revoked nor expired.
+func getUserAPIKeys(ctx context.Context, DB *sql.DB, userID int64) ([]APIKey, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM apikeys WHERE ownerID = ? AND revoked = 0 AND (expires = 0 OR expires > ?) ORDER BY id", userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, _, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func revokeAPIKey(ctx context.Context, DB *sql.DB, id string, userID int64) (int64, error) {
+	result, err := DB.ExecContext(ctx, "UPDATE apikeys SET revoked = ? WHERE id = ? AND ownerID = ? AND revoked = 0", time.Now().Unix(), id, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// apiKeyToken authenticates the request with an API key. The claims get the
+// id of the owner, like those of a JWT, and the apikey ID.
+func apiKeyToken(r *http.Request, secret string, claims *jwt.MapClaims) (*jwt.Token, error) {
+	ctx := r.Context()
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	key, ownerID, err := scanAPIKey(DB.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM apikeys WHERE hash = ? AND revoked = 0 AND ownerID IN (SELECT id FROM users WHERE disabled = 0)", hashSecret(secret)))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if key.Expires != 0 && key.Expires <= now.Unix() {
+		return nil, ErrInvalidToken
+	}
+	if scope := requiredScope(r); len(key.Scopes) > 0 && (scope == "" || !slices.Contains(key.Scopes, scope)) {
+		return nil, ErrInsufficientScope
+	}
+
+	if now.Sub(time.Unix(key.LastUsed, 0)) >= apiKeyUsedPrecision {
+		// a failed write mustn't fail the request
+		DB.ExecContext(ctx, "UPDATE apikeys SET lastUsed = ? WHERE id = ?", now.Unix(), key.ID)
+	}
+
+	(*claims)["id"] = float64(ownerID)
+	(*claims)["apikey"] = float64(key.ID)
+	return &jwt.Token{Claims: *claims, Valid: true}, nil
+}
+
+// requireLogin is requireUser for the endpoints which manage the
+// credentials of the user, which an API key must not reach.
+func requireLogin(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if method, _, _ := requestCredentials(r); method == AuthAPIKey {
+		generateErrorResponse(w, ErrAPIKeyNotAllowed.Error(), http.StatusForbidden)
+		return 0, false
+	}
+	return requireUser(w, r)
+}
+
+func ApiAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := getUserAPIKeys(ctx, DB, uid)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		json, err := json.Marshal(APIKeyList{APIKeys: keys})
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		fmt.Fprint(w, string(json))
+
+	case http.MethodPost:
+		var req APIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		if err := validateAPIKeyRequest(&req); err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		keys, err := getUserAPIKeys(ctx, DB, uid)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if len(keys) >= maxAPIKeysPerUser {
+			generateErrorResponse(w, "too many API keys, revoke one first", http.StatusConflict)
+			return
+		}
+
+		key, err := insertAPIKey(ctx, DB, uid, req)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		json, err := json.Marshal(key)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, string(json))
+	}
+}
+
+func ApiRevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := strconv.ParseInt(r.PathValue("id"), 10, 64); err != nil {
+		generateErrorResponse(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	n, err := revokeAPIKey(context.TODO(), DB, r.PathValue("id"), uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if n == 0 {
+		generateErrorResponse(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestAPIKeys(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(auth string, req APIKeyRequest) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(req)
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/apikeys", bytes.NewReader(b))
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		ApiAPIKeysHandler(w, r)
+		return w
+	}
+
+	if w := create("Bearer "+session.Token, APIKeyRequest{Name: "ci", Scopes: []string{"write"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown scope to be refused, got %d", w.Code)
+	}
+
+	w := create("Bearer "+session.Token, APIKeyRequest{Name: "ci", Scopes: []string{ScopeRead, ScopeRead}})
+	var key APIKey
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil || w.Code != http.StatusCreated || key.Key == "" || len(key.Scopes) != 1 {
+		t.Fatalf("unexpected key %d %s", w.Code, w.Body)
+	}
+
+	// keys can't create more keys
+	if w := create("ApiKey "+key.Key, APIKeyRequest{Name: "more"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+
+	tests := []struct {
+		method string
+		auth   string
+		err    error
+	}{
+		{http.MethodGet, "ApiKey " + key.Key, nil},
+		{http.MethodPost, "ApiKey " + key.Key, ErrInsufficientScope},
+		{http.MethodGet, "ApiKey " + key.Key + "x", ErrInvalidToken},
+		{http.MethodGet, "ApiKey " + session.RefreshToken, ErrInvalidToken},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/expressions", nil)
+		r.Header.Set("Authorization", test.auth)
+		claims := jwt.MapClaims{}
+		_, err := getToken(r, &claims)
+		if err != test.err {
+			t.Errorf("%s %s: expected %v, got %v", test.method, test.auth, test.err, err)
+		}
+		if err == nil && claims["id"] != float64(uid) {
+			t.Errorf("expected the key to act as the user, got %v", claims)
+		}
+	}
+
+	keys, err := getUserAPIKeys(ctx, DB, uid)
+	if err != nil || len(keys) != 1 || keys[0].Key != "" || keys[0].LastUsed < time.Now().Unix()-5 {
+		t.Fatalf("expected the used key without its secret, got %+v, %v", keys, err)
+	}
+
+	if n, err := revokeAPIKey(ctx, DB, "1", uid+1); err != nil || n != 0 {
+		t.Fatalf("expected the key of another user to be kept, got %d, %v", n, err)
+	}
+	if n, err := revokeAPIKey(ctx, DB, "1", uid); err != nil || n != 1 {
+		t.Fatalf("expected the key to be revoked, got %d, %v", n, err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil)
+	r.Header.Set("Authorization", "ApiKey "+key.Key)
+	if _, err := getToken(r, nil); err != ErrInvalidToken {
+		t.Fatalf("expected the revoked key to be refused, got %v", err)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{}
+	for name, scopes := range map[string][]string{"read": {ScopeRead}, "calculate": {ScopeCalculate}, "all": nil} {
+		key, err := insertAPIKey(ctx, DB, uid, APIKeyRequest{Name: name, Scopes: scopes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = "ApiKey " + key.Key
+	}
+	keys["session"] = "Bearer " + session.Token
+
+	expr := Expression{Status: "200", Result: "7", Source: "7", OwnerID: uid}
+	id, err := insertExpression(ctx, DB, &expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/v1/expressions/" + strconv.FormatInt(id, 10)
+
+	handler := NewRouter()
+	// refused tells why the request was refused, if it was
+	refused := func(method, path, auth, body string) error {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			return nil
+		}
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return errors.New(resp.Message)
+	}
+
+	tests := []struct {
+		method, path, body string
+		// the keys whose requests are refused and why
+		refused map[string]error
+	}{
+		{http.MethodPost, "/api/v1/calculate", `{"expression": "7"}`, map[string]error{"read": ErrInsufficientScope}},
+		{http.MethodPost, "/api/v1/calculate/batch", `{"expressions": [{"expression": "7"}]}`, map[string]error{"read": ErrInsufficientScope}},
+		{http.MethodPost, path + "/rerun", ``, map[string]error{"read": ErrInsufficientScope}},
+		{http.MethodGet, "/api/v1/expressions", ``, map[string]error{"calculate": ErrInsufficientScope}},
+		{http.MethodGet, path, ``, map[string]error{"calculate": ErrInsufficientScope}},
+		// nothing but the routes above may be used with a scoped key
+		{http.MethodPatch, path, `{"label": "x"}`, map[string]error{"read": ErrInsufficientScope, "calculate": ErrInsufficientScope}},
+		{http.MethodPost, path + "/cancel", ``, map[string]error{"read": ErrInsufficientScope, "calculate": ErrInsufficientScope}},
+		{http.MethodPost, "/api/v1/workspaces", `{"name": "Team"}`, map[string]error{"read": ErrInsufficientScope, "calculate": ErrInsufficientScope}},
+		// the webhook secret is a credential of the user
+		{http.MethodGet, "/api/v1/webhooks", ``, map[string]error{"read": ErrAPIKeyNotAllowed, "calculate": ErrInsufficientScope, "all": ErrAPIKeyNotAllowed}},
+		{http.MethodDelete, path, ``, map[string]error{"read": ErrInsufficientScope, "calculate": ErrInsufficientScope}},
+	}
+	for _, test := range tests {
+		for _, name := range []string{"read", "calculate", "all", "session"} {
+			err := refused(test.method, test.path, keys[name], test.body)
+			if want := test.refused[name]; fmt.Sprint(err) != fmt.Sprint(want) {
+				t.Errorf("%s %s with %s: expected %v, got %v", test.method, test.path, name, want, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package application
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// AuthMethod is how a request proves who makes it.
+type AuthMethod string
+
+const (
+	// AuthBearer is an access token in the Authorization header.
+	AuthBearer AuthMethod = "bearer"
+	// AuthAPIKey is an API key in the Authorization header.
+	AuthAPIKey AuthMethod = "apikey"
+	// AuthCookie is an access token in the token cookie of a browser.
+	AuthCookie AuthMethod = "cookie"
+)
+
+const (
+	CSRFCookie = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+var (
+	ErrInvalidAuthScheme = errors.New("unsupported authorization scheme, use Bearer or ApiKey")
+	ErrCSRF              = errors.New("missing or invalid CSRF token")
+)
+
+// Principal is the user a request is made for, as found by the auth
+// middlewares. Handlers get it with requestPrincipal.
+type Principal struct {
+	UserID int64
+	Method AuthMethod
+	// SessionID is the session of an access token, empty for API keys.
+	SessionID string
+	// APIKeyID is the key the request is made with, if any.
+	APIKeyID int64
+}
+
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, p Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// requestPrincipal returns the principal the auth middlewares put in the
+// context of the request. Routes without them, such as the logout, get the
+// principal from the credentials of the request instead.
+func requestPrincipal(r *http.Request) (Principal, bool) {
+	if p, ok := r.Context().Value(principalKey{}).(Principal); ok {
+		return p, true
+	}
+	p, err := authenticateRequest(r)
+	return p, err == nil
+}
+
+// requestCredentials returns the credentials of the request and how they are
+// sent. The Authorization header wins over the token cookie: a client which
+// sends the header means it, and a broken header is refused instead of
+// falling back to a cookie the client may not even know about.
+func requestCredentials(r *http.Request) (AuthMethod, string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, credential, _ := strings.Cut(header, " ")
+		credential = strings.TrimSpace(credential)
+		switch {
+		case credential == "":
+			return "", "", ErrInvalidToken
+		case strings.EqualFold(scheme, "Bearer"):
+			return AuthBearer, credential, nil
+		case strings.EqualFold(scheme, "ApiKey"):
+			return AuthAPIKey, credential, nil
+		}
+		return "", "", ErrInvalidAuthScheme
+	}
+	if cookie, err := r.Cookie(TokenCookie); err == nil && cookie.Value != "" {
+		return AuthCookie, cookie.Value, nil
+	}
+	return "", "", ErrNoToken
+}
+
+// getToken returns the access token of the request, or a token holding the
+// owner of its API key. Tokens of revoked sessions are invalid.
+func getToken(r *http.Request, claims *jwt.MapClaims) (*jwt.Token, error) {
+	method, credential, err := requestCredentials(r)
+	if errors.Is(err, ErrInvalidAuthScheme) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if claims == nil {
+		claims = &jwt.MapClaims{}
+	}
+	if method == AuthAPIKey {
+		return apiKeyToken(r, credential, claims)
+	}
+	token, err := parseTokenWithClaims(credential, claims)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	sid, _ := (*claims)["sid"].(string)
+	if sid == "" || Revoked.Contains(sid) {
+		return nil, ErrInvalidToken
+	}
+	return token, nil
+}
+
+// authenticateRequest finds the principal of the request from its
+// credentials.
+func authenticateRequest(r *http.Request) (Principal, error) {
+	method, _, err := requestCredentials(r)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := getToken(r, &claims); err != nil {
+		return Principal{}, err
+	}
+	id, ok := claims["id"].(float64)
+	if !ok {
+		return Principal{}, ErrInvalidToken
+	}
+
+	p := Principal{UserID: int64(id), Method: method}
+	p.SessionID, _ = claims["sid"].(string)
+	if key, ok := claims["apikey"].(float64); ok {
+		p.APIKeyID = int64(key)
+	}
+	return p, nil
+}
+
+// authenticateBrowser is authenticateRequest which renews an expired token
+// cookie with the refresh cookie. Credentials in a header are never renewed.
+func authenticateBrowser(w http.ResponseWriter, r *http.Request) (Principal, error) {
+	p, err := authenticateRequest(r)
+	if err == nil || errors.Is(err, ErrInsufficientScope) || r.Header.Get("Authorization") != "" {
+		return p, err
+	}
+	if !refreshSessionCookies(w, r) {
+		return p, err
+	}
+	return authenticateRequest(r)
+}
+
+// requireUser returns the ID of the user the request is authenticated as. If
+// there is none, 401 is already written to w.
+func requireUser(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	p, ok := requestPrincipal(r)
+	if !ok {
+		unauthorized(w)
+		return 0, false
+	}
+	return p.UserID, true
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	generateErrorResponse(w, "missing or invalid token", http.StatusUnauthorized)
+}
+
+// authMiddleware lets only logged in browsers see a page and sends the
+// others to the login page.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticateBrowser(w, r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		// the pages of sessions from before the CSRF cookie get one
+		setCSRFCookie(w, r)
+		next.ServeHTTP(w, withPrincipal(r, p))
+	})
+}
+
+// apiAuthMiddleware is authMiddleware for the API, which answers 401
+// instead of redirecting to the login page. Requests authenticated with the
+// token cookie must also pass the CSRF check.
+func apiAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticateBrowser(w, r)
+		if errors.Is(err, ErrInsufficientScope) {
+			generateErrorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			unauthorized(w)
+			return
+		}
+		if p.Method == AuthCookie && !validCSRF(r) {
+			generateErrorResponse(w, ErrCSRF.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, withPrincipal(r, p))
+	})
+}
+
+// validCSRF tells whether a request may change anything on behalf of the
+// browser it comes from. Other sites can make the browser send its cookies,
+// but can't read the CSRF cookie to copy it into the header
+// (double-submit cookie).
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.Header.Get(CSRFHeader))) == 1
+}
+
+// setCSRFCookie gives the browser a CSRF token unless it has one. The token
+// is kept when the session is refreshed, so that requests which are under
+// way don't fail.
+func setCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(CSRFCookie); err == nil && cookie.Value != "" {
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		return
+	}
+	// the scripts of the pages read the cookie, so it isn't HttpOnly
+	http.SetCookie(w, &http.Cookie{Name: CSRFCookie, Value: token, Path: "/", Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+}
+
+// CORSOrigins are the origins, such as https://app.example.com, whose pages
+// may call the API. The orchestrator's own pages don't need to be listed.
+var CORSOrigins = corsOrigins(os.Getenv("CORS_ORIGINS"))
+
+// corsOrigins parses a comma separated list of origins. Entries which aren't
+// an origin are left out.
+func corsOrigins(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		u, err := url.Parse(origin)
+		if origin == "" || err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			continue
+		}
+		origins = append(origins, strings.ToLower(origin))
+	}
+	return origins
+}
+
+// CORSMiddleware lets the pages of the origins in CORSOrigins call the
+// routes and answers their preflight requests. Other origins get no CORS
+// headers, so browsers keep their pages from reading the responses.
+func CORSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && slices.Contains(CORSOrigins, strings.ToLower(origin))
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader+", Retry-After")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+CSRFHeader+", "+RequestIDHeader+", "+WorkspaceHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
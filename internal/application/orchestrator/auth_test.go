@@ -0,0 +1,196 @@
+package application
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAuthPrecedence(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	alice, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	bob, _ := insertUser(ctx, DB, &User{Name: "bob", Password: "hash"})
+	aliceSession, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSession, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Principal
+	handler := apiAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = r.Context().Value(principalKey{}).(Principal)
+	}))
+
+	tests := []struct {
+		name   string
+		cookie string
+		header string
+		code   int
+		user   int64
+		method AuthMethod
+	}{
+		{"cookie", aliceSession.Token, "", http.StatusOK, alice, AuthCookie},
+		{"header wins", aliceSession.Token, "Bearer " + bobSession.Token, http.StatusOK, bob, AuthBearer},
+		{"lowercase scheme", "", "bearer " + bobSession.Token, http.StatusOK, bob, AuthBearer},
+		{"no fallback to the cookie", aliceSession.Token, "Bearer nope", http.StatusUnauthorized, 0, ""},
+		{"unknown scheme", aliceSession.Token, "Basic YWxpY2U6cHc=", http.StatusUnauthorized, 0, ""},
+		{"raw token", "", bobSession.Token, http.StatusUnauthorized, 0, ""},
+		{"nothing", "", "", http.StatusUnauthorized, 0, ""},
+	}
+	for _, test := range tests {
+		got = Principal{}
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil)
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: TokenCookie, Value: test.cookie})
+		}
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, w.Code)
+		}
+		if got.UserID != test.user || got.Method != test.method {
+			t.Errorf("%s: expected user %d by %q, got %+v", test.name, test.user, test.method, got)
+		}
+	}
+}
+
+func TestAuthMiddlewareRedirect(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if _, ok := requireUser(w, r); !ok {
+			t.Error("expected the principal in the context")
+		}
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/settings", nil)
+	r.AddCookie(&http.Cookie{Name: TokenCookie, Value: "nope"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login" || called {
+		t.Fatalf("expected only a redirect to the login page, got %d %q, handler called: %v", w.Code, w.Header().Get("Location"), called)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/settings", nil)
+	r.AddCookie(&http.Cookie{Name: TokenCookie, Value: session.Token})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !called {
+		t.Fatalf("expected the page, got %d", w.Code)
+	}
+	if !slices.ContainsFunc(w.Result().Cookies(), func(c *http.Cookie) bool { return c.Name == CSRFCookie && c.Value != "" && !c.HttpOnly }) {
+		t.Fatal("expected the page to set a CSRF cookie the scripts can read")
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	tests := []struct {
+		name         string
+		method       string
+		bearer       bool
+		cookie, csrf string
+		code         int
+	}{
+		{"no token", http.MethodDelete, false, "", "", http.StatusForbidden},
+		{"no cookie", http.MethodDelete, false, "", "abc", http.StatusForbidden},
+		{"other token", http.MethodDelete, false, "abc", "abd", http.StatusForbidden},
+		{"same token", http.MethodDelete, false, "abc", "abc", http.StatusNotFound},
+		{"reads", http.MethodGet, false, "", "", http.StatusOK},
+		{"bearer", http.MethodDelete, true, "", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		path := "/api/v1/apikeys/42"
+		if test.method == http.MethodGet {
+			path = "/api/v1/apikeys"
+		}
+		r := httptest.NewRequest(test.method, path, nil)
+		if test.bearer {
+			withBearer(r, session.Token)
+		} else {
+			r.AddCookie(&http.Cookie{Name: TokenCookie, Value: session.Token})
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: test.cookie})
+		}
+		if test.csrf != "" {
+			r.Header.Set(CSRFHeader, test.csrf)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.code, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	previous := CORSOrigins
+	CORSOrigins = corsOrigins(" https://App.example.com/, not an origin, http://localhost:3000, https://example.com/path")
+	t.Cleanup(func() { CORSOrigins = previous })
+	if !slices.Equal(CORSOrigins, []string{"https://app.example.com", "http://localhost:3000"}) {
+		t.Fatalf("unexpected origins %q", CORSOrigins)
+	}
+
+	handler := NewRouter()
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/openapi.json", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(http.MethodOptions, "https://app.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("expected the preflight to be allowed, got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Headers") == "" || w.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Fatalf("expected the allowed methods and headers, got %v", w.Header())
+	}
+
+	w = request(http.MethodOptions, "https://evil.example.com")
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected the preflight to be refused, got %d %v", w.Code, w.Header())
+	}
+
+	w = request(http.MethodGet, "https://evil.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "Origin" {
+		t.Fatalf("expected no CORS headers for another origin, got %d %v", w.Code, w.Header())
+	}
+	w = request(http.MethodGet, "http://localhost:3000")
+	if w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3000" {
+		t.Fatalf("expected the origin to be allowed, got %v", w.Header())
+	}
+}
@@ -0,0 +1,302 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MaxBatchSize = 10000
+	// BatchWorkers is how many expressions of a single batch are evaluated at once.
+	BatchWorkers = 16
+)
+
+type BatchItem struct {
+	Request
+	Key string `json:"key,omitempty"`
+}
+
+type BatchRequest struct {
+	Expressions []BatchItem `json:"expressions"`
+}
+
+type BatchResponse struct {
+	ID  int64   `json:"id"`
+	IDs []int64 `json:"ids"`
+}
+
+type BatchExpression struct {
+	ID     string `json:"id"`
+	Key    string `json:"key,omitempty"`
+	Status string `json:"status"`
+	Result string `json:"result"`
+}
+
+type BatchStatus struct {
+	ID          int64             `json:"id"`
+	Total       int               `json:"total"`
+	Pending     int               `json:"pending"`
+	Succeeded   int               `json:"succeeded"`
+	Failed      int               `json:"failed"`
+	Done        bool              `json:"done"`
+	Expressions []BatchExpression `json:"expressions"`
+}
+
+func createBatchesTable(ctx context.Context, DB *sql.DB) error {
+	const batchesTable = `
+	CREATE TABLE IF NOT EXISTS batches(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ownerID TEXT,
+		created INTEGER,
+		workspaceID INTEGER,
+		FOREIGN KEY(ownerID) REFERENCES users(id),
+		FOREIGN KEY(workspaceID) REFERENCES workspaces(id)
+	);`
+
+	if _, err := DB.ExecContext(ctx, batchesTable); err != nil {
+		return err
+	}
+
+	return addColumnIfMissing(ctx, DB, "batches", "workspaceID", "INTEGER REFERENCES workspaces(id)")
+}
+
+// insertBatch stores the batch and all its expressions in a single transaction
+// and fills in the IDs of exprs.
+func insertBatch(ctx context.Context, DB *sql.DB, member membership, exprs []Expression, keys []string) (int64, []int64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO batches (ownerID, workspaceID, created) values ($1, $2, $3)", member.UserID, member.WorkspaceID, time.Now().Unix())
+	if err != nil {
+		return 0, nil, err
+	}
+	batchID, err := result.LastInsertId()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+	INSERT INTO expressions (status, result, ownerID, workspaceID, batchID, batchKey, expression, created) values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, len(exprs))
+	for i := range exprs {
+		result, err := stmt.ExecContext(ctx, exprs[i].Status, exprs[i].Result, member.UserID, member.WorkspaceID, batchID, keys[i], exprs[i].Source, exprs[i].Created)
+		if err != nil {
+			return 0, nil, err
+		}
+		ids[i], err = result.LastInsertId()
+		if err != nil {
+			return 0, nil, err
+		}
+		exprs[i].ID = fmt.Sprint(ids[i])
+	}
+
+	return batchID, ids, tx.Commit()
+}
+
+func selectBatchWorkspace(ctx context.Context, DB *sql.DB, id int64) (int64, error) {
+	var workspaceID int64
+	err := DB.QueryRowContext(ctx, "SELECT COALESCE(workspaceID, 0) FROM batches WHERE id=$1", id).Scan(&workspaceID)
+	return workspaceID, err
+}
+
+func selectBatchExpressions(ctx context.Context, DB *sql.DB, batchID int64) ([]BatchExpression, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT id, COALESCE(batchKey, ''), status, result FROM expressions
+	WHERE batchID = ? ORDER BY id;`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exprs := []BatchExpression{}
+	for rows.Next() {
+		var expr BatchExpression
+		if err := rows.Scan(&expr.ID, &expr.Key, &expr.Status, &expr.Result); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	return exprs, rows.Err()
+}
+
+func ApiBatchHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		generateErrorResponse(w, "error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	var batch BatchRequest
+	if err := json.Unmarshal(bodyBytes, &batch); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	startBatch(w, r, batch.Expressions)
+}
+
+// startBatch stores the items as a new batch of the workspace, answers with
+// its IDs and evaluates the items in the background.
+func startBatch(w http.ResponseWriter, r *http.Request, items []BatchItem) {
+	if len(items) == 0 || len(items) > MaxBatchSize {
+		generateErrorResponse(w, fmt.Sprintf("a batch must contain between 1 and %d expressions", MaxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	member, ok := requireWorkspace(w, r, WorkspaceMember)
+	if !ok {
+		return
+	}
+	cfg, err := selectWorkspaceConfig(r.Context(), DB, member.WorkspaceID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	timeouts := make([]time.Duration, len(items))
+	keys := make([]string, len(items))
+	for i := range items {
+		timeout, err := items[i].Validate(cfg)
+		if err != nil {
+			generateErrorDetails(w, fmt.Sprintf("expression #%d: %s", i, err.Error()), http.StatusBadRequest, map[string]int{"index": i})
+			return
+		}
+		timeouts[i] = timeout
+		keys[i] = items[i].Key
+	}
+
+	now := time.Now().Unix()
+	exprs := make([]Expression, len(items))
+	for i := range exprs {
+		exprs[i] = Expression{ID: "-1", Status: "201", Result: "pending", Source: items[i].Expression, Created: now, OwnerID: member.UserID, WorkspaceID: member.WorkspaceID}
+	}
+
+	batchID, ids, err := insertBatch(context.TODO(), DB, member, exprs, keys)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	// every expression can be cancelled from now on, but its deadline only
+	// runs once a worker takes it, so that the end of a large batch doesn't
+	// time out while it waits
+	contexts := make([]context.Context, len(exprs))
+	starts := make([]func() bool, len(exprs))
+	finishes := make([]func(), len(exprs))
+	for i := range exprs {
+		contexts[i], starts[i], finishes[i] = Running.Queue(exprs[i].ID, func(ctx context.Context) {
+			evaluateExpression(ctx, &exprs[i], &items[i].Request)
+		})
+		publishExpression(&exprs[i], 0)
+	}
+
+	resp := BatchResponse{ID: batchID, IDs: ids}
+
+	json, err := json.Marshal(resp)
+	if err != nil {
+		internalError(w, err)
+	} else {
+		fmt.Fprint(w, string(json))
+	}
+
+	log.Printf("Batch %d of %d expressions from user %d\n", batchID, len(exprs), member.UserID)
+
+	go func() {
+		next := make(chan int)
+		var wg sync.WaitGroup
+		for range min(BatchWorkers, len(exprs)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					if !starts[i]() {
+						continue
+					}
+					ctx, cancel := context.WithTimeout(contexts[i], timeouts[i])
+					evaluateExpression(ctx, &exprs[i], &items[i].Request)
+					cancel()
+					finishes[i]()
+				}
+			}()
+		}
+		for i := range exprs {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+	}()
+}
+
+func ApiBatchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	batchID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		generateErrorResponse(w, "batch not found", http.StatusNotFound)
+		return
+	}
+
+	workspaceID, err := selectBatchWorkspace(ctx, DB, batchID)
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, "batch not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if _, ok := requireRole(ctx, w, workspaceID, uid, WorkspaceViewer, "batch not found"); !ok {
+		return
+	}
+
+	status := BatchStatus{ID: batchID}
+	status.Expressions, err = selectBatchExpressions(ctx, DB, status.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	status.Total = len(status.Expressions)
+	for _, expr := range status.Expressions {
+		switch expr.Status {
+		case "201":
+			status.Pending++
+		case "200":
+			status.Succeeded++
+		default:
+			status.Failed++
+		}
+	}
+	status.Done = status.Pending == 0
+
+	json, err := json.Marshal(status)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
@@ -0,0 +1,193 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Barsenick/calculator/internal/application/task"
+)
+
+// useTestAgent replaces TaskScheduler with one whose tasks are all computed
+// at once, each after delay.
+func useTestAgent(t *testing.T, delay time.Duration) {
+	t.Helper()
+	s := NewScheduler()
+	previous := TaskScheduler
+	TaskScheduler = s
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		TaskScheduler = previous
+	})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			next, ok := s.Next()
+			if !ok {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			go func() {
+				time.Sleep(delay)
+				s.Complete(task.TaskResult{TaskID: next.TaskID, Result: next.Arg1 + next.Arg2})
+			}()
+		}
+	}()
+}
+
+func TestBatch(t *testing.T) {
+	useTestDB(t)
+	useTestAgent(t, 100*time.Millisecond)
+	ctx := context.Background()
+
+	uid, err := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), s.Token))
+		return w
+	}
+	count := func(table string) int {
+		var n int
+		if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	w := request(http.MethodPost, "/api/v1/calculate/batch", `{"expressions": [{"expression": "1+1"}, {"expression": "1+1", "priority": 99}]}`)
+	var errResp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil || w.Code != http.StatusBadRequest || fmt.Sprint(errResp.Details) != "map[index:1]" {
+		t.Fatalf("expected the invalid item to be reported, got %d %s", w.Code, w.Body)
+	}
+
+	// the batch and its expressions are stored all at once or not at all
+	if _, err := DB.ExecContext(ctx, `
+	CREATE TRIGGER refuse_boom BEFORE INSERT ON expressions WHEN NEW.expression = 'boom'
+	BEGIN SELECT RAISE(ABORT, 'boom'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(http.MethodPost, "/api/v1/calculate/batch", `{"expressions": [{"expression": "1+1"}, {"expression": "boom"}]}`); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the insert to fail, got %d %s", w.Code, w.Body)
+	}
+	if b, e := count("batches"), count("expressions"); b != 0 || e != 0 {
+		t.Fatalf("expected nothing to be stored, got %d batches and %d expressions", b, e)
+	}
+	if _, err := DB.ExecContext(ctx, "DROP TRIGGER refuse_boom"); err != nil {
+		t.Fatal(err)
+	}
+
+	// four rounds of workers take 400ms, but every item only needs 100ms of
+	// its 300
+	var items []BatchItem
+	for i := range 3*BatchWorkers + 1 {
+		items = append(items, BatchItem{Request: Request{Expression: "1+1", TimeoutMS: 300}, Key: fmt.Sprint("k", i)})
+	}
+	items = append(items, BatchItem{Request: Request{Expression: "7"}, Key: "plain"}, BatchItem{Request: Request{Expression: "("}})
+	body, _ := json.Marshal(BatchRequest{Expressions: items})
+
+	w = request(http.MethodPost, "/api/v1/calculate/batch", string(body))
+	var created BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusOK || len(created.IDs) != len(items) {
+		t.Fatalf("unexpected batch %d %s", w.Code, w.Body)
+	}
+
+	var status BatchStatus
+	for deadline := time.Now().Add(5 * time.Second); !status.Done; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the batch to finish, got %+v", status)
+		}
+		w := request(http.MethodGet, fmt.Sprintf("/api/v1/calculate/batch/%d", created.ID), "")
+		status = BatchStatus{}
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d %s", w.Code, w.Body)
+		}
+	}
+
+	if status.Total != len(items) || status.Pending != 0 || status.Succeeded != len(items)-1 || status.Failed != 1 {
+		t.Fatalf("unexpected counts %d total, %d pending, %d succeeded, %d failed", status.Total, status.Pending, status.Succeeded, status.Failed)
+	}
+	for i, expr := range status.Expressions {
+		if expr.ID != fmt.Sprint(created.IDs[i]) || expr.Key != items[i].Key {
+			t.Fatalf("expected item %d to keep its ID and key, got %+v", i, expr)
+		}
+		if i < len(items)-1 && expr.Status != "200" {
+			t.Errorf("expected item %d to succeed, got %s %s", i, expr.Status, expr.Result)
+		}
+	}
+	if last := status.Expressions[len(items)-1]; last.Status != "422" {
+		t.Fatalf("expected the invalid expression to fail, got %+v", last)
+	}
+}
+
+func TestBatchCancelQueued(t *testing.T) {
+	useTestDB(t)
+	useTestAgent(t, time.Hour)
+	ctx := context.Background()
+
+	uid, err := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), s.Token))
+		return w
+	}
+
+	// every worker is stuck on an expression, the last one waits for its turn
+	items := make([]BatchItem, BatchWorkers+1)
+	for i := range items {
+		items[i] = BatchItem{Request: Request{Expression: "1+1"}}
+	}
+	body, _ := json.Marshal(BatchRequest{Expressions: items})
+	w := request(http.MethodPost, "/api/v1/calculate/batch", string(body))
+	var created BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected batch %d %s", w.Code, w.Body)
+	}
+	defer func() {
+		for _, id := range created.IDs {
+			Running.Cancel(fmt.Sprint(id))
+		}
+	}()
+
+	cancelled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		cancelled <- request(http.MethodPost, fmt.Sprintf("/api/v1/expressions/%d/cancel", created.IDs[BatchWorkers]), "")
+	}()
+	select {
+	case w = <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the waiting expression to be cancelled at once")
+	}
+	var expr Expression
+	if err := json.Unmarshal(w.Body.Bytes(), &expr); err != nil || w.Code != http.StatusOK || expr.Status != "cancelled" {
+		t.Fatalf("expected the expression to be cancelled, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,69 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// request IDs sent by the clients are only reused if they are harmless in logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ErrorResponse is the body of every error of the API. Code is the status
+// text in snake case, e.g. not_found, and RequestID is also sent as the
+// X-Request-ID header, so that the error can be found in the logs.
+type ErrorResponse = client.Error
+
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+func generateErrorResponse(w http.ResponseWriter, errMsg string, code int) {
+	generateErrorDetails(w, errMsg, code, nil)
+}
+
+func generateErrorDetails(w http.ResponseWriter, errMsg string, code int, details any) {
+	json, err := json.Marshal(ErrorResponse{
+		Code:      errorCode(code),
+		Message:   errMsg,
+		Details:   details,
+		RequestID: w.Header().Get(RequestIDHeader),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, string(json))
+}
+
+// internalError logs err and answers 500 without exposing it to the client.
+func internalError(w http.ResponseWriter, err error) {
+	log.Printf("Request %s failed: %v", w.Header().Get(RequestIDHeader), err)
+	generateErrorResponse(w, "internal server error", http.StatusInternalServerError)
+}
+
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = uuid.NewString()
+	}
+	w.Header().Set(RequestIDHeader, id)
+}
+
+// headerMiddleware marks the answers of the API as JSON.
+func headerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, req)
+	})
+}
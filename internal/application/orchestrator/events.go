@@ -0,0 +1,195 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventStatus   = "status"
+	EventProgress = "progress"
+)
+
+// ExpressionEvent is pushed to the members of the workspace of an expression
+// when its status changes or one more of its operations has been computed.
+type ExpressionEvent struct {
+	Type      string `json:"-"`
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Result    string `json:"result"`
+	Source    string `json:"expression"`
+	TasksDone int    `json:"tasks_done"`
+}
+
+type eventHub struct {
+	subs map[int64]map[chan ExpressionEvent]struct{}
+	mu   sync.Mutex
+}
+
+var Events = eventHub{subs: make(map[int64]map[chan ExpressionEvent]struct{})}
+
+// Subscribe starts delivering the events of the expressions of the workspace
+// to the returned channel until unsubscribe is called. The hub closes the
+// channel if the subscriber falls so far behind that it would miss a status
+// event.
+func (h *eventHub) Subscribe(workspaceID int64) (events chan ExpressionEvent, unsubscribe func()) {
+	events = make(chan ExpressionEvent, 64)
+
+	h.mu.Lock()
+	if h.subs[workspaceID] == nil {
+		h.subs[workspaceID] = make(map[chan ExpressionEvent]struct{})
+	}
+	h.subs[workspaceID][events] = struct{}{}
+	h.mu.Unlock()
+
+	return events, func() {
+		h.mu.Lock()
+		delete(h.subs[workspaceID], events)
+		if len(h.subs[workspaceID]) == 0 {
+			delete(h.subs, workspaceID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Publish never blocks. A subscriber that doesn't keep up misses progress
+// events, which the next one makes up for, but not status events: it is
+// dropped instead, and has to subscribe again and catch up.
+func (h *eventHub) Publish(workspaceID int64, ev ExpressionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for events := range h.subs[workspaceID] {
+		select {
+		case events <- ev:
+		default:
+			if ev.Type == EventStatus {
+				delete(h.subs[workspaceID], events)
+				close(events)
+			}
+		}
+	}
+	if len(h.subs[workspaceID]) == 0 {
+		delete(h.subs, workspaceID)
+	}
+}
+
+func publishExpression(expr *Expression, tasksDone int) {
+	Events.Publish(expr.WorkspaceID, ExpressionEvent{
+		Type:      EventStatus,
+		ID:        expr.ID,
+		Status:    expr.Status,
+		Result:    expr.Result,
+		Source:    expr.Source,
+		TasksDone: tasksDone,
+	})
+}
+
+// streamState returns the expressions whose current status a new stream
+// starts with: the expression id if it is given, or else the pending ones
+// and the ones finished since the Unix time since, which a reconnecting
+// EventSource tells with Last-Event-ID.
+func streamState(ctx context.Context, DB *sql.DB, workspaceID int64, id string, since int64) ([]Expression, error) {
+	query := "SELECT " + expressionColumns + " FROM expressions WHERE workspaceID = ? AND (status = '201' OR finished >= ?)"
+	args := []any{workspaceID, since}
+	if id != "" {
+		query = "SELECT " + expressionColumns + " FROM expressions WHERE workspaceID = ? AND id = ?"
+		args = []any{workspaceID, id}
+	}
+	rows, err := DB.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exprs := []Expression{}
+	for rows.Next() {
+		expr, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, rows.Err()
+}
+
+// writeEvent sends ev with the time as its ID, which the browser sends back
+// as Last-Event-ID when it reconnects.
+func writeEvent(w http.ResponseWriter, ev ExpressionEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", time.Now().Unix(), ev.Type, data)
+}
+
+// ApiExpressionsStreamHandler streams the events of the expressions of the
+// workspace as Server-Sent Events. With ?id= only the events of that
+// expression are sent. The stream starts with the current status, see
+// streamState, and ends if the client falls behind, so that EventSource
+// reconnects and gets the current status again.
+func ApiExpressionsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	member, ok := requireWorkspace(w, r, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		generateErrorResponse(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	idFilter := r.URL.Query().Get("id")
+
+	// the events published while the state is read are sent as well
+	events, unsubscribe := Events.Subscribe(member.WorkspaceID)
+	defer unsubscribe()
+
+	since := time.Now().Unix()
+	if last, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && last < since {
+		since = last
+	}
+	state, err := streamState(r.Context(), DB, member.WorkspaceID, idFilter, since)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, expr := range state {
+		writeEvent(w, ExpressionEvent{Type: EventStatus, ID: expr.ID, Status: expr.Status, Result: expr.Result, Source: expr.Source})
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if idFilter != "" && ev.ID != idFilter {
+				continue
+			}
+			writeEvent(w, ev)
+			flusher.Flush()
+		}
+	}
+}
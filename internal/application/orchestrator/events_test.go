@@ -0,0 +1,100 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	h := eventHub{subs: make(map[int64]map[chan ExpressionEvent]struct{})}
+	events, unsubscribe := h.Subscribe(1)
+	defer unsubscribe()
+
+	// progress events which don't fit are skipped
+	for i := 0; i < cap(events)+10; i++ {
+		h.Publish(1, ExpressionEvent{Type: EventProgress, ID: "1", TasksDone: i})
+	}
+	if len(events) != cap(events) {
+		t.Fatalf("expected a full buffer, got %d events", len(events))
+	}
+
+	// a status event which doesn't fit ends the subscription
+	h.Publish(1, ExpressionEvent{Type: EventStatus, ID: "1", Status: "200"})
+	for range cap(events) {
+		<-events
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+	if len(h.subs) != 0 {
+		t.Fatalf("expected the subscriber to be gone, got %v", h.subs)
+	}
+}
+
+func TestExpressionsStreamState(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, err := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := personalWorkspace(ctx, DB, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]string{}
+	for _, expr := range []Expression{
+		{Status: "201", Result: "pending", Source: "1+1"},
+		{Status: "200", Result: "4", Source: "2+2", Finished: time.Now().Add(-time.Hour).Unix()},
+		{Status: "200", Result: "6", Source: "3+3", Finished: time.Now().Unix()},
+	} {
+		expr.OwnerID, expr.WorkspaceID = uid, ws
+		id, err := insertExpression(ctx, DB, &expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expr.ID = fmt.Sprint(id)
+		if _, err := modifyExpression(ctx, DB, &expr); err != nil {
+			t.Fatal(err)
+		}
+		ids[expr.Source] = expr.ID
+	}
+
+	handler := NewRouter()
+	stream := func(query, lastEventID string) string {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		r := withBearer(httptest.NewRequest(http.MethodGet, "/api/v1/expressions/stream"+query, nil), s.Token).WithContext(ctx)
+		if lastEventID != "" {
+			r.Header.Set("Last-Event-ID", lastEventID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	sent := func(body, source string) bool {
+		return strings.Contains(body, `"id":"`+ids[source]+`"`)
+	}
+
+	if body := stream("", ""); !sent(body, "1+1") || sent(body, "2+2") || !strings.Contains(body, "event: status\n") {
+		t.Fatalf("expected the pending expression, got %s", body)
+	}
+	// a reconnecting client catches up with what finished meanwhile
+	if body := stream("", fmt.Sprint(time.Now().Add(-time.Minute).Unix())); !sent(body, "1+1") || !sent(body, "3+3") || sent(body, "2+2") {
+		t.Fatalf("expected the expressions finished since the last event, got %s", body)
+	}
+	if body := stream("?id="+ids["2+2"], ""); !sent(body, "2+2") || sent(body, "1+1") {
+		t.Fatalf("expected the expression of the stream, got %s", body)
+	}
+}
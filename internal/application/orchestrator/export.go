@@ -0,0 +1,362 @@
+package application
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatXLSX  = "xlsx"
+
+	MaxImportSize = 10 << 20
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown format, expected csv, jsonl or xlsx")
+
+	exportColumns = []string{"id", "expression", "status", "result", "label", "notes", "created", "finished"}
+
+	exportContentTypes = map[string]string{
+		FormatCSV:   "text/csv; charset=utf-8",
+		FormatJSONL: "application/x-ndjson",
+		FormatXLSX:  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}
+
+	importFormats = map[string]string{
+		"text/csv":                FormatCSV,
+		"application/x-ndjson":    FormatJSONL,
+		"application/jsonl":       FormatJSONL,
+		"application/x-jsonlines": FormatJSONL,
+	}
+)
+
+type expressionWriter interface {
+	WriteExpression(expr Expression) error
+	Flush() error
+	Close() error
+}
+
+func newExpressionWriter(w io.Writer, format string) (expressionWriter, error) {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		return &csvExpressionWriter{cw}, cw.Write(exportColumns)
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlExpressionWriter{bw, json.NewEncoder(bw)}, nil
+	case FormatXLSX:
+		xw, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		header := make([]any, len(exportColumns))
+		for i, column := range exportColumns {
+			header[i] = column
+		}
+		return &xlsxExpressionWriter{xw}, xw.WriteRow(header...)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// exportTime formats the timestamps for spreadsheets, zero stays empty.
+func exportTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+type csvExpressionWriter struct {
+	*csv.Writer
+}
+
+func (c *csvExpressionWriter) WriteExpression(expr Expression) error {
+	record := []string{expr.ID, expr.Source, expr.Status, expr.Result, expr.Label, expr.Notes, exportTime(expr.Created), exportTime(expr.Finished)}
+	for i := range record {
+		record[i] = escapeCSVCell(record[i])
+	}
+	return c.Write(record)
+}
+
+// csvFormulaPrefixes start the cells spreadsheets run as formulas.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell keeps a spreadsheet from running a label or an expression
+// like "=HYPERLINK(...)" by prefixing it with a quote, which
+// unescapeCSVCell removes again on import. Numbers like negative results
+// stay numbers.
+func escapeCSVCell(s string) string {
+	if s == "" || !strings.ContainsRune(csvFormulaPrefixes, rune(s[0])) {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	return "'" + s
+}
+
+func unescapeCSVCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+func (c *csvExpressionWriter) Flush() error {
+	c.Writer.Flush()
+	return c.Error()
+}
+
+func (c *csvExpressionWriter) Close() error {
+	return c.Flush()
+}
+
+// jsonlExpressionWriter writes the expressions the way the API returns them.
+type jsonlExpressionWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (j *jsonlExpressionWriter) WriteExpression(expr Expression) error {
+	return j.enc.Encode(expr)
+}
+
+func (j *jsonlExpressionWriter) Flush() error {
+	return j.w.Flush()
+}
+
+func (j *jsonlExpressionWriter) Close() error {
+	return j.w.Flush()
+}
+
+type xlsxExpressionWriter struct {
+	*xlsxWriter
+}
+
+func (x *xlsxExpressionWriter) WriteExpression(expr Expression) error {
+	var id any = expr.ID
+	if n, err := strconv.ParseInt(expr.ID, 10, 64); err == nil {
+		id = n
+	}
+	var result any = expr.Result
+	if expr.Status == "200" {
+		if n, err := strconv.ParseFloat(expr.Result, 64); err == nil {
+			result = n
+		}
+	}
+	return x.WriteRow(id, expr.Source, expr.Status, result, expr.Label, expr.Notes, exportTime(expr.Created), exportTime(expr.Finished))
+}
+
+// ApiExportExpressionsHandler streams the expressions of the workspace as a file. It
+// takes the same filters as the list, except that there are no pages.
+func ApiExportExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	member, ok := requireWorkspace(w, r, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		generateErrorResponse(w, ErrUnknownFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseExpressionFilter(r.URL.Query())
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = MaxPageSize
+	filter.WorkspaceID = member.WorkspaceID
+
+	exprs, nextCursor, err := getExpressions(ctx, DB, filter)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="expressions.%s"`, format))
+
+	ew, err := newExpressionWriter(w, format)
+	if err != nil {
+		log.Printf("Error exporting expressions: %v", err)
+		return
+	}
+
+	for {
+		for _, expr := range exprs {
+			if err := ew.WriteExpression(expr); err != nil {
+				log.Printf("Error exporting expressions: %v", err)
+				return
+			}
+		}
+		if nextCursor == "" {
+			break
+		}
+		if err := ew.Flush(); err != nil {
+			log.Printf("Error exporting expressions: %v", err)
+			return
+		}
+
+		filter.After, _ = decodeCursor(nextCursor)
+		exprs, nextCursor, err = getExpressions(ctx, DB, filter)
+		if err != nil {
+			// the status is already sent, all we can do is to cut the file short
+			log.Printf("Error exporting expressions: %v", err)
+			return
+		}
+	}
+
+	if err := ew.Close(); err != nil {
+		log.Printf("Error exporting expressions: %v", err)
+	}
+}
+
+// ApiImportExpressionsHandler queues every expression of an uploaded CSV or
+// JSONL file as a single batch. The format is taken from ?format= or from
+// the Content-Type.
+func ApiImportExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		format = importFormats[mediaType]
+	}
+
+	body := http.MaxBytesReader(w, r.Body, MaxImportSize)
+	defer body.Close()
+
+	var (
+		items []BatchItem
+		err   error
+	)
+	switch format {
+	case FormatCSV:
+		items, err = parseCSVImport(body)
+	case FormatJSONL:
+		items, err = parseJSONLImport(body)
+	default:
+		generateErrorResponse(w, "unknown format, send text/csv or application/x-ndjson or set ?format=csv|jsonl", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startBatch(w, r, items)
+}
+
+// parseCSVImport reads a CSV with a header. Only the expression column is
+// required, key, priority, timeout_ms and callback_url are optional and
+// unknown columns, e.g. those of an export, are ignored.
+func parseCSVImport(r io.Reader) ([]BatchItem, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+	}
+	if _, ok := columns["expression"]; !ok {
+		return nil, errors.New("the header has no expression column")
+	}
+
+	cell := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(unescapeCSVCell(record[i]))
+	}
+
+	var items []BatchItem
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		item := BatchItem{Key: cell(record, "key")}
+		item.Expression = cell(record, "expression")
+		item.CallbackURL = cell(record, "callback_url")
+		if item.Expression == "" {
+			return nil, fmt.Errorf("line %d: empty expression", line)
+		}
+		if val := cell(record, "priority"); val != "" {
+			if item.Priority, err = strconv.Atoi(val); err != nil {
+				return nil, fmt.Errorf("line %d: invalid priority %q", line, val)
+			}
+		}
+		if val := cell(record, "timeout_ms"); val != "" {
+			if item.TimeoutMS, err = strconv.Atoi(val); err != nil {
+				return nil, fmt.Errorf("line %d: invalid timeout_ms %q", line, val)
+			}
+		}
+		items = append(items, item)
+
+		if len(items) > MaxBatchSize {
+			return nil, fmt.Errorf("at most %d expressions can be imported at once", MaxBatchSize)
+		}
+	}
+
+	return items, nil
+}
+
+// parseJSONLImport reads an object per line with the same fields as the
+// items of a batch.
+func parseJSONLImport(r io.Reader) ([]BatchItem, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxImportSize)
+
+	var items []BatchItem
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var item BatchItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if item.Expression == "" {
+			return nil, fmt.Errorf("line %d: empty expression", line)
+		}
+		items = append(items, item)
+
+		if len(items) > MaxBatchSize {
+			return nil, fmt.Errorf("at most %d expressions can be imported at once", MaxBatchSize)
+		}
+	}
+
+	return items, scanner.Err()
+}
@@ -0,0 +1,166 @@
+package application
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestXLSXWriter(t *testing.T) {
+	var buf bytes.Buffer
+	xw, err := newXLSXWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.WriteRow("id", "expression", "result"); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.WriteRow(int64(1), "2<3 & 4", 6.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sheet []byte
+	for _, f := range zr.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sheet, _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	if len(zr.File) != len(xlsxParts)+1 || sheet == nil {
+		t.Fatalf("unexpected parts %v", zr.File)
+	}
+
+	var parsed struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal(sheet, &parsed); err != nil {
+		t.Fatalf("invalid sheet: %v\n%s", err, sheet)
+	}
+	if len(parsed.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %v", len(parsed.Rows))
+	}
+	row := parsed.Rows[1].Cells
+	if row[0].Ref != "A2" || row[0].Value != "1" {
+		t.Fatalf("unexpected id cell %+v", row[0])
+	}
+	if row[1].Inline != "2<3 & 4" {
+		t.Fatalf("unexpected text cell %+v", row[1])
+	}
+	if row[2].Ref != "C2" || row[2].Value != "6.5" {
+		t.Fatalf("unexpected number cell %+v", row[2])
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("xlsxColumn(%d) = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestCSVFormulaEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	ew, err := newExpressionWriter(&buf, FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exprs := []Expression{
+		{ID: "1", Source: "-2+3", Status: "200", Result: "1", Label: `=HYPERLINK("http://evil.example","x")`, Notes: "@SUM(A1)"},
+		{ID: "2", Source: "2+2", Status: "200", Result: "-4", Label: "+1", Notes: "\tcmd"},
+		{ID: "3", Source: "2*2", Status: "200", Result: "4", Label: "a=b", Notes: "\rcmd"},
+		{ID: "4", Source: "1-4", Status: "200", Result: "-3.000000", Label: "-1e3"},
+	}
+	for _, expr := range exprs {
+		if err := ew.WriteExpression(expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records[1:] {
+		for _, cell := range record {
+			_, err := strconv.ParseFloat(cell, 64)
+			if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) && err != nil {
+				t.Errorf("expected %q to be escaped", cell)
+			}
+		}
+	}
+	if records[1][4] != `'=HYPERLINK("http://evil.example","x")` || records[3][4] != "a=b" {
+		t.Fatalf("unexpected records %q", records)
+	}
+	// negative numbers stay numbers in a spreadsheet
+	if records[2][3] != "-4" || records[4][3] != "-3.000000" || records[4][4] != "-1e3" {
+		t.Fatalf("expected negative numbers not to be escaped, got %q", records)
+	}
+
+	// the export can be imported again
+	buf.Reset()
+	w := csv.NewWriter(&buf)
+	w.WriteAll(records)
+	items, err := parseCSVImport(&buf)
+	if err != nil || len(items) != 4 || items[0].Expression != "-2+3" {
+		t.Fatalf("unexpected items %+v, %v", items, err)
+	}
+}
+
+func TestParseCSVImport(t *testing.T) {
+	items, err := parseCSVImport(strings.NewReader("id,Expression,priority\n1,2+2,5\n2,\"3*(4+1)\",\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Expression != "2+2" || items[0].Priority != 5 || items[1].Expression != "3*(4+1)" {
+		t.Fatalf("unexpected items %+v", items)
+	}
+
+	if _, err := parseCSVImport(strings.NewReader("source\n2+2\n")); err == nil {
+		t.Fatal("expected an error without the expression column")
+	}
+	if _, err := parseCSVImport(strings.NewReader("expression,priority\n2+2,high\n")); err == nil {
+		t.Fatal("expected an error for an invalid priority")
+	}
+}
+
+func TestParseJSONLImport(t *testing.T) {
+	items, err := parseJSONLImport(strings.NewReader(`{"expression":"2+2","key":"a"}` + "\n\n" + `{"id":"7","expression":"1/3","status":"200"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Key != "a" || items[1].Expression != "1/3" {
+		t.Fatalf("unexpected items %+v", items)
+	}
+
+	if _, err := parseJSONLImport(strings.NewReader("{\"expression\":\"2+2\"}\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MaxLabelLength = 100
+	MaxNotesLength = 2000
+)
+
+// AnnotationRequest changes the label and/or the notes of an expression,
+// fields that are left out stay as they are.
+type AnnotationRequest struct {
+	Label *string `json:"label"`
+	Notes *string `json:"notes"`
+}
+
+func updateExpressionAnnotations(ctx context.Context, DB *sql.DB, expr *Expression) error {
+	_, err := DB.ExecContext(ctx, "UPDATE expressions SET label = $1, notes = $2 WHERE id = $3", expr.Label, expr.Notes, expr.ID)
+	return err
+}
+
+func deleteExpression(ctx context.Context, DB *sql.DB, id string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE expressionID = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shares WHERE expressionID = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM expressions WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// resetExpression makes the expression pending again unless it already is.
+// It reports false if somebody else is evaluating it.
+func resetExpression(ctx context.Context, DB *sql.DB, expr *Expression) (bool, error) {
+	result, err := DB.ExecContext(ctx, `
+	UPDATE expressions SET status = '201', result = 'pending', finished = NULL, trace = NULL WHERE id = $1 AND status != '201'
+	`, expr.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	expr.Status = "201"
+	expr.Result = "pending"
+	expr.Finished = 0
+	return true, nil
+}
+
+// cancelPendingExpression stores the expression as cancelled unless it isn't
+// pending anymore, which it reports with false.
+func cancelPendingExpression(ctx context.Context, DB *sql.DB, expr *Expression) (bool, error) {
+	finished := time.Now().Unix()
+	result, err := DB.ExecContext(ctx, `
+	UPDATE expressions SET status = 'cancelled', result = $1, finished = $2 WHERE id = $3 AND status = '201'
+	`, ErrCancelled.Error(), finished, expr.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	expr.Status = "cancelled"
+	expr.Result = ErrCancelled.Error()
+	expr.Finished = finished
+	return true, nil
+}
+
+// workspaceExpression loads the expression of the path and makes sure the
+// user has at least role in its workspace. If not, the error is already
+// written to w.
+func workspaceExpression(ctx context.Context, w http.ResponseWriter, r *http.Request, uid int64, role string) (Expression, bool) {
+	expr, err := selectExpression(ctx, DB, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, "expression not found", http.StatusNotFound)
+		return expr, false
+	} else if err != nil {
+		internalError(w, err)
+		return expr, false
+	}
+
+	if _, ok := requireRole(ctx, w, expr.WorkspaceID, uid, role, "expression not found"); !ok {
+		return expr, false
+	}
+
+	return expr, true
+}
+
+// startEvaluation evaluates the stored pending expression in the background.
+// The returned channel is closed once the outcome is stored.
+func startEvaluation(expr *Expression, cr *Request, timeout time.Duration) <-chan struct{} {
+	calcCtx, finish := Running.Start(expr.ID, timeout)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer finish()
+		evaluateExpression(calcCtx, expr, cr)
+	}()
+
+	return done
+}
+
+func ApiExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	role := WorkspaceMember
+	if r.Method == http.MethodGet {
+		role = WorkspaceViewer
+	}
+	expr, ok := workspaceExpression(ctx, w, r, uid, role)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		trace, err := selectTrace(ctx, DB, expr.ID)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		expr.Trace = trace
+
+	case http.MethodPatch:
+		var req AnnotationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		if req.Label != nil {
+			if utf8.RuneCountInString(*req.Label) > MaxLabelLength {
+				generateErrorResponse(w, fmt.Sprintf("label must be at most %d characters long", MaxLabelLength), http.StatusBadRequest)
+				return
+			}
+			expr.Label = *req.Label
+		}
+		if req.Notes != nil {
+			if utf8.RuneCountInString(*req.Notes) > MaxNotesLength {
+				generateErrorResponse(w, fmt.Sprintf("notes must be at most %d characters long", MaxNotesLength), http.StatusBadRequest)
+				return
+			}
+			expr.Notes = *req.Notes
+		}
+		if err := updateExpressionAnnotations(ctx, DB, &expr); err != nil {
+			internalError(w, err)
+			return
+		}
+
+	case http.MethodDelete:
+		if expr.Status == "201" {
+			Running.Cancel(expr.ID)
+		}
+		if err := deleteExpression(ctx, DB, expr.ID); err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	json, err := json.Marshal(expr)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+// ApiRerunExpressionHandler evaluates the stored source of a finished
+// expression again. The body may carry new priority, timeout_ms and callback_url.
+func ApiRerunExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	cr := new(Request)
+	defer r.Body.Close()
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		generateErrorResponse(w, "error reading request body", http.StatusBadRequest)
+		return
+	}
+	if len(bodyBytes) > 0 {
+		if err := json.Unmarshal(bodyBytes, cr); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	expr, ok := workspaceExpression(ctx, w, r, uid, WorkspaceMember)
+	if !ok {
+		return
+	}
+
+	cfg, err := selectWorkspaceConfig(ctx, DB, expr.WorkspaceID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	timeout, err := cr.Validate(cfg)
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if expr.Source == "" {
+		generateErrorResponse(w, "the source of this expression wasn't stored", http.StatusConflict)
+		return
+	}
+	cr.Expression = expr.Source
+
+	reset, err := resetExpression(ctx, DB, &expr)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !reset {
+		generateErrorResponse(w, "expression is still pending", http.StatusConflict)
+		return
+	}
+
+	publishExpression(&expr, 0)
+
+	json, err := json.Marshal(expr)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+
+	startEvaluation(&expr, cr, timeout)
+}
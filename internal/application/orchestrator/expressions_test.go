@@ -0,0 +1,94 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpressionHandler(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, err := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := personalWorkspace(ctx, DB, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(status, result, source string) string {
+		id, err := insertExpression(ctx, DB, &Expression{Status: status, Result: result, Source: source, OwnerID: uid, WorkspaceID: ws})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(id)
+	}
+
+	handler := NewRouter()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), s.Token))
+		return w
+	}
+
+	finished := "/api/v1/expressions/" + insert("200", "7", "7")
+
+	// labels and notes are limited in characters, not bytes
+	label, notes := strings.Repeat("é", MaxLabelLength), strings.Repeat("ü", MaxNotesLength)
+	for _, body := range []string{`{"label": "` + label + `x"}`, `{"notes": "` + notes + `x"}`} {
+		if w := request(http.MethodPatch, finished, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected a too long annotation to be refused, got %d", w.Code)
+		}
+	}
+	if w := request(http.MethodPatch, finished, `{"label": "`+label+`", "notes": "`+notes+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the longest annotations to be stored, got %d %s", w.Code, w.Body)
+	}
+	w := request(http.MethodPatch, finished, `{"label": "short"}`)
+	var expr Expression
+	if err := json.Unmarshal(w.Body.Bytes(), &expr); err != nil || w.Code != http.StatusOK || expr.Label != "short" || expr.Notes != notes {
+		t.Fatalf("expected the notes to stay, got %d %s", w.Code, w.Body)
+	}
+
+	// a pending expression can't run again, but a finished one can
+	pending := "/api/v1/expressions/" + insert("201", "pending", "7")
+	if w := request(http.MethodPost, pending+"/rerun", ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected the rerun of a pending expression to be refused, got %d", w.Code)
+	}
+	w = request(http.MethodPost, finished+"/rerun", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &expr); err != nil || w.Code != http.StatusOK || expr.Status != "201" {
+		t.Fatalf("expected the expression to run again, got %d %s", w.Code, w.Body)
+	}
+
+	// deleting a pending expression stops its evaluation first
+	useTestAgent(t, time.Hour)
+	expr = Expression{Status: "201", Result: "pending", Source: "1+1", OwnerID: uid, WorkspaceID: ws}
+	id, err := insertExpression(ctx, DB, &expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr.ID = fmt.Sprint(id)
+	done := startEvaluation(&expr, &Request{Expression: expr.Source}, time.Hour)
+	if w := request(http.MethodDelete, "/api/v1/expressions/"+expr.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the pending expression to be deleted, got %d %s", w.Code, w.Body)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the evaluation to stop")
+	}
+	if _, err := selectExpression(ctx, DB, expr.ID); err != sql.ErrNoRows {
+		t.Fatalf("expected the expression to be gone, got %v", err)
+	}
+}
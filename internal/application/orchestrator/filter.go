@@ -0,0 +1,128 @@
+package application
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// statusFilters maps the names accepted by ?status= to the stored statuses.
+	statusFilters = map[string][]string{
+		"pending":   {"201"},
+		"ok":        {"200"},
+		"error":     {"422", "500"},
+		"cancelled": {"cancelled"},
+		"timeout":   {"timeout"},
+	}
+
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+// ExpressionFilter selects a page of the expressions of a workspace, or of
+// those a user sent to any workspace.
+type ExpressionFilter struct {
+	WorkspaceID int64
+	OwnerID     int64
+
+	Statuses   []string
+	From       time.Time
+	To         time.Time
+	Query      string
+	After      int64
+	Descending bool
+	Limit      int
+}
+
+// parseExpressionFilter reads ?limit=, ?cursor=, ?status=pending,ok,
+// ?from= and ?to= (RFC 3339 or YYYY-MM-DD), ?q= and ?order=asc|desc.
+func parseExpressionFilter(query url.Values) (ExpressionFilter, error) {
+	filter := ExpressionFilter{Limit: DefaultPageSize}
+
+	if val := query.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	if val := query.Get("cursor"); val != "" {
+		after, err := decodeCursor(val)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = after
+	}
+
+	if val := query.Get("status"); val != "" {
+		for _, name := range strings.Split(val, ",") {
+			statuses, ok := statusFilters[strings.TrimSpace(name)]
+			if !ok {
+				return filter, fmt.Errorf("unknown status %q, expected pending, ok, error, cancelled or timeout", name)
+			}
+			filter.Statuses = append(filter.Statuses, statuses...)
+		}
+	}
+
+	var err error
+	if filter.From, err = parseFilterTime(query.Get("from")); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseFilterTime(query.Get("to")); err != nil {
+		return filter, err
+	}
+
+	filter.Query = query.Get("q")
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, errors.New("order must be asc or desc")
+	}
+
+	return filter, nil
+}
+
+func parseFilterTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, val); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", val)
+}
+
+// cursors are opaque to the clients, they only have to pass them back
+func encodeCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return id, nil
+}
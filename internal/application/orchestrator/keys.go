@@ -0,0 +1,359 @@
+package application
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Tokens are signed with the current key and verified with the key their kid
+// header names. To rotate, add the new key to JWT_KEYS_FILE, make it current
+// and reload; drop the old key once the tokens signed with it have expired.
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+const minSecretLength = 32
+
+var (
+	ErrUnknownKey   = errors.New("token is signed with an unknown key")
+	ErrAlgMismatch  = errors.New("token algorithm doesn't match its key")
+	ErrKeysNotReady = errors.New("signing keys are not loaded")
+)
+
+var signingMethods = map[string]jwt.SigningMethod{
+	AlgHS256: jwt.SigningMethodHS256,
+	AlgRS256: jwt.SigningMethodRS256,
+	AlgEdDSA: jwt.SigningMethodEdDSA,
+}
+
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Private is nil for keys which only verify tokens.
+	Private any
+	Public  any
+}
+
+type KeySet struct {
+	Current *SigningKey
+	Keys    map[string]*SigningKey
+}
+
+var signingKeys atomic.Pointer[KeySet]
+
+// keyFile is the format of JWT_KEYS_FILE. Relative paths are resolved
+// against the directory of the file.
+type keyFile struct {
+	Current string         `json:"current"`
+	Keys    []keyFileEntry `json:"keys"`
+}
+
+type keyFileEntry struct {
+	ID             string `json:"kid"`
+	Alg            string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	SecretFile     string `json:"secret_file,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+// LoadSigningKeys loads the keys from JWT_KEYS_FILE, or else the HS256 key
+// JWT_SECRET (or the contents of JWT_SECRET_FILE) with the ID JWT_KEY_ID. If
+// none is set, a key is generated, which makes every token invalid once the
+// orchestrator restarts.
+func LoadSigningKeys() error {
+	var (
+		keys *KeySet
+		err  error
+	)
+
+	switch {
+	case os.Getenv("JWT_KEYS_FILE") != "":
+		keys, err = readKeyFile(os.Getenv("JWT_KEYS_FILE"))
+	case os.Getenv("JWT_SECRET") != "" || os.Getenv("JWT_SECRET_FILE") != "":
+		id := os.Getenv("JWT_KEY_ID")
+		if id == "" {
+			id = "default"
+		}
+		keys, err = newKeySet(keyFile{Current: id, Keys: []keyFileEntry{{
+			ID:         id,
+			Alg:        AlgHS256,
+			Secret:     os.Getenv("JWT_SECRET"),
+			SecretFile: os.Getenv("JWT_SECRET_FILE"),
+		}}}, ".")
+	default:
+		log.Println("No JWT_KEYS_FILE or JWT_SECRET, signing tokens with a temporary key")
+		keys, err = temporaryKeySet()
+	}
+	if err != nil {
+		return err
+	}
+
+	signingKeys.Store(keys)
+	return nil
+}
+
+func readKeyFile(path string) (*KeySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var kf keyFile
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return newKeySet(kf, filepath.Dir(path))
+}
+
+func newKeySet(kf keyFile, dir string) (*KeySet, error) {
+	keys := &KeySet{Keys: map[string]*SigningKey{}}
+	for _, entry := range kf.Keys {
+		key, err := loadKey(entry, dir)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.ID, err)
+		}
+		if _, ok := keys.Keys[key.ID]; ok {
+			return nil, fmt.Errorf("key %q is listed twice", key.ID)
+		}
+		keys.Keys[key.ID] = key
+	}
+
+	keys.Current = keys.Keys[kf.Current]
+	if keys.Current == nil {
+		return nil, fmt.Errorf("the current key %q is not listed", kf.Current)
+	}
+	if keys.Current.Private == nil {
+		return nil, fmt.Errorf("the current key %q has no private key", kf.Current)
+	}
+	return keys, nil
+}
+
+func loadKey(entry keyFileEntry, dir string) (*SigningKey, error) {
+	if entry.ID == "" {
+		return nil, errors.New("kid is missing")
+	}
+
+	method, ok := signingMethods[entry.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q, expected HS256, RS256 or EdDSA", entry.Alg)
+	}
+	key := &SigningKey{ID: entry.ID, Method: method}
+
+	read := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+
+	if entry.Alg == AlgHS256 {
+		secret := []byte(entry.Secret)
+		if entry.SecretFile != "" {
+			b, err := read(entry.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = b
+		}
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("the secret must be at least %d bytes long", minSecretLength)
+		}
+		key.Private, key.Public = secret, secret
+		return key, nil
+	}
+
+	switch {
+	case entry.PrivateKeyFile != "":
+		pem, err := read(entry.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.Private, key.Public, err = parsePrivateKey(entry.Alg, pem); err != nil {
+			return nil, err
+		}
+	case entry.PublicKeyFile != "":
+		pem, err := read(entry.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.Public, err = parsePublicKey(entry.Alg, pem); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+	return key, nil
+}
+
+func parsePrivateKey(alg string, pem []byte) (private, public any, err error) {
+	if alg == AlgRS256 {
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.N.BitLen() < 2048 {
+			return nil, nil, errors.New("RSA keys must have at least 2048 bits")
+		}
+		return key, &key.PublicKey, nil
+	}
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, nil, err
+	}
+	edKey := key.(ed25519.PrivateKey)
+	return edKey, edKey.Public(), nil
+}
+
+func parsePublicKey(alg string, pem []byte) (any, error) {
+	if alg == AlgRS256 {
+		key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return jwt.ParseEdPublicKeyFromPEM(pem)
+}
+
+func temporaryKeySet() (*KeySet, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: uuid.NewString(), Method: jwt.SigningMethodEdDSA, Private: private, Public: public}
+	return &KeySet{Current: key, Keys: map[string]*SigningKey{key.ID: key}}, nil
+}
+
+func signToken(claims jwt.Claims) (string, error) {
+	keys := signingKeys.Load()
+	if keys == nil {
+		return "", ErrKeysNotReady
+	}
+
+	token := jwt.NewWithClaims(keys.Current.Method, claims)
+	token.Header["kid"] = keys.Current.ID
+	return token.SignedString(keys.Current.Private)
+}
+
+// tokenParser accepts nothing but the algorithms of the keys, so that e.g.
+// "none" can't be smuggled in; keyFor then checks the alg of the very key.
+var tokenParser = &jwt.Parser{ValidMethods: []string{AlgHS256, AlgRS256, AlgEdDSA}}
+
+func keyFor(token *jwt.Token) (any, error) {
+	keys := signingKeys.Load()
+	if keys == nil {
+		return nil, ErrKeysNotReady
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys.Keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, ErrAlgMismatch
+	}
+	return key.Public, nil
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// publicJWKS lists the asymmetric keys; HS256 secrets are never published.
+func publicJWKS(keys *KeySet) JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range keys.Keys {
+		jwk := JWK{ID: key.ID, Algorithm: key.Method.Alg(), Use: "sig"}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].ID < jwks.Keys[j].ID })
+	return jwks
+}
+
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	keys := signingKeys.Load()
+	if keys == nil {
+		internalError(w, ErrKeysNotReady)
+		return
+	}
+
+	json, err := json.Marshal(publicJWKS(keys))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	fmt.Fprint(w, string(json))
+}
+
+// reloadKeysOnHangup loads the keys again on SIGHUP, so that they can be
+// rotated without a restart.
+func reloadKeysOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		if os.Getenv("JWT_KEYS_FILE") == "" && os.Getenv("JWT_SECRET") == "" && os.Getenv("JWT_SECRET_FILE") == "" {
+			log.Println("The signing key is temporary, there is nothing to reload")
+			continue
+		}
+		if err := LoadSigningKeys(); err != nil {
+			log.Printf("Reloading the signing keys failed, keeping the old ones: %v\n", err)
+			continue
+		}
+		log.Println("Signing keys reloaded")
+	}
+}
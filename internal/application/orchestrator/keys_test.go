@@ -0,0 +1,152 @@
+package application
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeKeys writes an RSA and an Ed25519 key pair to dir and returns a key
+// file naming current as the current key. The Ed25519 key is only given as
+// a public key, as a key being rotated out would be.
+func writeKeys(t *testing.T, dir, current string) (string, *rsa.PrivateKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "rsa.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(edPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "ed.pub.pem"), "PUBLIC KEY", der)
+
+	kf := keyFile{Current: current, Keys: []keyFileEntry{
+		{ID: "rsa", Alg: AlgRS256, PrivateKeyFile: "rsa.pem"},
+		{ID: "old", Alg: AlgEdDSA, PublicKeyFile: "ed.pub.pem"},
+		{ID: "hs", Alg: AlgHS256, Secret: "0123456789abcdef0123456789abcdef"},
+	}}
+	b, _ := json.Marshal(kf)
+	path := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, rsaKey, edKey
+}
+
+func useKeys(t *testing.T, path string) {
+	t.Helper()
+	previous := signingKeys.Load()
+	t.Cleanup(func() { signingKeys.Store(previous) })
+
+	t.Setenv("JWT_KEYS_FILE", path)
+	if err := LoadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"id": 1, "exp": time.Now().Add(time.Hour).Unix()})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	path, rsaKey, edKey := writeKeys(t, dir, "rsa")
+	useKeys(t, path)
+
+	signed, err := generateToken(1, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := parseToken(signed)
+	if err != nil || !token.Valid || token.Header["kid"] != "rsa" || token.Method.Alg() != AlgRS256 {
+		t.Fatalf("expected a valid RS256 token with kid rsa, got %v, %v", token, err)
+	}
+
+	rsaPublic, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rotated out key", signWith(t, jwt.SigningMethodEdDSA, "old", edKey), true},
+		{"hmac key", signWith(t, jwt.SigningMethodHS256, "hs", []byte("0123456789abcdef0123456789abcdef")), true},
+		{"no kid", signWith(t, jwt.SigningMethodRS256, "", rsaKey), false},
+		{"unknown kid", signWith(t, jwt.SigningMethodRS256, "new", rsaKey), false},
+		{"public key as hmac secret", signWith(t, jwt.SigningMethodHS256, "rsa", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublic})), false},
+		{"alg none", signWith(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType), false},
+	}
+	for _, test := range tests {
+		token, err := parseToken(test.token)
+		if valid := err == nil && token.Valid; valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	// the rotated out key can't become the current one without its private key
+	path, _, _ = writeKeys(t, dir, "old")
+	t.Setenv("JWT_KEYS_FILE", path)
+	if err := LoadSigningKeys(); err == nil {
+		t.Fatal("expected a current key without a private key to be refused")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	path, _, _ := writeKeys(t, t.TempDir(), "rsa")
+	useKeys(t, path)
+
+	w := httptest.NewRecorder()
+	JWKSHandler(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	var jwks JWKS
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+
+	// the HS256 secret must not be published
+	if len(jwks.Keys) != 2 || jwks.Keys[0].ID != "old" || jwks.Keys[1].ID != "rsa" {
+		t.Fatalf("expected the keys old and rsa, got %+v", jwks.Keys)
+	}
+
+	ed, rs := jwks.Keys[0], jwks.Keys[1]
+	if ed.KeyType != "OKP" || ed.Curve != "Ed25519" || ed.Algorithm != AlgEdDSA || ed.X == "" {
+		t.Errorf("unexpected Ed25519 key %+v", ed)
+	}
+	if rs.KeyType != "RSA" || rs.Algorithm != AlgRS256 || rs.E != "AQAB" || len(rs.N) != 342 {
+		t.Errorf("unexpected RSA key %+v", rs)
+	}
+}
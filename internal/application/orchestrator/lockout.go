@@ -0,0 +1,116 @@
+package application
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// failed logins are forgotten after this long without another one
+const lockoutForgetAfter = 24 * time.Hour
+
+// lockouts are swept of forgotten entries when they grow this large
+const lockoutSweepAt = 10000
+
+// lockout counts the failed logins of an account or an IP. After
+// MaxFailures of them further attempts are refused for Base, which doubles
+// with every failure up to Max. A successful login of the account resets
+// its count, IPs only recover with time.
+type lockout struct {
+	MaxFailures int
+	Base        time.Duration
+	Max         time.Duration
+
+	m  map[string]*loginFailures
+	mu sync.Mutex
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+var (
+	accountLockout = newLockout(envInt("LOGIN_MAX_FAILURES", 5))
+	ipLockout      = newLockout(envInt("LOGIN_IP_MAX_FAILURES", 20))
+)
+
+func newLockout(maxFailures int) *lockout {
+	return &lockout{
+		MaxFailures: maxFailures,
+		Base:        envMilliseconds("LOGIN_LOCKOUT_MS", 30000),
+		Max:         envMilliseconds("LOGIN_LOCKOUT_MAX_MS", 900000),
+		m:           make(map[string]*loginFailures),
+	}
+}
+
+// Retry returns how long key is still locked out, 0 if it isn't.
+func (l *lockout) Retry(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.m[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(f.lockedUntil), 0)
+}
+
+// Fail records a failed login of key.
+func (l *lockout) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.m) >= lockoutSweepAt {
+		for k, f := range l.m {
+			if now.Sub(f.last) > lockoutForgetAfter {
+				delete(l.m, k)
+			}
+		}
+	}
+
+	f, ok := l.m[key]
+	if !ok || now.Sub(f.last) > lockoutForgetAfter {
+		f = &loginFailures{}
+		l.m[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if l.MaxFailures > 0 && f.count >= l.MaxFailures {
+		// the shift is bounded, as Max is reached long before it overflows
+		d := l.Base << min(f.count-l.MaxFailures, 32)
+		if d > l.Max || d <= 0 {
+			d = l.Max
+		}
+		f.lockedUntil = now.Add(d)
+	}
+}
+
+func (l *lockout) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.m, key)
+}
+
+// lockedOut answers 429 with a Retry-After header if the login or the IP of
+// the request is locked out.
+func lockedOut(w http.ResponseWriter, r *http.Request, login string) bool {
+	d := max(accountLockout.Retry(login), ipLockout.Retry(clientIP(r)))
+	if d == 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(d.Seconds()))))
+	generateErrorResponse(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+	return true
+}
+
+func loginFailed(r *http.Request, login string) {
+	accountLockout.Fail(login)
+	ipLockout.Fail(clientIP(r))
+}
@@ -0,0 +1,60 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails of the orchestrator, like password reset links.
+// Other implementations, e.g. for SMTP, can replace Mail before the server
+// starts.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// Mail is a FileMailer writing to MAIL_DIR if it is set, a LogMailer
+// otherwise.
+var Mail Mailer = LogMailer{}
+
+func init() {
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		Mail = FileMailer{Dir: dir}
+	}
+}
+
+// LogMailer writes the emails to the log instead of sending them, for local
+// use.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, email Email) error {
+	log.Printf("Email to %s: %s\n%s\n", email.To, email.Subject, email.Body)
+	return nil
+}
+
+// FileMailer writes every email to a file of its own in Dir.
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) Send(ctx context.Context, email Email) error {
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := filepath.Join(m.Dir, fmt.Sprintf("%d-%s.eml", now.Unix(), uuid.NewString()))
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n", email.To, email.Subject, now.Format(time.RFC1123Z), email.Body)
+	return os.WriteFile(name, []byte(content), 0o600)
+}
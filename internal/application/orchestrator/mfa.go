@@ -0,0 +1,599 @@
+package application
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"rsc.io/qr"
+)
+
+// TOTP as in RFC 6238 with the defaults authenticator apps expect: SHA-1,
+// 6 digits and 30 second steps. Codes of the steps next to the current one
+// are accepted too, for clocks which are a little off.
+const (
+	totpIssuer = "Calculator"
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+const recoveryCodeCount = 10
+
+// a login waits this long for its code, which may be wrong a few times
+const (
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAttempts = 5
+)
+
+type MFALoginRequest = client.MFALoginRequest
+
+type MFACodeRequest = client.MFACodeRequest
+
+type MFAEnrollment = client.MFAEnrollment
+
+type RecoveryCodes = client.RecoveryCodes
+
+type MFAStatus = client.MFAStatus
+
+var (
+	ErrMFAEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled   = errors.New("two-factor authentication isn't enabled")
+	ErrMFANotEnrolled  = errors.New("there is no TOTP secret to verify, enroll first")
+	ErrInvalidMFACode  = errors.New("invalid code")
+	ErrInvalidMFAToken = errors.New("the mfa_token is invalid or expired, log in again")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the step code belongs to.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(login, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+login) + "?" + v.Encode()
+}
+
+// normalizeCode drops the spaces and dashes people type into codes.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func createMFATables(ctx context.Context, DB *sql.DB) error {
+	const totpTable = `
+	CREATE TABLE IF NOT EXISTS totp(
+		ownerID INTEGER PRIMARY KEY,
+		secret TEXT,
+		enabled INTEGER NOT NULL DEFAULT 0,
+		lastStep INTEGER NOT NULL DEFAULT 0,
+		created INTEGER,
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	const recoveryCodesTable = `
+	CREATE TABLE IF NOT EXISTS recovery_codes(
+		hash TEXT PRIMARY KEY,
+		ownerID INTEGER,
+		used INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	for _, table := range []string{totpTable, recoveryCodesTable} {
+		if _, err := DB.ExecContext(ctx, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectTOTP returns the secret of the user and whether it is enabled, or
+// sql.ErrNoRows if the user has none.
+func selectTOTP(ctx context.Context, DB *sql.DB, userID int64) (string, bool, error) {
+	var (
+		secret  string
+		enabled bool
+	)
+	err := DB.QueryRowContext(ctx, "SELECT secret, enabled FROM totp WHERE ownerID = $1", userID).Scan(&secret, &enabled)
+	return secret, enabled, err
+}
+
+func mfaEnabled(ctx context.Context, DB *sql.DB, userID int64) (bool, error) {
+	_, enabled, err := selectTOTP(ctx, DB, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// insertTOTP creates a new secret of the user, which replaces one that
+// wasn't verified.
+func insertTOTP(ctx context.Context, DB *sql.DB, userID int64) (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := totpEncoding.EncodeToString(b)
+
+	result, err := DB.ExecContext(ctx, `
+	INSERT INTO totp (ownerID, secret, created) values ($1, $2, $3)
+	ON CONFLICT(ownerID) DO UPDATE SET secret = excluded.secret, lastStep = 0, created = excluded.created WHERE enabled = 0
+	`, userID, secret, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", ErrMFAEnabled
+	}
+	return secret, nil
+}
+
+// useMFACode checks a TOTP code of the user, or a recovery code if
+// recovery is true. Every code works once.
+func useMFACode(ctx context.Context, DB *sql.DB, userID int64, code string, recovery bool) error {
+	code = normalizeCode(code)
+
+	if len(code) == totpDigits {
+		secret, _, err := selectTOTP(ctx, DB, userID)
+		if err == sql.ErrNoRows {
+			return ErrInvalidMFACode
+		}
+		if err != nil {
+			return err
+		}
+		key, err := totpEncoding.DecodeString(secret)
+		if err != nil {
+			return err
+		}
+
+		step, ok := matchTOTP(key, code, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		// a code seen before may have been watched over the shoulder
+		result, err := DB.ExecContext(ctx, "UPDATE totp SET lastStep = $1 WHERE ownerID = $2 AND lastStep < $1", step, userID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	if !recovery {
+		return ErrInvalidMFACode
+	}
+	result, err := DB.ExecContext(ctx, "UPDATE recovery_codes SET used = 1 WHERE hash = $1 AND ownerID = $2 AND used = 0", hashSecret(code), userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// newRecoveryCodes replaces the recovery codes of the user, and enables its
+// TOTP secret if it isn't yet.
+func newRecoveryCodes(ctx context.Context, DB *sql.DB, userID int64) ([]string, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE totp SET enabled = 1 WHERE ownerID = $1", userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE ownerID = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (hash, ownerID) values ($1, $2)", hashSecret(code), userID); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+func deleteTOTP(ctx context.Context, DB *sql.DB, userID int64) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM totp WHERE ownerID = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE ownerID = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mfaChallenge is a login whose password was right, waiting for its code.
+type mfaChallenge struct {
+	userID   int64
+	login    string
+	expires  time.Time
+	attempts int
+}
+
+type mfaChallenges struct {
+	m  map[string]*mfaChallenge
+	mu sync.Mutex
+}
+
+var challenges = mfaChallenges{m: make(map[string]*mfaChallenge)}
+
+// New returns the token of a new challenge of the user.
+func (mc *mfaChallenges) New(userID int64, login string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	now := time.Now()
+	for hash, c := range mc.m {
+		if now.After(c.expires) {
+			delete(mc.m, hash)
+		}
+	}
+	mc.m[hashSecret(token)] = &mfaChallenge{userID: userID, login: login, expires: now.Add(mfaChallengeTTL)}
+	return token, nil
+}
+
+func (mc *mfaChallenges) Get(token string) (mfaChallenge, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	c, ok := mc.m[hashSecret(token)]
+	if !ok || time.Now().After(c.expires) {
+		return mfaChallenge{}, false
+	}
+	return *c, true
+}
+
+// Fail records a wrong code, the challenge ends after too many of them.
+func (mc *mfaChallenges) Fail(token string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if c, ok := mc.m[hashSecret(token)]; ok {
+		c.attempts++
+		if c.attempts >= mfaChallengeAttempts {
+			delete(mc.m, hashSecret(token))
+		}
+	}
+}
+
+func (mc *mfaChallenges) Delete(token string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.m, hashSecret(token))
+}
+
+// ApiLoginMFAHandler completes a login with the mfa_token of
+// ApiLoginHandler and a TOTP or recovery code.
+func ApiLoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	challenge, ok := challenges.Get(req.MFAToken)
+	if !ok {
+		generateErrorResponse(w, ErrInvalidMFAToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	if lockedOut(w, r, challenge.login) {
+		return
+	}
+
+	err := useMFACode(ctx, DB, challenge.userID, req.Code, true)
+	if err == ErrInvalidMFACode {
+		challenges.Fail(req.MFAToken)
+		loginFailed(r, challenge.login)
+		generateErrorResponse(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	challenges.Delete(req.MFAToken)
+	accountLockout.Reset(challenge.login)
+
+	user, err := selectUserByID(ctx, DB, challenge.userID)
+	if err == sql.ErrNoRows || (err == nil && user.Disabled) {
+		generateErrorResponse(w, ErrUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	tokens, err := startSession(ctx, r, user.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	setSessionCookies(w, r, tokens)
+
+	json, err := json.Marshal(tokens)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiMFAHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var status MFAStatus
+	err := DB.QueryRowContext(r.Context(), `
+	SELECT EXISTS(SELECT 1 FROM totp WHERE ownerID = $1 AND enabled = 1), (SELECT COUNT(*) FROM recovery_codes WHERE ownerID = $1 AND used = 0)
+	`, uid).Scan(&status.TOTPEnabled, &status.RecoveryCodesLeft)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(status)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+// ApiTOTPHandler enrolls a TOTP secret with POST and turns two-factor
+// authentication off with DELETE.
+func ApiTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		if enabled, err := mfaEnabled(ctx, DB, uid); err != nil {
+			internalError(w, err)
+			return
+		} else if !enabled {
+			generateErrorResponse(w, ErrMFANotEnabled.Error(), http.StatusConflict)
+			return
+		}
+		if !checkMFACode(w, r, uid, req.Code, true) {
+			return
+		}
+
+		if err := deleteTOTP(ctx, DB, uid); err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	user, err := selectUserByID(ctx, DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	secret, err := insertTOTP(ctx, DB, uid)
+	if err == ErrMFAEnabled {
+		generateErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	enrollment := MFAEnrollment{Secret: secret, URI: totpURI(user.Name, secret)}
+	code, err := qr.Encode(enrollment.URI, qr.M)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	enrollment.QRPNG = code.PNG()
+
+	json, err := json.Marshal(enrollment)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(json))
+}
+
+// ApiTOTPVerifyHandler enables the enrolled secret with one of its codes
+// and returns the recovery codes.
+func ApiTOTPVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	_, enabled, err := selectTOTP(ctx, DB, uid)
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, ErrMFANotEnrolled.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if enabled {
+		generateErrorResponse(w, ErrMFAEnabled.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := useMFACode(ctx, DB, uid, req.Code, false); err == ErrInvalidMFACode {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	writeRecoveryCodes(w, r, uid)
+}
+
+// ApiRecoveryCodesHandler replaces the recovery codes, which takes a TOTP
+// code.
+func ApiRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	if enabled, err := mfaEnabled(ctx, DB, uid); err != nil {
+		internalError(w, err)
+		return
+	} else if !enabled {
+		generateErrorResponse(w, ErrMFANotEnabled.Error(), http.StatusConflict)
+		return
+	}
+	if !checkMFACode(w, r, uid, req.Code, false) {
+		return
+	}
+
+	writeRecoveryCodes(w, r, uid)
+}
+
+// checkMFACode uses the code of a logged in user, whose failures count
+// towards the lockouts like the ones of ApiLoginMFAHandler, so that a
+// stolen session can't guess its way to the second factor. If it reports
+// false, the error is already written to w.
+func checkMFACode(w http.ResponseWriter, r *http.Request, uid int64, code string, recovery bool) bool {
+	ctx := r.Context()
+
+	user, err := selectUserByID(ctx, DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return false
+	}
+	if lockedOut(w, r, user.Name) {
+		return false
+	}
+
+	err = useMFACode(ctx, DB, uid, code, recovery)
+	if err == ErrInvalidMFACode {
+		loginFailed(r, user.Name)
+		generateErrorResponse(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		internalError(w, err)
+		return false
+	}
+	accountLockout.Reset(user.Name)
+	return true
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, r *http.Request, uid int64) {
+	codes, err := newRecoveryCodes(r.Context(), DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(RecoveryCodes{Codes: codes})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
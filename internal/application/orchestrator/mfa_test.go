@@ -0,0 +1,249 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238, appendix B
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := totpCode(secret, test.unix/totpPeriod); code != test.code {
+			t.Errorf("%d: expected %s, got %s", test.unix, test.code, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	if _, ok := matchTOTP(secret, totpCode(secret, now.Unix()/totpPeriod-1), now); !ok {
+		t.Error("expected the code of the previous step to match")
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, now.Unix()/totpPeriod-2), now); ok {
+		t.Error("expected an older code not to match")
+	}
+}
+
+func TestMFALogin(t *testing.T) {
+	useTestDB(t)
+	useTestLockouts(t)
+	ctx := context.Background()
+
+	hash, _ := generate("secret-42")
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: hash})
+	session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	request := func(method, path, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			withBearer(r, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(http.MethodPost, "/api/v1/mfa/totp", "", session.Token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the enrollment to succeed, got %d %s", w.Code, w.Body)
+	}
+	var enrollment MFAEnrollment
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Calculator:alice?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Fatalf("unexpected URI %s", enrollment.URI)
+	}
+	if !strings.HasPrefix(string(enrollment.QRPNG), "\x89PNG") {
+		t.Fatal("expected a PNG of the QR code")
+	}
+	key, _ := totpEncoding.DecodeString(enrollment.Secret)
+	code := func(offset int64) string {
+		return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+	}
+
+	// the secret isn't used before it is verified
+	if w := request(http.MethodPost, "/api/v1/login", `{"login": "alice", "password": "secret-42"}`, ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "mfa_token") {
+		t.Fatalf("expected a normal login before the verification, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodPost, "/api/v1/mfa/totp/verify", `{"code": "000000x"}`, session.Token); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a wrong code to be refused, got %d", w.Code)
+	}
+	verified := code(-1)
+	w = request(http.MethodPost, "/api/v1/mfa/totp/verify", `{"code": "`+verified+`"}`, session.Token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the verification to succeed, got %d %s", w.Code, w.Body)
+	}
+	var recovery RecoveryCodes
+	json.Unmarshal(w.Body.Bytes(), &recovery)
+	if len(recovery.Codes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(recovery.Codes))
+	}
+	if w := request(http.MethodPost, "/api/v1/mfa/totp", "", session.Token); w.Code != http.StatusConflict {
+		t.Fatalf("expected no second enrollment, got %d", w.Code)
+	}
+
+	login := func() string {
+		w := request(http.MethodPost, "/api/v1/login", `{"login": "alice", "password": "secret-42"}`, "")
+		var tokens RegistrationResponse
+		json.Unmarshal(w.Body.Bytes(), &tokens)
+		if w.Code != http.StatusOK || tokens.Status != "mfa_required" || tokens.Token != "" || tokens.MFAToken == "" {
+			t.Fatalf("expected a challenge, got %d %s", w.Code, w.Body)
+		}
+		return tokens.MFAToken
+	}
+	complete := func(token, code string) *httptest.ResponseRecorder {
+		return request(http.MethodPost, "/api/v1/login/mfa", `{"mfa_token": "`+token+`", "code": "`+code+`"}`, "")
+	}
+
+	challenge := login()
+	if w := complete(challenge, verified); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a used code to be refused, got %d", w.Code)
+	}
+	if w := complete("nope", code(0)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown challenge to be refused, got %d", w.Code)
+	}
+	w = complete(challenge, code(0))
+	var tokens RegistrationResponse
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || tokens.Token == "" {
+		t.Fatalf("expected the tokens, got %d %s", w.Code, w.Body)
+	}
+	if w := complete(challenge, code(1)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the challenge to be used up, got %d", w.Code)
+	}
+
+	// recovery codes work once, with or without the dash
+	recoveryCode := strings.ToUpper(strings.ReplaceAll(recovery.Codes[0], "-", " "))
+	if w := complete(login(), recoveryCode); w.Code != http.StatusOK {
+		t.Fatalf("expected the recovery code to work, got %d %s", w.Code, w.Body)
+	}
+	if w := complete(login(), recovery.Codes[0]); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the recovery code to be used up, got %d", w.Code)
+	}
+
+	w = request(http.MethodGet, "/api/v1/mfa", "", tokens.Token)
+	var status MFAStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if !status.TOTPEnabled || status.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Fatalf("unexpected status %s", w.Body)
+	}
+
+	if w := request(http.MethodDelete, "/api/v1/mfa/totp", `{"code": "`+recovery.Codes[1]+`"}`, tokens.Token); w.Code != http.StatusNoContent {
+		t.Fatalf("expected two-factor authentication to be turned off, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodPost, "/api/v1/login", `{"login": "alice", "password": "secret-42"}`, ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "mfa_token") {
+		t.Fatalf("expected a normal login again, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMFAChallengeAttempts(t *testing.T) {
+	useTestDB(t)
+	useTestLockouts(t)
+	accountLockout.MaxFailures = mfaChallengeAttempts + 2
+	ctx := context.Background()
+
+	hash, _ := generate("secret-42")
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: hash})
+	if _, err := insertTOTP(ctx, DB, uid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRecoveryCodes(ctx, DB, uid); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	request := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+
+	var tokens RegistrationResponse
+	json.Unmarshal(request("/api/v1/login", `{"login": "alice", "password": "secret-42"}`).Body.Bytes(), &tokens)
+	for i := 0; i < mfaChallengeAttempts; i++ {
+		if w := request("/api/v1/login/mfa", `{"mfa_token": "`+tokens.MFAToken+`", "code": "zzzzz-zzzzz"}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a wrong code to be refused, got %d", w.Code)
+		}
+	}
+	if _, ok := challenges.Get(tokens.MFAToken); ok {
+		t.Fatal("expected the challenge to end after too many wrong codes")
+	}
+
+	// the right password of a new challenge doesn't reset the failures
+	json.Unmarshal(request("/api/v1/login", `{"login": "alice", "password": "secret-42"}`).Body.Bytes(), &tokens)
+	for i := 0; i < 2; i++ {
+		request("/api/v1/login/mfa", `{"mfa_token": "`+tokens.MFAToken+`", "code": "zzzzz-zzzzz"}`)
+	}
+	if w := request("/api/v1/login", `{"login": "alice", "password": "secret-42"}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the account to be locked out, got %d", w.Code)
+	}
+}
+
+func TestMFACodeAttempts(t *testing.T) {
+	useTestDB(t)
+	useTestLockouts(t)
+	ctx := context.Background()
+
+	hash, _ := generate("secret-42")
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: hash})
+	if _, err := insertTOTP(ctx, DB, uid); err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := newRecoveryCodes(ctx, DB, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), session.Token))
+		return w
+	}
+
+	// a stolen session can't guess the codes which turn MFA off or show the
+	// recovery codes
+	for _, path := range []string{"/api/v1/mfa/recovery-codes", "/api/v1/mfa/totp"} {
+		method := http.MethodPost
+		if path == "/api/v1/mfa/totp" {
+			method = http.MethodDelete
+		}
+		accountLockout.Reset("alice")
+		for i := 0; i < accountLockout.MaxFailures; i++ {
+			if w := request(method, path, `{"code": "zzzzz-zzzzz"}`); w.Code != http.StatusForbidden {
+				t.Fatalf("%s %s: expected a wrong code to be refused, got %d", method, path, w.Code)
+			}
+		}
+		if w := request(http.MethodDelete, "/api/v1/mfa/totp", `{"code": "`+recovery[0]+`"}`); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s %s: expected the right code to be refused during the lockout, got %d", method, path, w.Code)
+		}
+		if w := request(http.MethodPost, "/api/v1/login", `{"login": "alice", "password": "secret-42"}`); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s %s: expected the logins to be locked out too, got %d", method, path, w.Code)
+		}
+	}
+
+	accountLockout.Reset("alice")
+	if w := request(http.MethodDelete, "/api/v1/mfa/totp", `{"code": "`+recovery[0]+`"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected MFA to be turned off, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,655 @@
+package application
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Users can log in with an OpenID Connect provider next to their passwords,
+// with the authorization code flow and PKCE. The first login of a subject
+// links it to the user with its verified email, or creates a user.
+
+const oidcStateCookie = "oidc_state"
+
+// a login has this long to come back from the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// the keys of the provider are fetched again at most this often when a
+// token names an unknown one
+const oidcKeysRefresh = time.Minute
+
+var (
+	ErrOIDCNoAccount    = errors.New("there is no account for this login and sign up is disabled")
+	ErrInvalidIDToken   = errors.New("invalid ID token")
+	ErrOIDCLoginExpired = errors.New("the login expired or was started in another browser, try again")
+)
+
+// OIDCProvider is the OpenID Connect provider of the orchestrator. Its
+// endpoints and keys come from the discovery document of Issuer.
+type OIDCProvider struct {
+	// Name is shown on the login page.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered at the provider,
+	// PUBLIC_URL/auth/oidc/callback if it is empty.
+	RedirectURL string
+	Scopes      []string
+	// AllowSignup creates users for subjects which aren't linked to one
+	// and have no verified email of an existing user.
+	AllowSignup bool
+	Client      *http.Client
+
+	mu          sync.Mutex
+	config      *oidcConfiguration
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDC is nil unless LoadOIDC configured a provider.
+var OIDC *OIDCProvider
+
+// LoadOIDC configures the provider from OIDC_ISSUER, OIDC_CLIENT_ID and
+// OIDC_CLIENT_SECRET (or the contents of OIDC_CLIENT_SECRET_FILE). Without
+// OIDC_ISSUER users only log in with passwords.
+func LoadOIDC() error {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil
+	}
+
+	p := &OIDCProvider{
+		Name:         os.Getenv("OIDC_NAME"),
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		AllowSignup:  envBool("OIDC_ALLOW_SIGNUP", true),
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if file := os.Getenv("OIDC_CLIENT_SECRET_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		p.ClientSecret = strings.TrimSpace(string(b))
+	}
+	if p.ClientID == "" {
+		return errors.New("OIDC_ISSUER is set without OIDC_CLIENT_ID")
+	}
+	if p.Name == "" {
+		p.Name = "SSO"
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	OIDC = p
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// configuration fetches the discovery document once, later logins use it
+// as it is.
+func (p *OIDCProvider) configuration(ctx context.Context) (*oidcConfiguration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	var config oidcConfiguration
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != p.Issuer {
+		return nil, fmt.Errorf("the discovery document is of the issuer %q, not %q", config.Issuer, p.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, errors.New("the discovery document lacks endpoints")
+	}
+	p.config = &config
+	return p.config, nil
+}
+
+// key returns the public key kid of the provider, fetching the keys again
+// if it doesn't know it, e.g. after the provider rotated them.
+func (p *OIDCProvider) key(ctx context.Context, config *oidcConfiguration, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysRefresh {
+		return nil, ErrUnknownKey
+	}
+
+	var jwks JWKS
+	p.keysFetched = time.Now()
+	if err := p.getJSON(ctx, config.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]any)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("Skipping the key %q of the OIDC provider: %v\n", jwk.ID, err)
+			continue
+		}
+		p.keys[jwk.ID] = key
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// PublicKey returns the RSA, P-256 or Ed25519 key of the JWK.
+func (k JWK) PublicKey() (any, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch {
+	case k.KeyType == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.KeyType == "EC" && k.Curve == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point isn't on the curve")
+		}
+		return key, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", k.KeyType, k.Curve)
+}
+
+func (p *OIDCProvider) redirectURL(r *http.Request) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	if u := publicURL(); u != "" {
+		return u + "/auth/oidc/callback"
+	}
+	// the provider only redirects to the callbacks registered there, so the
+	// host of the request can't send the code elsewhere
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/oidc/callback"
+}
+
+// exchange swaps the authorization code for the ID token.
+func (p *OIDCProvider) exchange(ctx context.Context, config *oidcConfiguration, code, verifier, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// oidcClaims are the claims of an ID token used to find its user.
+type oidcClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+var oidcParser = &jwt.Parser{ValidMethods: []string{AlgRS256, "ES256", AlgEdDSA}}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// the ID token.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, config *oidcConfiguration, raw, nonce string) (oidcClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := oidcParser.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, config, kid)
+	})
+	if err != nil {
+		return oidcClaims{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != config.Issuer {
+		return oidcClaims{}, fmt.Errorf("%w: issued by %q", ErrInvalidIDToken, iss)
+	}
+	var audience []any
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []any{aud}
+	case []any:
+		audience = aud
+	}
+	audienceOK := false
+	for _, aud := range audience {
+		audienceOK = audienceOK || aud == p.ClientID
+	}
+	if !audienceOK {
+		return oidcClaims{}, fmt.Errorf("%w: issued for %v", ErrInvalidIDToken, claims["aud"])
+	}
+	// the parser only checks exp if there is one
+	if _, ok := claims["exp"].(float64); !ok {
+		return oidcClaims{}, fmt.Errorf("%w: no exp", ErrInvalidIDToken)
+	}
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return oidcClaims{}, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	}
+
+	var result oidcClaims
+	result.Subject, _ = claims["sub"].(string)
+	result.Email, _ = claims["email"].(string)
+	result.PreferredUsername, _ = claims["preferred_username"].(string)
+	// some providers send the flag as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		result.EmailVerified = verified
+	case string:
+		result.EmailVerified = verified == "true"
+	}
+	if result.Subject == "" {
+		return oidcClaims{}, fmt.Errorf("%w: no sub", ErrInvalidIDToken)
+	}
+	return result, nil
+}
+
+func createOIDCIdentitiesTable(ctx context.Context, DB *sql.DB) error {
+	const oidcIdentitiesTable = `
+	CREATE TABLE IF NOT EXISTS oidc_identities(
+		issuer TEXT,
+		subject TEXT,
+		ownerID INTEGER,
+		created INTEGER,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	_, err := DB.ExecContext(ctx, oidcIdentitiesTable)
+	return err
+}
+
+// loginPattern is what a login derived from the claims may consist of.
+var loginPattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// oidcUser returns the user linked to the subject. An unlinked subject is
+// linked to the user with its email if both the provider and this server
+// verified it, or to a new user if sign up is allowed. Anyone can register
+// with any email, so an unverified one would hand the subject to whoever
+// registered it first.
+func oidcUser(ctx context.Context, DB *sql.DB, issuer string, claims oidcClaims, signup bool) (User, error) {
+	var userID int64
+	err := DB.QueryRowContext(ctx, "SELECT ownerID FROM oidc_identities WHERE issuer = $1 AND subject = $2", issuer, claims.Subject).Scan(&userID)
+	if err == nil {
+		return selectUserByID(ctx, DB, userID)
+	}
+	if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	if claims.Email != "" && claims.EmailVerified {
+		err := DB.QueryRowContext(ctx, "SELECT id FROM users WHERE email = $1 COLLATE NOCASE AND emailVerified = 1 ORDER BY id LIMIT 1", claims.Email).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			return User{}, err
+		}
+	}
+
+	if userID == 0 {
+		if !signup {
+			return User{}, ErrOIDCNoAccount
+		}
+		if userID, err = insertOIDCUser(ctx, DB, claims); err != nil {
+			return User{}, err
+		}
+	}
+
+	_, err = DB.ExecContext(ctx, `
+	INSERT INTO oidc_identities (issuer, subject, ownerID, created) values ($1, $2, $3, $4)
+	`, issuer, claims.Subject, userID, time.Now().Unix())
+	if err != nil {
+		return User{}, err
+	}
+	return selectUserByID(ctx, DB, userID)
+}
+
+// insertOIDCUser creates a user named after the claims, with a password
+// nobody knows; a reset link sets one.
+func insertOIDCUser(ctx context.Context, DB *sql.DB, claims oidcClaims) (int64, error) {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	name = strings.Trim(loginPattern.ReplaceAllString(name, "-"), "-")
+	if len(name) < 3 {
+		name = "user"
+	}
+
+	password, err := randomToken()
+	if err != nil {
+		return 0, err
+	}
+	hash, err := generate(password)
+	if err != nil {
+		return 0, err
+	}
+
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+
+	login := name
+	for i := 2; ; i++ {
+		_, err := selectUser(ctx, DB, login)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		login = fmt.Sprintf("%s-%d", name, i)
+	}
+	id, err := insertUser(ctx, DB, &User{Name: login, Password: hash, Email: email})
+	if err != nil {
+		return 0, err
+	}
+	return id, verifyEmail(ctx, DB, id)
+}
+
+// oidcLogin is a login which went to the provider and hasn't come back.
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+type oidcLogins struct {
+	m  map[string]oidcLogin
+	mu sync.Mutex
+}
+
+var pendingOIDCLogins = oidcLogins{m: make(map[string]oidcLogin)}
+
+func (ol *oidcLogins) Add(state string, login oidcLogin) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	now := time.Now()
+	for s, l := range ol.m {
+		if now.After(l.expires) {
+			delete(ol.m, s)
+		}
+	}
+	ol.m[state] = login
+}
+
+// Take returns the login of state, which can only be completed once.
+func (ol *oidcLogins) Take(state string) (oidcLogin, bool) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	login, ok := ol.m[state]
+	delete(ol.m, state)
+	if !ok || time.Now().After(login.expires) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcFailed sends the browser back to the login page, which shows message.
+func oidcFailed(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/login?error="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+// OIDCLoginHandler sends the browser to the provider.
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	config, err := OIDC.configuration(r.Context())
+	if err != nil {
+		log.Printf("Fetching the OIDC discovery document failed: %v\n", err)
+		oidcFailed(w, r, OIDC.Name+" is unavailable, try again later")
+		return
+	}
+
+	var state, nonce, verifier string
+	for _, token := range []*string{&state, &nonce, &verifier} {
+		if *token, err = randomToken(); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	pendingOIDCLogins.Add(state, oidcLogin{nonce: nonce, verifier: verifier, expires: time.Now().Add(oidcLoginTTL)})
+
+	// the cookie ties the callback to this browser
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: state, Path: "/auth/oidc", MaxAge: int(oidcLoginTTL.Seconds()), HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {OIDC.ClientID},
+		"redirect_uri":          {OIDC.redirectURL(r)},
+		"scope":                 {strings.Join(OIDC.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, config.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// OIDCCallbackHandler completes the login with the code from the provider
+// and sets the session cookies. Users with two-factor authentication still
+// enter a code on the login page.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+
+	if e := query.Get("error"); e != "" {
+		oidcFailed(w, r, fmt.Sprintf("%s refused the login: %s", OIDC.Name, strings.TrimSpace(e+" "+query.Get("error_description"))))
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		oidcFailed(w, r, ErrOIDCLoginExpired.Error())
+		return
+	}
+	login, ok := pendingOIDCLogins.Take(state)
+	if !ok {
+		oidcFailed(w, r, ErrOIDCLoginExpired.Error())
+		return
+	}
+
+	failed := func(err error) {
+		log.Printf("OIDC login failed: %v\n", err)
+		oidcFailed(w, r, "the login with "+OIDC.Name+" failed")
+	}
+
+	config, err := OIDC.configuration(ctx)
+	if err != nil {
+		failed(err)
+		return
+	}
+	idToken, err := OIDC.exchange(ctx, config, query.Get("code"), login.verifier, OIDC.redirectURL(r))
+	if err != nil {
+		failed(err)
+		return
+	}
+	claims, err := OIDC.verifyIDToken(ctx, config, idToken, login.nonce)
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	user, err := oidcUser(ctx, DB, config.Issuer, claims, OIDC.AllowSignup)
+	if err == ErrOIDCNoAccount {
+		oidcFailed(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		failed(err)
+		return
+	}
+	if user.Disabled {
+		oidcFailed(w, r, ErrUserDisabled.Error())
+		return
+	}
+
+	mfa, err := mfaEnabled(ctx, DB, user.ID)
+	if err != nil {
+		failed(err)
+		return
+	}
+	if mfa {
+		token, err := challenges.New(user.ID, user.Name)
+		if err != nil {
+			failed(err)
+			return
+		}
+		// the fragment stays out of logs and Referer headers
+		http.Redirect(w, r, "/login#mfa_token="+url.QueryEscape(token), http.StatusSeeOther)
+		return
+	}
+
+	tokens, err := startSession(ctx, r, user.ID)
+	if err != nil {
+		failed(err)
+		return
+	}
+	setSessionCookies(w, r, tokens)
+	http.Redirect(w, r, "/calculate", http.StatusSeeOther)
+}
@@ -0,0 +1,327 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// mockOIDC is an OpenID Connect provider which logs in whoever has the
+// claims of Next without asking.
+type mockOIDC struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Next are the claims of the next login.
+	Next jwt.MapClaims
+	// Audience overrides the aud of the ID tokens.
+	Audience string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockCode
+}
+
+type mockCode struct {
+	claims      jwt.MapClaims
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{ClientID: "calculator", ClientSecret: "mock-secret", key: key, codes: make(map[string]mockCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{{
+			KeyType: "RSA", ID: "mock-1", Algorithm: AlgRS256, Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != m.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken()
+		m.mu.Lock()
+		m.codes[code] = mockCode{claims: m.Next, nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != m.ClientID || password != m.ClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		m.mu.Lock()
+		code, ok := m.codes[r.PostFormValue("code")]
+		delete(m.codes, r.PostFormValue("code"))
+		m.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || code.redirectURI != r.PostFormValue("redirect_uri") || code.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{"iss": m.URL, "aud": m.ClientID, "iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(), "nonce": code.nonce}
+		if m.Audience != "" {
+			claims["aud"] = m.Audience
+		}
+		for k, v := range code.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "mock-1"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "mock", "token_type": "Bearer", "id_token": idToken})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// useMockOIDC makes the mock the provider of the orchestrator.
+func useMockOIDC(t *testing.T) *mockOIDC {
+	m := newMockOIDC(t)
+	previous := OIDC
+	OIDC = &OIDCProvider{Name: "Mock", Issuer: m.URL, ClientID: m.ClientID, ClientSecret: m.ClientSecret, Scopes: []string{"openid", "email"}, AllowSignup: true, Client: m.Client()}
+	t.Cleanup(func() { OIDC = previous })
+	return m
+}
+
+// loginWithOIDC goes through the login as a browser would and returns the
+// answer of the callback.
+func loginWithOIDC(t *testing.T, handler http.Handler, m *mockOIDC, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	t.Helper()
+	m.Next = claims
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the provider, got %d %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the provider to redirect back, got %s", resp.Status)
+	}
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	r := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func loggedInAs(t *testing.T, w *httptest.ResponseRecorder) int64 {
+	t.Helper()
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/calculate" {
+		t.Fatalf("expected the login to succeed, got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == TokenCookie && c.Value != "" {
+			claims := jwt.MapClaims{}
+			if _, err := tokenParser.ParseWithClaims(c.Value, claims, keyFor); err != nil {
+				t.Fatal(err)
+			}
+			return int64(claims["id"].(float64))
+		}
+	}
+	t.Fatal("expected a token cookie")
+	return 0
+}
+
+func loginError(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || location.Path != "/login" || location.Query().Get("error") == "" {
+		t.Fatalf("expected to be sent back to the login page with an error, got %d to %s", w.Code, location)
+	}
+	return location.Query().Get("error")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	useTestDB(t)
+	m := useMockOIDC(t)
+	ctx := context.Background()
+	handler := NewRouter()
+
+	aliceID, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash", Email: "Alice@example.com"})
+	bobID, _ := insertUser(ctx, DB, &User{Name: "bob", Password: "hash", Email: "bob@example.com"})
+	if err := verifyEmail(ctx, DB, aliceID); err != nil {
+		t.Fatal(err)
+	}
+
+	// an email verified by both sides links the subject to the existing user
+	if id := loggedInAs(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-alice", "email": "alice@example.com", "email_verified": true})); id != aliceID {
+		t.Fatalf("expected to log in as alice (%d), got %d", aliceID, id)
+	}
+	// from then on the subject is what counts
+	if id := loggedInAs(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-alice", "email": "alice@elsewhere.example"})); id != aliceID {
+		t.Fatalf("expected the linked subject to log in as alice, got %d", id)
+	}
+
+	// an unverified email doesn't, the user is created instead
+	id := loggedInAs(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-bob", "email": "bob@example.com", "preferred_username": "bob"}))
+	if id == bobID {
+		t.Fatal("expected an unverified email not to link to bob")
+	}
+	user, err := selectUserByID(ctx, DB, id)
+	if err != nil || user.Name != "bob-2" || user.Email != "" {
+		t.Fatalf("expected a new user bob-2 without email, got %+v, %v", user, err)
+	}
+	if _, err := authenticate(ctx, httptest.NewRequest(http.MethodPost, "/", nil), "bob-2", ""); err != ErrInvalidCredentials {
+		t.Fatalf("expected the new user to have no usable password, got %v", err)
+	}
+
+	// anyone may register with the email of someone else, which must not
+	// hand them the account of its owner
+	malloryID, _ := insertUser(ctx, DB, &User{Name: "mallory", Password: "hash", Email: "carol@example.com"})
+	id = loggedInAs(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-carol", "email": "carol@example.com", "email_verified": true, "preferred_username": "carol"}))
+	if id == malloryID {
+		t.Fatal("expected the unverified email of mallory not to link to carol")
+	}
+	if user, err := selectUserByID(ctx, DB, id); err != nil || user.Name != "carol" {
+		t.Fatalf("expected a new user carol, got %+v, %v", user, err)
+	}
+	if id := loggedInAs(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-carol-2", "email": "carol@example.com", "email_verified": true})); id == malloryID {
+		t.Fatal("expected the verified email of carol to win over the one of mallory")
+	}
+
+	OIDC.AllowSignup = false
+	if msg := loginError(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-dave", "email": "dave@example.com", "email_verified": true})); msg != ErrOIDCNoAccount.Error() {
+		t.Fatalf("expected sign up to be refused, got %q", msg)
+	}
+	OIDC.AllowSignup = true
+
+	m.Audience = "someone-else"
+	loginError(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-alice"}))
+	m.Audience = ""
+
+	updateUser(ctx, DB, User{ID: aliceID, Role: RoleUser, Disabled: true})
+	if msg := loginError(t, loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-alice"})); msg != ErrUserDisabled.Error() {
+		t.Fatalf("expected a disabled user to be refused, got %q", msg)
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	useTestDB(t)
+	m := useMockOIDC(t)
+	handler := NewRouter()
+	m.Next = jwt.MapClaims{"sub": "sub-alice"}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	// a callback without the cookie of the login, e.g. one an attacker
+	// started, is refused
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil))
+	if msg := loginError(t, w); msg != ErrOIDCLoginExpired.Error() {
+		t.Fatalf("expected the callback to be refused, got %q", msg)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?error=access_denied", nil))
+	if msg := loginError(t, w); !strings.Contains(msg, "access_denied") {
+		t.Fatalf("expected the error of the provider, got %q", msg)
+	}
+
+	OIDC = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a provider, got %d", w.Code)
+	}
+}
+
+func TestOIDCLoginMFA(t *testing.T) {
+	useTestDB(t)
+	m := useMockOIDC(t)
+	ctx := context.Background()
+	handler := NewRouter()
+
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash", Email: "alice@example.com"})
+	if err := verifyEmail(ctx, DB, uid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertTOTP(ctx, DB, uid); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := newRecoveryCodes(ctx, DB, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := loginWithOIDC(t, handler, m, jwt.MapClaims{"sub": "sub-alice", "email": "alice@example.com", "email_verified": true})
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/login#mfa_token=") {
+		t.Fatalf("expected a two-factor challenge, got %d to %s", w.Code, location)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == TokenCookie {
+			t.Fatal("expected no token before the code")
+		}
+	}
+
+	token, _ := url.QueryUnescape(strings.TrimPrefix(location, "/login#mfa_token="))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/login/mfa", strings.NewReader(`{"mfa_token": "`+token+`", "code": "`+codes[0]+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the code to complete the login, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,30 @@
+package application
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+// OpenAPISpec describes every /api/v1 route. Keep it in sync with NewRouter,
+// TestOpenAPISpecRoutes checks that the documented routes exist.
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+func ApiOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write(OpenAPISpec)
+}
+
+func DocsPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("../../html_templates/html/docs.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
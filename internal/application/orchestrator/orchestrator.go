@@ -9,13 +9,14 @@ import (
 	"html/template"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"runtime/debug"
 	"strings"
 	"time"
 
+	"github.com/Barsenick/calculator/internal/application/task"
 	"github.com/Barsenick/calculator/pkg/calc"
+	"github.com/Barsenick/calculator/pkg/client"
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
 
@@ -26,43 +27,46 @@ var (
 	ErrNoToken                = errors.New("no token found")
 	ErrUniqueConstraintFailed = errors.New("UNIQUE constraint failed: users.login")
 	ErrInvalidToken           = errors.New("token is invalid")
+	ErrCancelled              = errors.New("expression was cancelled")
+	ErrExpressionTimeout      = errors.New("expression evaluation timed out")
 )
 
-const hmacSampleSecret = "calculator_service_signature3"
-
-type Request struct {
-	Expression string `json:"expression"`
-}
+// The bodies of the API are shared with pkg/client, so that the server and
+// its clients can't disagree about them.
+type Request client.CalculateRequest
 
 type Expressions struct {
 	Expressions []Expression `json:"expressions"`
+	NextCursor  string       `json:"next_cursor,omitempty"`
 }
 
-type RegistrationRequest struct {
-	Name     string `json:"login"`
-	Password string `json:"password"`
-}
+type RegistrationRequest = client.Credentials
 
-type RegistrationResponse struct {
-	Status string `json:"status"`
-	Token  string `json:"token,omitempty"`
-}
+type RegistrationResponse = client.TokenResponse
 
 type Expression struct {
-	ID      string `json:"id"`
-	Status  string `json:"status"`
-	Result  string `json:"result"`
-	OwnerID int64  `json:"-"`
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Result   string `json:"result"`
+	Source   string `json:"expression"`
+	Created  int64  `json:"created"`
+	Finished int64  `json:"finished,omitempty"`
+	Label    string `json:"label"`
+	Notes    string `json:"notes"`
+	OwnerID  int64  `json:"-"`
+	// the workspace the expression belongs to and the login of its OwnerID
+	WorkspaceID int64  `json:"workspace_id"`
+	CreatedBy   string `json:"created_by,omitempty"`
+	// the operations computed so far, only loaded for a single expression
+	Trace []TraceStep `json:"trace,omitempty"`
 }
 
+type TraceStep = client.TraceStep
+
 type Response struct {
 	ID string `json:"id"`
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
-}
-
 type Application struct {
 }
 
@@ -75,125 +79,55 @@ type User struct {
 	Name           string
 	Password       string
 	OriginPassword string
+	Role           string
+	Disabled       bool
+	Email          string
 }
 
 var DB *sql.DB
 
-func generateErrorResponse(w http.ResponseWriter, errMsg string, code int) {
-	json, err := json.Marshal(ErrorResponse{Error: errMsg})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(code)
-	fmt.Fprint(w, string(json))
-}
-
-func enableCORS(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-}
-
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", 404)
 }
 
-func getToken(r *http.Request, claims *jwt.MapClaims) (*jwt.Token, error) {
-	if claims == nil {
-		tokenCookie, err := r.Cookie("token")
-		if err != nil || tokenCookie.Value == "" {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				return nil, ErrNoToken
-			} else {
-				tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-				token, err := parseToken(tokenString)
-				if err != nil || !token.Valid {
-					return nil, ErrInvalidToken
-				}
-				return token, nil
-			}
-		} else {
-			token, err := parseToken(tokenCookie.Value)
-			if err != nil || !token.Valid {
-				return nil, ErrInvalidToken
-			}
-			return token, nil
+// adminMiddleware lets only admins through. The role is looked up on every
+// request, so that a demoted admin loses access at once.
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := requestPrincipal(r)
+		if !ok {
+			unauthorized(w)
+			return
 		}
-	} else {
-		tokenCookie, err := r.Cookie("token")
-		if err != nil || tokenCookie.Value == "" {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				return nil, ErrNoToken
-			} else {
-				tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-				token, err := parseTokenWithClaims(tokenString, claims)
-				if err != nil || !token.Valid {
-					return nil, ErrInvalidToken
-				}
-				return token, nil
-			}
-		} else {
-			token, err := parseTokenWithClaims(tokenCookie.Value, claims)
-			if err != nil || !token.Valid {
-				return nil, ErrInvalidToken
-			}
-			return token, nil
+		if p.Method == AuthAPIKey {
+			generateErrorResponse(w, ErrAPIKeyNotAllowed.Error(), http.StatusForbidden)
+			return
 		}
-	}
-
-}
 
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, err := getToken(r, nil)
-		if err != nil || !token.Valid {
-			http.Redirect(w, r, "/login", http.StatusFound)
+		user, err := selectUserByID(r.Context(), DB, p.UserID)
+		if err == sql.ErrNoRows {
+			unauthorized(w)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if user.Role != RoleAdmin || user.Disabled {
+			generateErrorResponse(w, "admin role required", http.StatusForbidden)
+			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-func auth(tokenstr string) *jwt.Token {
-	if tokenstr == "" {
-		return nil
-	}
-
-	token, err := parseToken(tokenstr)
-	if err != nil || !token.Valid {
-		return nil
-	}
-
-	return token
-}
-
-func authWithClaims(header string, claims *jwt.MapClaims) *jwt.Token {
-	if header == "" {
-		return nil
-	}
-
-	tokenString := strings.TrimPrefix(header, "Bearer ")
-	token, err := parseTokenWithClaims(tokenString, claims)
-	if err != nil || !token.Valid {
-		return nil
-	}
-
-	return token
-}
-
 func parseToken(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(hmacSampleSecret), nil
-	})
+	return tokenParser.Parse(tokenString, keyFor)
 }
 
 func parseTokenWithClaims(tokenString string, claims *jwt.MapClaims) (*jwt.Token, error) {
-	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(hmacSampleSecret), nil
-	})
+	return tokenParser.ParseWithClaims(tokenString, claims, keyFor)
 }
 
 func (u User) ComparePassword(u2 User) error {
@@ -217,37 +151,117 @@ func createUsersTable(ctx context.Context, DB *sql.DB) error {
 		return err
 	}
 
+	if err := addColumnIfMissing(ctx, DB, "users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "users", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "users", "email", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// emailVerified is set once the user proved to own the email, see
+	// verifyEmail
+	if err := addColumnIfMissing(ctx, DB, "users", "emailVerified", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// the scheduler settings admins gave the user, NULL for those of the
+	// environment
+	if err := addColumnIfMissing(ctx, DB, "users", "schedulerCap", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "users", "schedulerWeight", "INTEGER"); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func getUserExpressions(ctx context.Context, DB *sql.DB, userID int64) ([]Expression, error) {
-	selectExpressions := `
-	SELECT id, status, result FROM expressions
-	WHERE ownerID = ?;`
+// expressionColumns are scanned by scanExpression.
+const expressionColumns = `id, status, result, ownerID, COALESCE(workspaceID, 0), COALESCE((SELECT login FROM users WHERE users.id = expressions.ownerID), ''),
+	COALESCE(expression, ''), COALESCE(created, 0), COALESCE(finished, 0), COALESCE(label, ''), COALESCE(notes, '')`
+
+func scanExpression(row interface{ Scan(...any) error }) (Expression, error) {
+	var expr Expression
+	err := row.Scan(&expr.ID, &expr.Status, &expr.Result, &expr.OwnerID, &expr.WorkspaceID, &expr.CreatedBy, &expr.Source, &expr.Created, &expr.Finished, &expr.Label, &expr.Notes)
+	return expr, err
+}
+
+// getExpressions returns a page of the expressions of the workspace of the
+// filter, or of those its user sent if it has none, and the cursor of the
+// next page, which is empty on the last one.
+func getExpressions(ctx context.Context, DB *sql.DB, filter ExpressionFilter) ([]Expression, string, error) {
+	selectExpressions := "SELECT " + expressionColumns + " FROM expressions WHERE workspaceID = ?"
+	args := []any{filter.WorkspaceID}
+	if filter.WorkspaceID == 0 {
+		selectExpressions = "SELECT " + expressionColumns + " FROM expressions WHERE ownerID = ?"
+		args = []any{filter.OwnerID}
+	}
+
+	if len(filter.Statuses) > 0 {
+		selectExpressions += " AND status IN (?" + strings.Repeat(", ?", len(filter.Statuses)-1) + ")"
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !filter.From.IsZero() {
+		selectExpressions += " AND created >= ?"
+		args = append(args, filter.From.Unix())
+	}
+	if !filter.To.IsZero() {
+		selectExpressions += " AND created < ?"
+		args = append(args, filter.To.Unix())
+	}
+	if filter.Query != "" {
+		selectExpressions += ` AND expression LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(filter.Query)+"%")
+	}
+	if filter.After != 0 {
+		if filter.Descending {
+			selectExpressions += " AND id < ?"
+		} else {
+			selectExpressions += " AND id > ?"
+		}
+		args = append(args, filter.After)
+	}
+	if filter.Descending {
+		selectExpressions += " ORDER BY id DESC"
+	} else {
+		selectExpressions += " ORDER BY id ASC"
+	}
+	// one extra row tells whether there is a next page
+	selectExpressions += " LIMIT ?;"
+	args = append(args, filter.Limit+1)
 
-	rows, err := DB.QueryContext(ctx, selectExpressions, userID)
+	rows, err := DB.QueryContext(ctx, selectExpressions, args...)
 	if err != nil {
 		log.Printf("Error executing query: %v", err)
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
-	var expressions []Expression
+	expressions := []Expression{}
 	for rows.Next() {
-		var expression Expression
-		if err := rows.Scan(&expression.ID, &expression.Status, &expression.Result); err != nil {
+		expression, err := scanExpression(rows)
+		if err != nil {
 			log.Printf("Error scanning row: %v", err)
-			return nil, err
+			return nil, "", err
 		}
 		expressions = append(expressions, expression)
 	}
 
 	if err := rows.Err(); err != nil {
 		log.Printf("Error iterating over rows: %v", err)
-		return nil, err
+		return nil, "", err
 	}
 
-	return expressions, nil
+	nextCursor := ""
+	if len(expressions) > filter.Limit {
+		expressions = expressions[:filter.Limit]
+		nextCursor = encodeCursor(expressions[len(expressions)-1].ID)
+	}
+
+	return expressions, nextCursor, nil
 }
 
 func createExpressionsTable(ctx context.Context, DB *sql.DB) error {
@@ -257,21 +271,85 @@ func createExpressionsTable(ctx context.Context, DB *sql.DB) error {
 		ownerID TEXT,
 		status TEXT,
 		result TEXT,
-		FOREIGN KEY(ownerID) REFERENCES users(id)
+		batchID INTEGER,
+		batchKey TEXT,
+		expression TEXT,
+		created INTEGER,
+		finished INTEGER,
+		label TEXT,
+		notes TEXT,
+		workspaceID INTEGER,
+		trace TEXT,
+		FOREIGN KEY(ownerID) REFERENCES users(id),
+		FOREIGN KEY(batchID) REFERENCES batches(id),
+		FOREIGN KEY(workspaceID) REFERENCES workspaces(id)
 	);`
 
 	if _, err := DB.ExecContext(ctx, expressionsTable); err != nil {
 		return err
 	}
 
+	// databases created by older versions lack the newer columns
+	if err := addColumnIfMissing(ctx, DB, "expressions", "batchID", "INTEGER REFERENCES batches(id)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "batchKey", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "expression", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "created", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "finished", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "label", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "notes", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "workspaceID", "INTEGER REFERENCES workspaces(id)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, DB, "expressions", "trace", "TEXT"); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func addColumnIfMissing(ctx context.Context, DB *sql.DB, table, column, definition string) error {
+	rows, err := DB.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = DB.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func insertUser(ctx context.Context, DB *sql.DB, user *User) (int64, error) {
 	var q = `
-	INSERT INTO users (login, password) values ($1, $2)
+	INSERT INTO users (login, password, email) values ($1, $2, $3)
 	`
-	result, err := DB.ExecContext(ctx, q, user.Name, user.Password)
+	result, err := DB.ExecContext(ctx, q, user.Name, user.Password, user.Email)
 	if err != nil {
 		return 0, err
 	}
@@ -283,11 +361,21 @@ func insertUser(ctx context.Context, DB *sql.DB, user *User) (int64, error) {
 	return id, nil
 }
 
+// insertExpression stores the expression in its workspace, or in the
+// personal workspace of its owner if it has none.
 func insertExpression(ctx context.Context, DB *sql.DB, expr *Expression) (int64, error) {
+	if expr.WorkspaceID == 0 && expr.OwnerID != 0 {
+		id, err := personalWorkspace(ctx, DB, expr.OwnerID)
+		if err != nil {
+			return 0, err
+		}
+		expr.WorkspaceID = id
+	}
+
 	var q = `
-	INSERT INTO expressions (status, result, ownerID) values ($1, $2, $3)
+	INSERT INTO expressions (status, result, ownerID, workspaceID, expression, created) values ($1, $2, $3, $4, $5, $6)
 	`
-	result, err := DB.ExecContext(ctx, q, &expr.Status, &expr.Result, &expr.OwnerID)
+	result, err := DB.ExecContext(ctx, q, &expr.Status, &expr.Result, &expr.OwnerID, &expr.WorkspaceID, &expr.Source, &expr.Created)
 	if err != nil {
 		return 0, err
 	}
@@ -300,10 +388,19 @@ func insertExpression(ctx context.Context, DB *sql.DB, expr *Expression) (int64,
 }
 
 func modifyExpression(ctx context.Context, DB *sql.DB, expr *Expression) (int64, error) {
+	var trace sql.NullString
+	if len(expr.Trace) > 0 {
+		b, err := json.Marshal(expr.Trace)
+		if err != nil {
+			return 0, err
+		}
+		trace = sql.NullString{String: string(b), Valid: true}
+	}
+
 	var q = `
-	UPDATE expressions SET status = $1, result = $2, ownerID = $3 WHERE id = $f;
+	UPDATE expressions SET status = $1, result = $2, ownerID = $3, finished = NULLIF($4, 0), trace = $5 WHERE id = $6;
 	`
-	result, err := DB.ExecContext(ctx, q, &expr.Status, &expr.Result, &expr.OwnerID, &expr.ID)
+	result, err := DB.ExecContext(ctx, q, &expr.Status, &expr.Result, &expr.OwnerID, &expr.Finished, trace, &expr.ID)
 	if err != nil {
 		return 0, err
 	}
@@ -321,8 +418,8 @@ func selectUser(ctx context.Context, DB *sql.DB, login string) (User, error) {
 		err  error
 	)
 
-	var q = "SELECT id, login, password FROM users WHERE login=$1"
-	err = DB.QueryRowContext(ctx, q, login).Scan(&user.ID, &user.Name, &user.Password)
+	var q = "SELECT id, login, password, role, disabled, email FROM users WHERE login=$1"
+	err = DB.QueryRowContext(ctx, q, login).Scan(&user.ID, &user.Name, &user.Password, &user.Role, &user.Disabled, &user.Email)
 	return user, err
 }
 
@@ -332,20 +429,28 @@ func selectUserByID(ctx context.Context, DB *sql.DB, id int64) (User, error) {
 		err  error
 	)
 
-	var q = "SELECT id, login, password FROM users WHERE id=$1"
-	err = DB.QueryRowContext(ctx, q, id).Scan(&user.ID, &user.Name, &user.Password)
+	var q = "SELECT id, login, password, role, disabled, email FROM users WHERE id=$1"
+	err = DB.QueryRowContext(ctx, q, id).Scan(&user.ID, &user.Name, &user.Password, &user.Role, &user.Disabled, &user.Email)
 	return user, err
 }
 
 func selectExpression(ctx context.Context, DB *sql.DB, id string) (Expression, error) {
-	var (
-		expr Expression
-		err  error
-	)
+	return scanExpression(DB.QueryRowContext(ctx, "SELECT "+expressionColumns+" FROM expressions WHERE id=$1", id))
+}
 
-	var q = "SELECT id, status, result, ownerID FROM expressions WHERE id=$1"
-	err = DB.QueryRowContext(ctx, q, id).Scan(&expr.ID, &expr.Status, &expr.Result, &expr.OwnerID)
-	return expr, err
+// selectTrace returns the operations stored for the expression, which
+// selectExpression leaves out to keep the lists small.
+func selectTrace(ctx context.Context, DB *sql.DB, id string) ([]TraceStep, error) {
+	var trace sql.NullString
+	if err := DB.QueryRowContext(ctx, "SELECT trace FROM expressions WHERE id=$1", id).Scan(&trace); err != nil {
+		return nil, err
+	}
+	if !trace.Valid {
+		return nil, nil
+	}
+	var steps []TraceStep
+	err := json.Unmarshal([]byte(trace.String), &steps)
+	return steps, err
 }
 
 func generate(s string) (string, error) {
@@ -359,20 +464,16 @@ func generate(s string) (string, error) {
 	return hash, nil
 }
 
-func generateToken(id int64) (string, error) {
+// generateToken returns an access token of the session sid.
+func generateToken(id int64, sid string) (string, error) {
 	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	return signToken(jwt.MapClaims{
 		"id":  id,
+		"sid": sid,
 		"nbf": now.Unix(),
-		"exp": now.Add(168 * time.Hour).Unix(),
+		"exp": now.Add(AccessTokenTTL).Unix(),
 		"iat": now.Unix(),
 	})
-
-	tokenString, err := token.SignedString([]byte(hmacSampleSecret))
-	if err != nil {
-		return "", nil
-	}
-	return tokenString, nil
 }
 
 func compare(hash string, s string) error {
@@ -382,9 +483,13 @@ func compare(hash string, s string) error {
 }
 
 func OpenDB() (*sql.DB, error) {
+	return openDB("store.db")
+}
+
+func openDB(path string) (*sql.DB, error) {
 	ctx := context.TODO()
 
-	db, err := sql.Open("sqlite3", "store.db")
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
@@ -398,43 +503,89 @@ func OpenDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err = loadUserScheduling(ctx, db, TaskScheduler); err != nil {
+		return nil, err
+	}
+
+	if err = createBatchesTable(ctx, db); err != nil {
+		return nil, err
+	}
+
 	if err = createExpressionsTable(ctx, db); err != nil {
 		return nil, err
 	}
 
+	if err = createSessionsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createAPIKeysTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createWebhooksTables(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createPasswordResetsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createMFATables(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createOIDCIdentitiesTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createWorkspacesTables(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createSharesTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err = createSettingsTable(ctx, db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
 func TasksHandler(w http.ResponseWriter, r *http.Request) {
-	tr := calc.TaskResult{}
-	err1 := json.NewDecoder(r.Body).Decode(&tr)
-	calc.Tasks.M.Lock()
-	defer calc.Tasks.M.Unlock()
-	if err1 != nil {
-		if len(calc.Tasks.Tasks) == len(calc.TaskResults.TaskResults) {
+	if r.Method == http.MethodGet {
+		task, ok := TaskScheduler.Next()
+		Agents.Seen(r, ok, false)
+		if !ok {
 			fmt.Fprint(w, "{}")
-		} else {
-			task := calc.Tasks.Tasks[len(calc.Tasks.Tasks)-1]
-			js, err := json.Marshal(task)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-			}
-			calc.TaskResults.TaskResults = append(calc.TaskResults.TaskResults, calc.TaskResult{TaskID: task.TaskID, Result: 0, Error: ""})
-			fmt.Fprintf(w, "%v", string(js))
+			return
 		}
+		js, err := json.Marshal(task)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		fmt.Fprintf(w, "%v", string(js))
 		return
 	}
 
-	calc.TaskResults.TaskResults[tr.TaskID].Result = tr.Result
-	calc.TaskResults.TaskResults[tr.TaskID].Error = tr.Error
-	calc.Wg.Done()
-}
-
-func ApiCalcHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
+	tr := task.TaskResult{}
+	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	Agents.Seen(r, false, true)
+	if err := TaskScheduler.Complete(tr); err == ErrTaskCancelled {
+		generateErrorResponse(w, err.Error(), http.StatusGone)
+	} else if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+func ApiCalcHandler(w http.ResponseWriter, r *http.Request) {
 	ClientRequest := new(Request)
 
 	clientIP := r.RemoteAddr
@@ -448,14 +599,14 @@ func ApiCalcHandler(w http.ResponseWriter, r *http.Request) {
 	bodyBytes, err1 := io.ReadAll(r.Body)
 	if err1 != nil {
 		log.Printf("Error reading request body from %s: %s\n", clientIP, err1.Error())
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		generateErrorResponse(w, "error reading request body", http.StatusBadRequest)
 		return
 	}
 
 	err2 := json.Unmarshal(bodyBytes, &ClientRequest)
 	if err2 != nil {
 		log.Printf("Invalid ClientRequest body from %s: %s\n", clientIP, string(bodyBytes))
-		http.Error(w, "Invalid ClientRequest body: "+ClientRequest.Expression, http.StatusBadRequest)
+		generateErrorResponse(w, "Invalid ClientRequest body: "+ClientRequest.Expression, http.StatusBadRequest)
 		return
 	}
 
@@ -463,104 +614,299 @@ func ApiCalcHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx := context.TODO()
 
-	claims := jwt.MapClaims{}
-	token, err := getToken(r, &claims)
-	if err != nil || !token.Valid {
-		http.Redirect(w, r, "/login", http.StatusFound)
+	member, ok := requireWorkspace(w, r, WorkspaceMember)
+	if !ok {
+		return
+	}
+	cfg, err := selectWorkspaceConfig(ctx, DB, member.WorkspaceID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	timeout, err := ClientRequest.Validate(cfg)
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	ownerID := int64(math.Floor(claims["id"].(float64)))
+	wait, err := waitFor(r, ClientRequest, cfg.Timings)
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	expr := Expression{ID: "-1", Status: "201", Result: "pending", OwnerID: ownerID}
+	expr := Expression{ID: "-1", Status: "201", Result: "pending", Source: ClientRequest.Expression, Created: time.Now().Unix(), OwnerID: member.UserID, WorkspaceID: member.WorkspaceID}
 
 	id, err := insertExpression(ctx, DB, &expr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		internalError(w, err)
 		return
 	}
 
 	expr.ID = fmt.Sprint(id)
+	publishExpression(&expr, 0)
+
+	done := startEvaluation(&expr, ClientRequest, timeout)
 
-	jsonid, err3 := json.Marshal(calc.ID{ID: id})
+	if wait > 0 {
+		select {
+		case <-done:
+			json, err := json.Marshal(expr)
+			if err != nil {
+				internalError(w, err)
+				return
+			}
+			fmt.Fprint(w, string(json))
+			return
+		case <-r.Context().Done():
+			return
+		case <-time.After(wait):
+			w.Header().Set("Location", "/api/v1/expressions/"+expr.ID)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+
+	jsonid, err3 := json.Marshal(client.CalculateResponse{ID: id})
 	if err3 != nil {
-		http.Error(w, err3.Error(), http.StatusInternalServerError)
+		internalError(w, err3)
 		return
 	}
 
 	_, errwr := fmt.Fprint(w, string(jsonid))
 	if errwr != nil {
-		http.Error(w, errwr.Error(), http.StatusInternalServerError)
+		internalError(w, errwr)
 	}
+}
 
-	go func(DB *sql.DB) {
-		ctx := context.TODO()
+// waitFor tells how long the client is willing to wait for the result, either
+// with ?wait=5s or with "sync": true, which waits as long as t allows.
+func waitFor(r *http.Request, cr *Request, t *Timings) (time.Duration, error) {
+	wait := time.Duration(0)
+	maxWait := t.MaxWait
+	if cr.Sync {
+		wait = maxWait
+	}
 
-		res, errCalc := calc.Calc(ClientRequest.Expression)
-		if errCalc != nil {
-			if errCalc == calc.Err422 {
-				expr.Status = "422"
-			} else {
-				expr.Status = "500"
-			}
-			expr.Result = errCalc.Error()
-		} else {
-			expr.Status = "200"
-			expr.Result = fmt.Sprintf("%f", res)
+	if val := r.URL.Query().Get("wait"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid wait %q, expected a duration like 5s", val)
 		}
-		_, err := modifyExpression(ctx, DB, &expr)
-		if err != nil {
-			log.Println(err.Error())
+		wait = min(d, maxWait)
+	}
+
+	return wait, nil
+}
+
+// Validate checks the optional fields of the request against the settings of
+// its workspace, fills in the precision if it is missing and returns the
+// timeout the expression has to be evaluated within.
+func (cr *Request) Validate(cfg workspaceConfig) (time.Duration, error) {
+	if cr.Priority < MinPriority || cr.Priority > MaxPriority {
+		return 0, ErrInvalidPriority
+	}
+
+	if cr.Precision == nil {
+		cr.Precision = &cfg.Precision
+	} else if *cr.Precision < -1 || *cr.Precision > MaxPrecision {
+		return 0, ErrInvalidPrecision
+	}
+
+	t := cfg.Timings
+	if cr.TimeoutMS < 0 || time.Duration(cr.TimeoutMS)*time.Millisecond > t.MaxTimeout {
+		return 0, fmt.Errorf("timeout_ms must be between 1 and %d", t.MaxTimeout.Milliseconds())
+	}
+
+	if cr.CallbackURL != "" {
+		if err := validateWebhookURL(cr.CallbackURL); err != nil {
+			return 0, err
 		}
-	}(DB)
+	}
+
+	if cr.TimeoutMS > 0 {
+		return time.Duration(cr.TimeoutMS) * time.Millisecond, nil
+	}
+
+	return t.DefaultTimeout, nil
 }
 
-func ApiExpressionsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		return
+// agentError turns the errors of the agents, which arrive as text, back into
+// the errors of pkg/calc.
+func agentError(err error) error {
+	if msg := err.Error(); strings.HasPrefix(msg, calc.Err422.Error()) {
+		return fmt.Errorf("%w%s", calc.Err422, strings.TrimPrefix(msg, calc.Err422.Error()))
 	}
+	return err
+}
 
+// evaluateExpression computes the expression with the help of the agents and
+// stores the outcome.
+func evaluateExpression(calcCtx context.Context, expr *Expression, cr *Request) {
 	ctx := context.TODO()
 
-	claims := jwt.MapClaims{}
-	token, err := getToken(r, &claims)
-	if err != nil || !token.Valid {
-		http.Redirect(w, r, "/login", http.StatusFound)
+	// the expression may have been cancelled while it was waiting for its turn
+	var res float64
+	var trace []TraceStep
+	tasksDone := 0
+	errCalc := calcCtx.Err()
+	if errCalc == nil {
+		operationTimes := CurrentTimings().Operations
+		res, errCalc = calc.Evaluate(cr.Expression, calc.WithSolver(func(op rune, arg1, arg2 float64) (float64, error) {
+			value, err := TaskScheduler.Solve(calcCtx, expr.OwnerID, cr.Priority, op, arg1, arg2, operationTimes[op])
+			if err != nil {
+				return 0, agentError(err)
+			}
+			tasksDone++
+			trace = append(trace, TraceStep{Operation: string(op), Arg1: arg1, Arg2: arg2, Result: value})
+			Events.Publish(expr.WorkspaceID, ExpressionEvent{Type: EventProgress, ID: expr.ID, Status: expr.Status, Result: expr.Result, Source: expr.Source, TasksDone: tasksDone})
+			return value, nil
+		}))
+	}
+	if errCalc != nil {
+		if errors.Is(errCalc, calc.Err422) {
+			expr.Status = "422"
+			expr.Result = calc.Err422.Error()
+		} else if errors.Is(errCalc, context.Canceled) {
+			expr.Status = "cancelled"
+			expr.Result = ErrCancelled.Error()
+		} else if errors.Is(errCalc, context.DeadlineExceeded) {
+			expr.Status = "timeout"
+			expr.Result = ErrExpressionTimeout.Error()
+		} else if errCalc.Error() == task.ErrTimeout.Error() {
+			// an agent didn't manage to compute an operation in time
+			expr.Status = "timeout"
+			expr.Result = errCalc.Error()
+		} else if errors.Is(errCalc, calc.Err500) {
+			expr.Status = "500"
+			expr.Result = calc.Err500.Error()
+		} else {
+			expr.Status = "500"
+			expr.Result = errCalc.Error()
+		}
+	} else {
+		expr.Status = "200"
+		expr.Result = formatResult(res, cr.Precision)
+	}
+	expr.Finished = time.Now().Unix()
+	expr.Trace = trace
+	_, err := modifyExpression(ctx, DB, expr)
+	if err != nil {
+		log.Println(err.Error())
 	}
+	publishExpression(expr, tasksDone)
+	notifyWebhooks(*expr, cr.CallbackURL)
+}
+
+func ApiExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
 
-	uid := int64(math.Floor(claims["id"].(float64)))
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	idstr := r.URL.Query().Get("id")
 	if idstr != "" {
 		expr, err := selectExpression(ctx, DB, idstr)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if err == sql.ErrNoRows {
+			generateErrorResponse(w, "expression not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			internalError(w, err)
+			return
 		}
 
-		if expr.OwnerID == uid {
+		if _, ok := requireRole(ctx, w, expr.WorkspaceID, uid, WorkspaceViewer, "expression not found"); ok {
 			json, err2 := json.Marshal(expr)
 			if err2 != nil {
-				http.Error(w, err2.Error(), 500)
+				internalError(w, err2)
 				return
 			}
 			fmt.Fprintf(w, "%v", string(json))
-		} else {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		}
 	} else {
-		actualexprs, err := getUserExpressions(ctx, DB, uid)
+		member, ok := requireWorkspace(w, r, WorkspaceViewer)
+		if !ok {
+			return
+		}
+		filter, err := parseExpressionFilter(r.URL.Query())
+		if err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.WorkspaceID = member.WorkspaceID
+		actualexprs, nextCursor, err := getExpressions(ctx, DB, filter)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			internalError(w, err)
+			return
 		}
-		exprs := Expressions{Expressions: actualexprs}
+		exprs := Expressions{Expressions: actualexprs, NextCursor: nextCursor}
 		json, err := json.Marshal(exprs)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			internalError(w, err)
 		} else {
 			fmt.Fprintf(w, "%v", string(json))
 		}
 	}
 }
 
+func ApiCancelExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	expr, ok := workspaceExpression(ctx, w, r, uid, WorkspaceMember)
+	if !ok {
+		return
+	}
+
+	if expr.Status != "201" {
+		generateErrorResponse(w, "expression is not pending", http.StatusConflict)
+		return
+	}
+
+	if !Running.Cancel(expr.ID) {
+		// nobody is evaluating it anymore, e.g. the server was restarted, or
+		// its evaluation has just finished
+		cancelled, err := cancelPendingExpression(ctx, DB, &expr)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !cancelled {
+			generateErrorResponse(w, "expression is not pending", http.StatusConflict)
+			return
+		}
+		publishExpression(&expr, 0)
+	}
+
+	expr, err := selectExpression(ctx, DB, expr.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(expr)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%v", string(json))
+}
+
+func ApiQueueHandler(w http.ResponseWriter, r *http.Request) {
+	json, err := json.Marshal(QueueStatsResponse{Users: TaskScheduler.Stats()})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%v", string(json))
+}
+
 func CalcPageHandler(w http.ResponseWriter, r *http.Request) {
 	// Render the calculate.html template
 	tmpl, err := template.ParseFiles("../../html_templates/html/calculate.html")
@@ -576,10 +922,6 @@ func CalcPageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ExpressionsPageHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	tmpl, err := template.ParseFiles("../../html_templates/html/expressions.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -605,10 +947,21 @@ func ExpressionPageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func EverythingPageHandler(w http.ResponseWriter, r *http.Request) {
-	enableCORS(&w)
+func SettingsPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("../../html_templates/html/settings.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	tmpl, err := template.ParseFiles("../html_templates/html/index.html")
+	err = tmpl.Execute(w, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func ResetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("../../html_templates/html/reset-password.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -620,34 +973,45 @@ func EverythingPageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ApiRegistrationHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
+func EverythingPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("../html_templates/html/index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	err = tmpl.Execute(w, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func ApiRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 	ClientRequest := new(RegistrationRequest)
 
 	defer r.Body.Close()
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		generateErrorResponse(w, "error reading request body", http.StatusBadRequest)
 		return
 	}
 
 	err = json.Unmarshal(bodyBytes, &ClientRequest)
 	if err != nil {
-		http.Error(w, "Invalid ClientRequest", http.StatusBadRequest)
+		generateErrorResponse(w, "Invalid ClientRequest", http.StatusBadRequest)
 		return
 	}
 
-	if len(ClientRequest.Name) < 3 && len(ClientRequest.Password) < 3 {
-		generateErrorResponse(w, "Username and password must be at least 3 letters long", 401)
+	if len(ClientRequest.Login) < 3 {
+		generateErrorResponse(w, "Username must be at least 3 letters long", http.StatusBadRequest)
 		return
-	} else if len(ClientRequest.Name) < 3 {
-		generateErrorResponse(w, "Username must be at least 3 letters long", 401)
+	}
+	if !checkPassword(w, ClientRequest.Login, ClientRequest.Password) {
 		return
-	} else if len(ClientRequest.Password) < 3 {
-		generateErrorResponse(w, "Password must be at least 3 letters long", 401)
+	}
+	email, err := checkEmail(ClientRequest.Email)
+	if err != nil {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -655,32 +1019,33 @@ func ApiRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 
 	hash, err := generate(ClientRequest.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		internalError(w, err)
 		return
 	}
 
-	user := User{-1, ClientRequest.Name, hash, ClientRequest.Password}
+	user := User{ID: -1, Name: ClientRequest.Login, Password: hash, OriginPassword: ClientRequest.Password, Email: email}
 
 	uid, err := insertUser(ctx, DB, &user)
 	if err != nil {
 		if err.Error() == ErrUniqueConstraintFailed.Error() {
-			generateErrorResponse(w, "Username had already been taken", 401)
+			generateErrorResponse(w, "Username had already been taken", http.StatusConflict)
 			return
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			internalError(w, err)
 			return
 		}
 	}
 
-	token, err := generateToken(uid)
+	tokens, err := startSession(ctx, r, uid)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		internalError(w, err)
 		return
 	}
+	setSessionCookies(w, r, tokens)
 
-	json, err := json.Marshal(RegistrationResponse{Status: "200 OK", Token: token})
+	json, err := json.Marshal(tokens)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		internalError(w, err)
 		return
 	}
 
@@ -688,8 +1053,8 @@ func ApiRegistrationHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func RegistrationPageHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := getToken(r, &jwt.MapClaims{})
-	if err == ErrNoToken || err == ErrInvalidToken {
+	_, err := authenticateRequest(r)
+	if err != nil {
 		tmpl, err := template.ParseFiles("../../html_templates/html/register.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -709,15 +1074,20 @@ func RegistrationPageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func LoginPageHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := getToken(r, &jwt.MapClaims{})
-	if err == ErrNoToken || err == ErrInvalidToken {
+	_, err := authenticateRequest(r)
+	if err != nil {
 		tmpl, err := template.ParseFiles("../../html_templates/html/login.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		err = tmpl.Execute(w, nil)
+		// the page offers the OIDC provider if there is one
+		var data struct{ OIDC string }
+		if OIDC != nil {
+			data.OIDC = OIDC.Name
+		}
+		err = tmpl.Execute(w, data)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -731,74 +1101,85 @@ func LoginPageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func ApiLoginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	ClientRequest := new(RegistrationRequest)
 
 	defer r.Body.Close()
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		generateErrorResponse(w, "error reading request body", http.StatusBadRequest)
 		return
 	}
 
 	err = json.Unmarshal(bodyBytes, &ClientRequest)
 	if err != nil {
-		http.Error(w, "Invalid ClientRequest", http.StatusBadRequest)
+		generateErrorResponse(w, "Invalid ClientRequest", http.StatusBadRequest)
 		return
 	}
 
-	user := User{-1, ClientRequest.Name, "", ClientRequest.Password}
-
 	ctx := context.TODO()
 
-	userFromDB, err := selectUser(ctx, DB, ClientRequest.Name)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			generateErrorResponse(w, "This username doesnt exist", 401)
-			return
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if lockedOut(w, r, ClientRequest.Login) {
+		return
 	}
 
-	user.ID = userFromDB.ID
+	// unknown logins and wrong passwords get the same answer, so that it
+	// doesn't tell which logins exist
+	user, err := authenticate(ctx, r, ClientRequest.Login, ClientRequest.Password)
+	if err == ErrInvalidCredentials {
+		generateErrorResponse(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if user.Disabled {
+		generateErrorResponse(w, ErrUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
 
-	if err := user.ComparePassword(userFromDB); err == nil {
-		token, err := generateToken(user.ID)
+	// with two-factor authentication the password only gets a challenge,
+	// which ApiLoginMFAHandler exchanges for the tokens along with a code
+	mfa, err := mfaEnabled(ctx, DB, user.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	var tokens RegistrationResponse
+	if mfa {
+		token, err := challenges.New(user.ID, user.Name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			internalError(w, err)
 			return
 		}
-		json, err := json.Marshal(RegistrationResponse{Status: "200 OK", Token: token})
+		tokens = RegistrationResponse{Status: client.StatusMFARequired, MFAToken: token, ExpiresIn: int64(mfaChallengeTTL.Seconds())}
+	} else {
+		accountLockout.Reset(user.Name)
+		tokens, err = startSession(ctx, r, user.ID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			internalError(w, err)
 			return
 		}
-		fmt.Fprint(w, string(json)+"")
+		setSessionCookies(w, r, tokens)
+	}
 
-	} else if err == bcrypt.ErrMismatchedHashAndPassword {
-		generateErrorResponse(w, "Invalid password", 401)
-	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	json, err := json.Marshal(tokens)
+	if err != nil {
+		internalError(w, err)
+		return
 	}
+	fmt.Fprint(w, string(json)+"")
 }
 
-// func headerMiddleware(next http.Handler) http.Handler {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-// 		w.Header().Add("Content-Type", "application/json")
-// 		next.ServeHTTP(w, req)
-// 	})
-// }
-
 func panicRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				if strings.HasPrefix(req.URL.Path, "/api/") {
+					internalError(w, fmt.Errorf("panic: %v", err))
+				} else {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
 				log.Println(string(debug.Stack()))
 			}
 		}()
@@ -806,21 +1187,6 @@ func panicRecovery(next http.Handler) http.Handler {
 	})
 }
 
-func CORSMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			return
-		} else {
-			next.ServeHTTP(w, r)
-		}
-	})
-}
-
 func withMiddlewareFunc(handler http.HandlerFunc, middlewares ...func(http.Handler) http.Handler) http.HandlerFunc {
 	h := http.Handler(handler)
 	for _, middleware := range middlewares {
@@ -829,66 +1195,11 @@ func withMiddlewareFunc(handler http.HandlerFunc, middlewares ...func(http.Handl
 	return h.ServeHTTP
 }
 
-func pathHandler(w http.ResponseWriter, r *http.Request) {
-	middlewares := []func(http.Handler) http.Handler{panicRecovery /*headerMiddleware,*/, CORSMiddleware, authMiddleware}
-	switch r.URL.Path {
-	case "/api/v1/register":
-		withMiddlewareFunc(ApiRegistrationHandler, middlewares[:2]...)(w, r)
-	case "/api/v1/login":
-		withMiddlewareFunc(ApiLoginHandler, middlewares[:2]...)(w, r)
-	case "/internal/task":
-		withMiddlewareFunc(TasksHandler, middlewares[:1]...)(w, r)
-	case "/api/v1/calculate":
-		withMiddlewareFunc(ApiCalcHandler, middlewares...)(w, r)
-	case "/api/v1/expressions":
-		withMiddlewareFunc(ApiExpressionsHandler, middlewares...)(w, r)
-	case "/register":
-		withMiddlewareFunc(RegistrationPageHandler, middlewares[:2]...)(w, r)
-	case "/login":
-		withMiddlewareFunc(LoginPageHandler, middlewares[:2]...)(w, r)
-	case "/calculate":
-		withMiddlewareFunc(CalcPageHandler, middlewares...)(w, r)
-	case "/expressions":
-		withMiddlewareFunc(ExpressionsPageHandler, middlewares...)(w, r)
-	case "/expression":
-		withMiddlewareFunc(ExpressionPageHandler, middlewares...)(w, r)
-	case "/everything":
-		withMiddlewareFunc(EverythingPageHandler, middlewares...)(w, r)
-	default:
-		r.Header.Add("Content-Type", "")
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-	}
-}
-
 func (a *Application) RunServer() error {
-	//middlewares := []func(http.Handler) http.Handler{panicRecovery /*headerMiddleware,*/, CORSMiddleware, authMiddleware}
-	mux := http.NewServeMux()
-
-	// mux.HandleFunc("/api/v1/register", withMiddlewareFunc(ApiRegistrationHandler, middlewares[:2]...))
-	// mux.HandleFunc("/api/v1/login", withMiddlewareFunc(ApiLoginHandler, middlewares[:2]...))
-
-	// mux.HandleFunc("/internal/task", withMiddlewareFunc(TasksHandler, middlewares[:1]...))
-
-	// mux.HandleFunc("/api/v1/calculate", withMiddlewareFunc(ApiCalcHandler, middlewares...))
-	// mux.HandleFunc("/api/v1/expressions", withMiddlewareFunc(ApiExpressionsHandler, middlewares...))
-
-	// mux.HandleFunc("/register", withMiddlewareFunc(RegistrationPageHandler, middlewares[:2]...))
-	// mux.HandleFunc("/login", withMiddlewareFunc(LoginPageHandler, middlewares[:2]...))
-
-	// mux.HandleFunc("/calculate", withMiddlewareFunc(CalcPageHandler, middlewares...))
-	// mux.HandleFunc("/expressions", withMiddlewareFunc(ExpressionsPageHandler, middlewares...))
-	// mux.HandleFunc("/expression", withMiddlewareFunc(ExpressionPageHandler, middlewares...))
-
-	// mux.HandleFunc("/everything", withMiddlewareFunc(EverythingPageHandler, middlewares...))
-
-	mux.HandleFunc("/", pathHandler)
-
-	mux.Handle("/css/", http.StripPrefix("/css", http.FileServer(http.Dir("../../html_templates/css"))))
-	mux.Handle("/js/", http.StripPrefix("/js", http.FileServer(http.Dir("../../html_templates/js"))))
-	mux.Handle("/icons/", http.StripPrefix("/icons", http.FileServer(http.Dir("../../html_templates/icons"))))
+	go reloadKeysOnHangup()
 
-	log.Println("Starting server on", calc.Port)
-	err := http.ListenAndServe(calc.Port, mux)
+	log.Println("Starting server on", task.Port)
+	err := http.ListenAndServe(task.Port, NewRouter())
 
 	return err
 }
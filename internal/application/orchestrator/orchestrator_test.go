@@ -0,0 +1,75 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCancelExpression(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, err := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := personalWorkspace(ctx, DB, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewRouter()
+	cancel := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(http.MethodPost, "/api/v1/expressions/"+id+"/cancel", nil), s.Token))
+		return w
+	}
+
+	// nobody evaluates an expression left pending by a restart
+	id, err := insertExpression(ctx, DB, &Expression{Status: "201", Result: "pending", Source: "1+1", OwnerID: uid, WorkspaceID: ws, Created: time.Now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := Events.Subscribe(ws)
+	defer unsubscribe()
+
+	w := cancel(fmt.Sprint(id))
+	var expr Expression
+	if err := json.Unmarshal(w.Body.Bytes(), &expr); err != nil || w.Code != http.StatusOK || expr.Status != "cancelled" || expr.Result != ErrCancelled.Error() || expr.Finished == 0 {
+		t.Fatalf("expected the expression to be cancelled, got %d %s", w.Code, w.Body)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != EventStatus || ev.ID != expr.ID || ev.Status != "cancelled" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	default:
+		t.Fatal("expected the cancellation to be published")
+	}
+
+	if w := cancel(expr.ID); w.Code != http.StatusConflict {
+		t.Fatalf("expected a finished expression not to be cancelled again, got %d", w.Code)
+	}
+
+	// a result stored since the expression was loaded stays
+	finished := Expression{ID: expr.ID, Status: "200", Result: "2.000000", OwnerID: uid, Finished: time.Now().Unix()}
+	if _, err := modifyExpression(ctx, DB, &finished); err != nil {
+		t.Fatal(err)
+	}
+	stale := Expression{ID: expr.ID, Status: "201"}
+	if cancelled, err := cancelPendingExpression(ctx, DB, &stale); err != nil || cancelled {
+		t.Fatalf("expected the finished expression not to be cancelled, got %v, %v", cancelled, err)
+	}
+	if stored, err := selectExpression(ctx, DB, expr.ID); err != nil || stored.Status != "200" || stored.Result != "2.000000" {
+		t.Fatalf("expected the result to stay, got %+v, %v", stored, err)
+	}
+}
@@ -0,0 +1,392 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores everything after 72 bytes
+const maxPasswordBytes = 72
+
+// a user gets at most one reset link per minute
+const passwordResetInterval = time.Minute
+
+type PasswordChangeRequest = client.PasswordChangeRequest
+
+type PasswordResetRequest = client.PasswordResetRequest
+
+type PasswordResetConfirmRequest = client.PasswordResetConfirmRequest
+
+var (
+	ErrInvalidCredentials = errors.New("invalid login or password")
+	ErrWeakPassword       = errors.New("the password doesn't meet the password policy")
+	ErrWrongPassword      = errors.New("the current password is wrong")
+	ErrInvalidResetToken  = errors.New("the reset token is invalid or expired")
+)
+
+// PasswordPolicy is what registration, password changes and resets require
+// of a new password.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+var Passwords = PasswordPolicy{
+	MinLength:     envInt("PASSWORD_MIN_LENGTH", 8),
+	RequireUpper:  envBool("PASSWORD_REQUIRE_UPPER", false),
+	RequireDigit:  envBool("PASSWORD_REQUIRE_DIGIT", true),
+	RequireSymbol: envBool("PASSWORD_REQUIRE_SYMBOL", false),
+}
+
+var PasswordResetTTL = envMilliseconds("PASSWORD_RESET_TTL_MS", 3600000)
+
+// Check returns what password lacks, nothing if it meets the policy.
+func (p PasswordPolicy) Check(login, password string) []string {
+	var problems []string
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", maxPasswordBytes))
+	}
+	if p.RequireUpper && strings.IndexFunc(password, unicode.IsUpper) < 0 {
+		problems = append(problems, "must contain an uppercase letter")
+	}
+	if p.RequireDigit && strings.IndexFunc(password, unicode.IsDigit) < 0 {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.RequireSymbol && strings.IndexFunc(password, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) < 0 {
+		problems = append(problems, "must contain a symbol")
+	}
+	if login != "" && strings.EqualFold(password, login) {
+		problems = append(problems, "must differ from the login")
+	}
+	return problems
+}
+
+// checkPassword answers 400 with the problems of the password as details if
+// it doesn't meet the policy.
+func checkPassword(w http.ResponseWriter, login, password string) bool {
+	if problems := Passwords.Check(login, password); len(problems) > 0 {
+		generateErrorDetails(w, ErrWeakPassword.Error(), http.StatusBadRequest, problems)
+		return false
+	}
+	return true
+}
+
+// checkEmail returns the address of email, which may be empty.
+func checkEmail(email string) (string, error) {
+	if email == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" {
+		return "", errors.New("invalid email address")
+	}
+	return addr.Address, nil
+}
+
+// dummyHash is compared with the passwords of unknown logins, so that they
+// take as long as those of existing ones.
+var dummyHash = sync.OnceValue(func() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	hash, _ := generate(base64.RawURLEncoding.EncodeToString(b))
+	return hash
+})
+
+// authenticate returns the user if the password is right. Unknown logins and
+// wrong passwords both count as failed logins and get ErrInvalidCredentials.
+// The failures are only reset by a complete login, which may still need a
+// second factor.
+func authenticate(ctx context.Context, r *http.Request, login, password string) (User, error) {
+	user, err := selectUser(ctx, DB, login)
+	if err == sql.ErrNoRows {
+		compare(dummyHash(), password)
+		loginFailed(r, login)
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	err = compare(user.Password, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		loginFailed(r, login)
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func updatePassword(ctx context.Context, DB *sql.DB, userID int64, password string) error {
+	hash, err := generate(password)
+	if err != nil {
+		return err
+	}
+	_, err = DB.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2", hash, userID)
+	return err
+}
+
+func createPasswordResetsTable(ctx context.Context, DB *sql.DB) error {
+	const passwordResetsTable = `
+	CREATE TABLE IF NOT EXISTS password_resets(
+		hash TEXT PRIMARY KEY,
+		ownerID INTEGER,
+		created INTEGER,
+		expires INTEGER,
+		used INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	_, err := DB.ExecContext(ctx, passwordResetsTable)
+	return err
+}
+
+// insertPasswordReset returns a new reset token of the user, or "" if the
+// user got one less than passwordResetInterval ago.
+func insertPasswordReset(ctx context.Context, DB *sql.DB, userID int64) (string, error) {
+	now := time.Now()
+
+	var recent int
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM password_resets WHERE ownerID = $1 AND created > $2", userID, now.Add(-passwordResetInterval).Unix()).Scan(&recent)
+	if err != nil || recent > 0 {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err = DB.ExecContext(ctx, `
+	INSERT INTO password_resets (hash, ownerID, created, expires) values ($1, $2, $3, $4)
+	`, hashSecret(token), userID, now.Unix(), now.Add(PasswordResetTTL).Unix())
+	return token, err
+}
+
+// selectPasswordReset returns the user of the reset token.
+func selectPasswordReset(ctx context.Context, DB *sql.DB, token string) (int64, error) {
+	var userID int64
+	err := DB.QueryRowContext(ctx, `
+	SELECT ownerID FROM password_resets WHERE hash = $1 AND used = 0 AND expires > $2
+	`, hashSecret(token), time.Now().Unix()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, err
+}
+
+// usePasswordResets makes every reset token of the user unusable.
+func usePasswordResets(ctx context.Context, DB *sql.DB, userID int64) error {
+	_, err := DB.ExecContext(ctx, "UPDATE password_resets SET used = 1 WHERE ownerID = $1", userID)
+	return err
+}
+
+// verifyEmail records that the user owns the email, which the registration
+// doesn't check. A used reset link or a verified email of the OIDC provider
+// proves it.
+func verifyEmail(ctx context.Context, DB *sql.DB, userID int64) error {
+	_, err := DB.ExecContext(ctx, "UPDATE users SET emailVerified = 1 WHERE id = $1 AND email != ''", userID)
+	return err
+}
+
+// publicURL is where the users reach the orchestrator, PUBLIC_URL without
+// the trailing slash, or "" if it isn't set. The links which are emailed
+// need it: the Host header is chosen by the client, so a link built from it
+// could point anywhere.
+func publicURL() string {
+	return strings.TrimRight(os.Getenv("PUBLIC_URL"), "/")
+}
+
+func ApiChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var req PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := selectUserByID(ctx, DB, uid)
+	if err == sql.ErrNoRows {
+		unauthorized(w)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if lockedOut(w, r, user.Name) {
+		return
+	}
+	if _, err := authenticate(ctx, r, user.Name, req.CurrentPassword); err == ErrInvalidCredentials {
+		generateErrorResponse(w, ErrWrongPassword.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+	accountLockout.Reset(user.Name)
+
+	if req.NewPassword == req.CurrentPassword {
+		generateErrorDetails(w, ErrWeakPassword.Error(), http.StatusBadRequest, []string{"must differ from the current password"})
+		return
+	}
+	if !checkPassword(w, user.Name, req.NewPassword) {
+		return
+	}
+
+	if err := updatePassword(ctx, DB, uid, req.NewPassword); err != nil {
+		internalError(w, err)
+		return
+	}
+
+	// whoever else knew the old password is logged out
+	sessions, err := getActiveSessions(ctx, DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	var others []string
+	for _, s := range sessions {
+		if s.ID != sessionID(r) {
+			others = append(others, s.ID)
+		}
+	}
+	if len(others) > 0 {
+		if err := revokeSessions(ctx, DB, uid, others...); err != nil && err != sql.ErrNoRows {
+			internalError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ApiPasswordResetHandler sends a reset link to the email of the user. The
+// answer is the same whether or not the user exists or has an email, and
+// the email is sent in the background so that it doesn't take longer
+// either.
+func ApiPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Login == "" {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := selectUser(ctx, DB, req.Login)
+	if err != nil && err != sql.ErrNoRows {
+		internalError(w, err)
+		return
+	}
+
+	// the answer doesn't tell that PUBLIC_URL is missing either
+	if err == nil && user.Email != "" && !user.Disabled && publicURL() == "" {
+		log.Printf("Not sending the password reset email of user %d, PUBLIC_URL isn't set\n", user.ID)
+	} else if err == nil && user.Email != "" && !user.Disabled {
+		token, err := insertPasswordReset(ctx, DB, user.ID)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+
+		if token != "" {
+			email := Email{
+				To:      user.Email,
+				Subject: "Reset your calculator password",
+				Body: fmt.Sprintf("Someone asked to reset the password of %s. Open this link within %v to choose a new one:\n\n%s/reset-password?token=%s\n\nIf it wasn't you, ignore this email.",
+					user.Name, PasswordResetTTL, publicURL(), url.QueryEscape(token)),
+			}
+			go func() {
+				if err := Mail.Send(context.Background(), email); err != nil {
+					log.Printf("Sending the password reset email of user %d failed: %v\n", user.ID, err)
+				}
+			}()
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func ApiPasswordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req PasswordResetConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	// the token isn't used up by a password the policy refuses
+	userID, err := selectPasswordReset(ctx, DB, req.Token)
+	if err == ErrInvalidResetToken {
+		generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	user, err := selectUserByID(ctx, DB, userID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !checkPassword(w, user.Name, req.NewPassword) {
+		return
+	}
+
+	if err := usePasswordResets(ctx, DB, user.ID); err != nil {
+		internalError(w, err)
+		return
+	}
+	// the link was sent to the email, so the user owns it
+	if err := verifyEmail(ctx, DB, user.ID); err != nil {
+		internalError(w, err)
+		return
+	}
+	if err := updatePassword(ctx, DB, user.ID, req.NewPassword); err != nil {
+		internalError(w, err)
+		return
+	}
+	if err := revokeSessions(ctx, DB, user.ID); err != nil && err != sql.ErrNoRows {
+		internalError(w, err)
+		return
+	}
+	accountLockout.Reset(user.Name)
+
+	log.Printf("Request %s reset the password of user %d\n", w.Header().Get(RequestIDHeader), user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,257 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, RequireUpper: true, RequireDigit: true, RequireSymbol: true}
+
+	tests := []struct {
+		login, password string
+		problems        int
+	}{
+		{"alice", "Secret-42", 0},
+		{"alice", "Sec-42", 1},
+		{"alice", "secret-42", 1},
+		{"alice", "Secret42", 1},
+		{"alice", "secret", 4},
+		{"alice-1-X", "Alice-1-x", 1},
+		{"alice", "Секрет-42", 0},
+		{"alice", "A-1" + strings.Repeat("x", maxPasswordBytes), 1},
+	}
+	for _, test := range tests {
+		if problems := policy.Check(test.login, test.password); len(problems) != test.problems {
+			t.Errorf("%q: expected %d problems, got %q", test.password, test.problems, problems)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := &lockout{MaxFailures: 3, Base: time.Minute, Max: 3 * time.Minute, m: make(map[string]*loginFailures)}
+
+	for i := 0; i < 2; i++ {
+		l.Fail("alice")
+	}
+	if d := l.Retry("alice"); d != 0 {
+		t.Fatalf("expected no lockout below the limit, got %v", d)
+	}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for _, want := range expected {
+		l.Fail("alice")
+		if d := l.Retry("alice"); d <= want-time.Second || d > want {
+			t.Fatalf("expected a lockout of %v, got %v", want, d)
+		}
+	}
+	if d := l.Retry("bob"); d != 0 {
+		t.Fatalf("expected other keys not to be locked out, got %v", d)
+	}
+
+	l.Reset("alice")
+	if d := l.Retry("alice"); d != 0 {
+		t.Fatalf("expected the reset to lift the lockout, got %v", d)
+	}
+}
+
+type recordingMailer struct {
+	mu     sync.Mutex
+	emails []Email
+	sent   chan struct{}
+}
+
+func (m *recordingMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	m.emails = append(m.emails, email)
+	m.mu.Unlock()
+	m.sent <- struct{}{}
+	return nil
+}
+
+func useTestLockouts(t *testing.T) {
+	previousAccounts, previousIPs := accountLockout, ipLockout
+	accountLockout = &lockout{MaxFailures: 3, Base: time.Minute, Max: time.Hour, m: make(map[string]*loginFailures)}
+	ipLockout = &lockout{MaxFailures: 100, Base: time.Minute, Max: time.Hour, m: make(map[string]*loginFailures)}
+	t.Cleanup(func() { accountLockout, ipLockout = previousAccounts, previousIPs })
+}
+
+func TestLogin(t *testing.T) {
+	useTestDB(t)
+	useTestLockouts(t)
+	ctx := context.Background()
+
+	hash, _ := generate("secret-42")
+	insertUser(ctx, DB, &User{Name: "alice", Password: hash})
+
+	handler := NewRouter()
+	login := func(user, password string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(RegistrationRequest{Login: user, Password: password})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(string(b))))
+		return w
+	}
+
+	unknown, wrong := login("bob", "secret-42"), login("alice", "secret-43")
+	if unknown.Code != http.StatusUnauthorized || wrong.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d and %d", unknown.Code, wrong.Code)
+	}
+	var unknownErr, wrongErr ErrorResponse
+	json.Unmarshal(unknown.Body.Bytes(), &unknownErr)
+	json.Unmarshal(wrong.Body.Bytes(), &wrongErr)
+	if unknownErr.Message != wrongErr.Message {
+		t.Fatalf("expected the same message, got %q and %q", unknownErr.Message, wrongErr.Message)
+	}
+
+	if w := login("alice", "secret-42"); w.Code != http.StatusOK {
+		t.Fatalf("expected the login to succeed, got %d %s", w.Code, w.Body)
+	}
+
+	// the success reset the count
+	for i := 0; i < 3; i++ {
+		login("alice", "wrong")
+	}
+	w := login("alice", "secret-42")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected the account to be locked out, got %d", w.Code)
+	}
+
+	if w := login("alice-2", "secret-42-x"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected other accounts not to be locked out, got %d", w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	useTestDB(t)
+	useTestLockouts(t)
+	ctx := context.Background()
+
+	mailer := &recordingMailer{sent: make(chan struct{}, 1)}
+	previousMail := Mail
+	Mail = mailer
+	t.Cleanup(func() { Mail = previousMail })
+
+	hash, _ := generate("secret-42")
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: hash, Email: "alice@example.com"})
+	if _, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid); err != nil {
+		t.Fatal(err)
+	}
+	// a reset lifts the lockout of the account
+	for i := 0; i < 3; i++ {
+		accountLockout.Fail("alice")
+	}
+
+	handler := NewRouter()
+	request := func(path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Host = "evil.example"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// without PUBLIC_URL there is nothing to build the link from
+	t.Setenv("PUBLIC_URL", "")
+	if w := request("/api/v1/password/reset", `{"login": "alice"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", w.Code)
+	}
+	if len(mailer.emails) != 0 {
+		t.Fatalf("expected no email without PUBLIC_URL, got %+v", mailer.emails)
+	}
+
+	t.Setenv("PUBLIC_URL", "https://calc.example/")
+	for _, login := range []string{"alice", "bob", "alice"} {
+		if w := request("/api/v1/password/reset", `{"login": "`+login+`"}`); w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 for %s, got %d", login, w.Code)
+		}
+	}
+	select {
+	case <-mailer.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a reset email")
+	}
+	if len(mailer.emails) != 1 || mailer.emails[0].To != "alice@example.com" {
+		t.Fatalf("expected a single email to alice, got %+v", mailer.emails)
+	}
+
+	if !strings.Contains(mailer.emails[0].Body, "\nhttps://calc.example/reset-password?token=") || strings.Contains(mailer.emails[0].Body, "evil.example") {
+		t.Fatalf("expected the link to start with PUBLIC_URL, got %s", mailer.emails[0].Body)
+	}
+	i := strings.Index(mailer.emails[0].Body, "token=")
+	token, _ := url.QueryUnescape(strings.Fields(mailer.emails[0].Body[i+len("token="):])[0])
+
+	if w := request("/api/v1/password/reset/confirm", `{"token": "`+token+`", "new_password": "short"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a weak password to be refused, got %d", w.Code)
+	}
+	if w := request("/api/v1/password/reset/confirm", `{"token": "`+token+`", "new_password": "new-secret-42"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the password to be reset, got %d %s", w.Code, w.Body)
+	}
+	if w := request("/api/v1/password/reset/confirm", `{"token": "`+token+`", "new_password": "new-secret-43"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the token to be used up, got %d", w.Code)
+	}
+
+	var verified bool
+	if err := DB.QueryRowContext(ctx, "SELECT emailVerified FROM users WHERE id = $1", uid).Scan(&verified); err != nil || !verified {
+		t.Fatalf("expected the used link to verify the email, got %v, %v", verified, err)
+	}
+	if d := accountLockout.Retry("alice"); d != 0 {
+		t.Fatalf("expected the lockout to be lifted, got %v", d)
+	}
+	if _, err := authenticate(ctx, httptest.NewRequest(http.MethodPost, "/", nil), "alice", "new-secret-42"); err != nil {
+		t.Fatalf("expected the new password to work, got %v", err)
+	}
+	if sessions, err := getActiveSessions(ctx, DB, uid); err != nil || len(sessions) != 0 {
+		t.Fatalf("expected the sessions to end, got %d, %v", len(sessions), err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	useTestDB(t)
+	useTestLockouts(t)
+	ctx := context.Background()
+
+	hash, _ := generate("secret-42")
+	uid, _ := insertUser(ctx, DB, &User{Name: "alice", Password: hash})
+	var sessions []RegistrationResponse
+	for i := 0; i < 2; i++ {
+		s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	handler := NewRouter()
+	change := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(http.MethodPost, "/api/v1/password/change", strings.NewReader(body)), sessions[0].Token))
+		return w
+	}
+
+	if w := change(`{"current_password": "secret-43", "new_password": "new-secret-42"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected a wrong password to be refused, got %d", w.Code)
+	}
+	if w := change(`{"current_password": "secret-42", "new_password": "secret-42"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the same password to be refused, got %d", w.Code)
+	}
+	if w := change(`{"current_password": "secret-42", "new_password": "new-secret-42"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the password to change, got %d %s", w.Code, w.Body)
+	}
+
+	active, err := getActiveSessions(ctx, DB, uid)
+	if err != nil || len(active) != 1 {
+		t.Fatalf("expected only the other session to end, got %d, %v", len(active), err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, withBearer(httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil), sessions[0].Token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the session of the change to go on, got %d", w.Code)
+	}
+}
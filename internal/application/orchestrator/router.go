@@ -0,0 +1,161 @@
+package application
+
+import (
+	"net/http"
+	"strings"
+)
+
+// router serves the routes registered on the mux. Requests no route matches
+// get a JSON error under /api/ and are sent to the login page elsewhere.
+type router struct {
+	mux *http.ServeMux
+}
+
+func NewRouter() http.Handler {
+	pages := []func(http.Handler) http.Handler{panicRecovery, CORSMiddleware, authMiddleware}
+	middlewares := []func(http.Handler) http.Handler{panicRecovery, headerMiddleware, CORSMiddleware, apiAuthMiddleware}
+	admin := append(middlewares[:4:4], adminMiddleware)
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /api/v1/register", withMiddlewareFunc(ApiRegistrationHandler, middlewares[:3]...))
+	mux.HandleFunc("POST /api/v1/login", withMiddlewareFunc(ApiLoginHandler, middlewares[:3]...))
+	mux.HandleFunc("POST /api/v1/login/mfa", withMiddlewareFunc(ApiLoginMFAHandler, middlewares[:3]...))
+	mux.HandleFunc("POST /api/v1/token/refresh", withMiddlewareFunc(ApiRefreshHandler, middlewares[:3]...))
+	mux.HandleFunc("POST /api/v1/logout", withMiddlewareFunc(ApiLogoutHandler, middlewares[:3]...))
+	mux.HandleFunc("POST /api/v1/password/change", withMiddlewareFunc(ApiChangePasswordHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/password/reset", withMiddlewareFunc(ApiPasswordResetHandler, middlewares[:3]...))
+	mux.HandleFunc("POST /api/v1/password/reset/confirm", withMiddlewareFunc(ApiPasswordResetConfirmHandler, middlewares[:3]...))
+	mux.HandleFunc("GET /api/v1/mfa", withMiddlewareFunc(ApiMFAHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/mfa/totp", withMiddlewareFunc(ApiTOTPHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/mfa/totp", withMiddlewareFunc(ApiTOTPHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/mfa/totp/verify", withMiddlewareFunc(ApiTOTPVerifyHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/mfa/recovery-codes", withMiddlewareFunc(ApiRecoveryCodesHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/sessions", withMiddlewareFunc(ApiSessionsHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}", withMiddlewareFunc(ApiRevokeSessionHandler, middlewares...))
+
+	mux.HandleFunc("GET /internal/task", withMiddlewareFunc(TasksHandler, middlewares[:2]...))
+	mux.HandleFunc("POST /internal/task", withMiddlewareFunc(TasksHandler, middlewares[:2]...))
+
+	mux.HandleFunc("POST /api/v1/calculate", withMiddlewareFunc(ApiCalcHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/calculate/batch", withMiddlewareFunc(ApiBatchHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/calculate/batch/{id}", withMiddlewareFunc(ApiBatchStatusHandler, middlewares...))
+
+	mux.HandleFunc("GET /api/v1/expressions", withMiddlewareFunc(ApiExpressionsHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/expressions/stream", withMiddlewareFunc(ApiExpressionsStreamHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/expressions/export", withMiddlewareFunc(ApiExportExpressionsHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/expressions/import", withMiddlewareFunc(ApiImportExpressionsHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/expressions/{id}", withMiddlewareFunc(ApiExpressionHandler, middlewares...))
+	mux.HandleFunc("PATCH /api/v1/expressions/{id}", withMiddlewareFunc(ApiExpressionHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/expressions/{id}", withMiddlewareFunc(ApiExpressionHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/expressions/{id}/cancel", withMiddlewareFunc(ApiCancelExpressionHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/expressions/{id}/rerun", withMiddlewareFunc(ApiRerunExpressionHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/expressions/{id}/deliveries", withMiddlewareFunc(ApiWebhookDeliveriesHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/expressions/{id}/shares", withMiddlewareFunc(ApiSharesHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/expressions/{id}/shares", withMiddlewareFunc(ApiSharesHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/expressions/{id}/shares/{share}", withMiddlewareFunc(ApiRevokeShareHandler, middlewares...))
+
+	mux.HandleFunc("GET /api/v1/webhooks", withMiddlewareFunc(ApiWebhooksHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/webhooks", withMiddlewareFunc(ApiWebhooksHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/webhooks/{id}", withMiddlewareFunc(ApiDeleteWebhookHandler, middlewares...))
+
+	mux.HandleFunc("GET /api/v1/apikeys", withMiddlewareFunc(ApiAPIKeysHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/apikeys", withMiddlewareFunc(ApiAPIKeysHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/apikeys/{id}", withMiddlewareFunc(ApiRevokeAPIKeyHandler, middlewares...))
+
+	mux.HandleFunc("GET /api/v1/workspaces", withMiddlewareFunc(ApiWorkspacesHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/workspaces", withMiddlewareFunc(ApiWorkspacesHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/workspaces/{id}", withMiddlewareFunc(ApiWorkspaceHandler, middlewares...))
+	mux.HandleFunc("PATCH /api/v1/workspaces/{id}", withMiddlewareFunc(ApiWorkspaceHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/workspaces/{id}", withMiddlewareFunc(ApiWorkspaceHandler, middlewares...))
+	mux.HandleFunc("PATCH /api/v1/workspaces/{id}/members/{user}", withMiddlewareFunc(ApiWorkspaceMemberHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/workspaces/{id}/members/{user}", withMiddlewareFunc(ApiWorkspaceMemberHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/workspaces/{id}/settings", withMiddlewareFunc(ApiWorkspaceSettingsHandler, middlewares...))
+	mux.HandleFunc("PATCH /api/v1/workspaces/{id}/settings", withMiddlewareFunc(ApiWorkspaceSettingsHandler, middlewares...))
+	mux.HandleFunc("GET /api/v1/workspaces/{id}/invites", withMiddlewareFunc(ApiWorkspaceInvitesHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/workspaces/{id}/invites", withMiddlewareFunc(ApiWorkspaceInvitesHandler, middlewares...))
+	mux.HandleFunc("DELETE /api/v1/workspaces/{id}/invites/{invite}", withMiddlewareFunc(ApiRevokeInviteHandler, middlewares...))
+	mux.HandleFunc("POST /api/v1/invites/accept", withMiddlewareFunc(ApiAcceptInviteHandler, middlewares...))
+
+	mux.HandleFunc("GET /api/v1/queue", withMiddlewareFunc(ApiQueueHandler, admin...))
+
+	mux.HandleFunc("GET /api/v1/admin/users", withMiddlewareFunc(ApiAdminUsersHandler, admin...))
+	mux.HandleFunc("PATCH /api/v1/admin/users/{id}", withMiddlewareFunc(ApiAdminUserHandler, admin...))
+	mux.HandleFunc("DELETE /api/v1/admin/users/{id}", withMiddlewareFunc(ApiAdminUserHandler, admin...))
+	mux.HandleFunc("GET /api/v1/admin/users/{id}/expressions", withMiddlewareFunc(ApiAdminUserExpressionsHandler, admin...))
+	mux.HandleFunc("GET /api/v1/admin/expressions/{id}", withMiddlewareFunc(ApiAdminExpressionHandler, admin...))
+	mux.HandleFunc("GET /api/v1/admin/status", withMiddlewareFunc(ApiAdminStatusHandler, admin...))
+	mux.HandleFunc("GET /api/v1/admin/timings", withMiddlewareFunc(ApiAdminTimingsHandler, admin...))
+	mux.HandleFunc("PATCH /api/v1/admin/timings", withMiddlewareFunc(ApiAdminTimingsHandler, admin...))
+
+	mux.HandleFunc("GET /api/v1/openapi.json", withMiddlewareFunc(ApiOpenAPIHandler, middlewares[:3]...))
+	mux.HandleFunc("GET /.well-known/jwks.json", withMiddlewareFunc(JWKSHandler, middlewares[:3]...))
+
+	mux.HandleFunc("GET /register", withMiddlewareFunc(RegistrationPageHandler, pages[:2]...))
+	mux.HandleFunc("GET /login", withMiddlewareFunc(LoginPageHandler, pages[:2]...))
+	mux.HandleFunc("GET /auth/oidc/login", withMiddlewareFunc(OIDCLoginHandler, pages[:2]...))
+	mux.HandleFunc("GET /auth/oidc/callback", withMiddlewareFunc(OIDCCallbackHandler, pages[:2]...))
+	mux.HandleFunc("GET /reset-password", withMiddlewareFunc(ResetPasswordPageHandler, pages[:2]...))
+	mux.HandleFunc("GET /share/{token}", withMiddlewareFunc(SharePageHandler, pages[:2]...))
+
+	mux.HandleFunc("GET /calculate", withMiddlewareFunc(CalcPageHandler, pages...))
+	mux.HandleFunc("GET /expressions", withMiddlewareFunc(ExpressionsPageHandler, pages...))
+	mux.HandleFunc("GET /expression", withMiddlewareFunc(ExpressionPageHandler, pages...))
+
+	mux.HandleFunc("GET /settings", withMiddlewareFunc(SettingsPageHandler, pages...))
+
+	mux.HandleFunc("GET /everything", withMiddlewareFunc(EverythingPageHandler, pages...))
+	mux.HandleFunc("GET /docs", withMiddlewareFunc(DocsPageHandler, pages[:2]...))
+
+	mux.Handle("GET /css/", http.StripPrefix("/css", http.FileServer(http.Dir("../../html_templates/css"))))
+	mux.Handle("GET /js/", http.StripPrefix("/js", http.FileServer(http.Dir("../../html_templates/js"))))
+	mux.Handle("GET /icons/", http.StripPrefix("/icons", http.FileServer(http.Dir("../../html_templates/icons"))))
+
+	return router{mux: mux}
+}
+
+func (rt router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setRequestID(w, r)
+
+	// preflight requests are answered for every route, the mux would refuse
+	// them as they don't use the method of the route
+	if r.Method == http.MethodOptions {
+		CORSMiddleware(http.NotFoundHandler()).ServeHTTP(w, r)
+		return
+	}
+
+	if _, pattern := rt.mux.Handler(r); pattern == "" {
+		// the mux answers with 404 or, if the path is known, with 405 and
+		// the Allow header
+		w = &fallbackWriter{ResponseWriter: w, r: r, api: strings.HasPrefix(r.URL.Path, "/api/")}
+	}
+	rt.mux.ServeHTTP(w, r)
+}
+
+// fallbackWriter replaces the plain text errors of the mux with JSON ones
+// under /api/ and with a redirect to the login page for unknown pages.
+type fallbackWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	api      bool
+	replaced bool
+}
+
+func (f *fallbackWriter) WriteHeader(code int) {
+	switch {
+	case f.api:
+		generateErrorResponse(f.ResponseWriter, http.StatusText(code), code)
+	case code == http.StatusNotFound:
+		http.Redirect(f.ResponseWriter, f.r, "/login", http.StatusSeeOther)
+	default:
+		f.ResponseWriter.WriteHeader(code)
+		return
+	}
+	f.replaced = true
+}
+
+func (f *fallbackWriter) Write(b []byte) (int, error) {
+	if f.replaced {
+		return len(b), nil
+	}
+	return f.ResponseWriter.Write(b)
+}
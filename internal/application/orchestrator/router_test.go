@@ -0,0 +1,48 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterFallbacks(t *testing.T) {
+	router := NewRouter()
+
+	tests := []struct {
+		method, path string
+		code         int
+		allow        string
+		location     string
+	}{
+		{http.MethodGet, "/api/v1/calculate", http.StatusMethodNotAllowed, "POST", ""},
+		{http.MethodPut, "/api/v1/expressions/1", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, PATCH", ""},
+		{http.MethodGet, "/api/v1/unknown", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/unknown", http.StatusSeeOther, "", "/login"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.code, rec.Code)
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.allow, got)
+		}
+		if got := rec.Header().Get("Location"); got != tt.location {
+			t.Errorf("%s %s: expected Location %q, got %q", tt.method, tt.path, tt.location, got)
+		}
+		if tt.location == "" {
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Code != errorCode(tt.code) {
+				t.Errorf("%s %s: expected a JSON error, got %q", tt.method, tt.path, rec.Body)
+			}
+			if resp.RequestID == "" || resp.RequestID != rec.Header().Get(RequestIDHeader) {
+				t.Errorf("%s %s: expected the request ID in the body and the header, got %q", tt.method, tt.path, rec.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package application
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timings are the time limits of the evaluation. DefaultTimeout bounds the
+// evaluation of an expression that doesn't ask for its own timeout_ms,
+// MaxTimeout is the largest timeout_ms a client may ask for and MaxWait is the
+// longest a synchronous calculate request is kept open. Operations is how
+// long an agent may take to compute an operation.
+//
+// They are read from the environment, and admins may change them at runtime.
+type Timings struct {
+	DefaultTimeout time.Duration
+	MaxTimeout     time.Duration
+	MaxWait        time.Duration
+	Operations     map[rune]time.Duration
+}
+
+// The timings are named after their environment variables, also in the
+// settings table.
+const (
+	timingDefaultTimeout = "CALC_TIMEOUT_DEFAULT_MS"
+	timingMaxTimeout     = "CALC_TIMEOUT_MAX_MS"
+	timingMaxWait        = "CALC_MAX_WAIT_MS"
+)
+
+var operationTimingNames = map[rune]string{
+	'+': "TIME_ADDITION_MS",
+	'-': "TIME_SUBTRACTION_MS",
+	'*': "TIME_MULTIPLICATIONS_MS",
+	'/': "TIME_DIVISIONS_MS",
+	'^': "TIME_POW_MS",
+}
+
+var timings atomic.Pointer[Timings]
+
+func init() {
+	t := &Timings{
+		DefaultTimeout: envMilliseconds(timingDefaultTimeout, 60000),
+		MaxTimeout:     envMilliseconds(timingMaxTimeout, 600000),
+		MaxWait:        envMilliseconds(timingMaxWait, 30000),
+		Operations:     make(map[rune]time.Duration),
+	}
+	for op, name := range operationTimingNames {
+		t.Operations[op] = envMilliseconds(name, 50)
+	}
+	timings.Store(t)
+}
+
+// CurrentTimings returns the timings in effect. They must not be modified,
+// SetTimings replaces them.
+func CurrentTimings() *Timings {
+	return timings.Load()
+}
+
+func envMilliseconds(name string, def int) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return time.Duration(def) * time.Millisecond
+	}
+	ms, err := strconv.Atoi(val)
+	if err != nil || ms <= 0 {
+		log.Printf("Invalid %s %q, using %v ms\n", name, val, def)
+		ms = def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func envInt(name string, def int) int {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s %q, using %v\n", name, val, def)
+		return def
+	}
+	return n
+}
+
+func envBool(name string, def bool) bool {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v\n", name, val, def)
+		return def
+	}
+	return b
+}
+
+// runningExpression is an expression whose evaluation goroutine is still alive.
+type runningExpression struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// cancelled is set while a queued expression waits for its turn, Cancel
+	// calls it to store the expression instead of waiting for the turn.
+	cancelled func()
+}
+
+type runningExpressions struct {
+	m  map[string]*runningExpression
+	mu sync.Mutex
+}
+
+var Running = runningExpressions{m: make(map[string]*runningExpression)}
+
+// Start registers the expression and returns the context its evaluation must
+// run in, which expires after timeout. finish has to be called once the result
+// is stored.
+func (re *runningExpressions) Start(id string, timeout time.Duration) (ctx context.Context, finish func()) {
+	ctx, unregister := re.Register(id)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		unregister()
+		cancel()
+	}
+}
+
+// Register is Start without a deadline.
+func (re *runningExpressions) Register(id string) (ctx context.Context, finish func()) {
+	_, ctx, finish = re.register(id, nil)
+	return ctx, finish
+}
+
+// Queue registers an expression which waits for its turn first, and only
+// starts its deadline once the turn has come. Until start is called, Cancel
+// doesn't wait for the turn but calls cancelled with the cancelled context,
+// which has to store the expression as cancelled. start reports false if
+// that happened, the expression is skipped then and finish must not be
+// called.
+func (re *runningExpressions) Queue(id string, cancelled func(ctx context.Context)) (ctx context.Context, start func() bool, finish func()) {
+	e, ctx, finish := re.register(id, cancelled)
+
+	return ctx, func() bool {
+		re.mu.Lock()
+		defer re.mu.Unlock()
+		e.cancelled = nil
+		return re.m[id] == e
+	}, finish
+}
+
+func (re *runningExpressions) register(id string, cancelled func(ctx context.Context)) (*runningExpression, context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &runningExpression{cancel: cancel, done: make(chan struct{})}
+	if cancelled != nil {
+		e.cancelled = func() { cancelled(ctx) }
+	}
+
+	re.mu.Lock()
+	re.m[id] = e
+	re.mu.Unlock()
+
+	return e, ctx, func() {
+		re.mu.Lock()
+		delete(re.m, id)
+		re.mu.Unlock()
+		cancel()
+		close(e.done)
+	}
+}
+
+// Cancel stops the evaluation of the expression and waits until it is stored
+// as cancelled. It reports false if the expression isn't being evaluated.
+func (re *runningExpressions) Cancel(id string) bool {
+	re.mu.Lock()
+	e, ok := re.m[id]
+	var cancelled func()
+	if ok && e.cancelled != nil {
+		// the expression is still waiting, it won't get its turn
+		cancelled = e.cancelled
+		delete(re.m, id)
+	}
+	re.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	e.cancel()
+	if cancelled != nil {
+		cancelled()
+		close(e.done)
+	}
+	<-e.done
+	return true
+}
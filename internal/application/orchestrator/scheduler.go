@@ -0,0 +1,356 @@
+package application
+
+import (
+	"container/heap"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Barsenick/calculator/internal/application/task"
+)
+
+const (
+	MinPriority = 0
+	MaxPriority = 10
+)
+
+var (
+	ErrUnknownTask     = errors.New("unknown task")
+	ErrTaskCancelled   = errors.New("task was cancelled")
+	ErrInvalidPriority = errors.New("priority must be between 0 and 10")
+)
+
+type QueueStats struct {
+	UserID  int64 `json:"user_id"`
+	Queued  int   `json:"queued"`
+	Running int   `json:"running"`
+	Cap     int   `json:"cap"`
+	Weight  int   `json:"weight"`
+}
+
+type QueueStatsResponse struct {
+	Users []QueueStats `json:"users"`
+}
+
+type scheduledTask struct {
+	task     task.Task
+	ownerID  int64
+	priority int
+	seq      uint64
+	result   chan task.TaskResult
+}
+
+// taskHeap orders the tasks of a single user: higher priority first, then FIFO.
+type taskHeap []*scheduledTask
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x any)   { *h = append(*h, x.(*scheduledTask)) }
+func (h *taskHeap) Pop() any {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return t
+}
+
+type userQueue struct {
+	tasks   taskHeap
+	running int
+	// pass is the virtual time of the user: every dispatched task advances it
+	// by 1/weight, and the user with the smallest pass is served next.
+	pass float64
+}
+
+// Scheduler keeps a queue of pending tasks per user and hands them out to
+// agents using weighted fair sharing, so one user can't starve the others.
+type Scheduler struct {
+	mu         sync.Mutex
+	queues     map[int64]*userQueue
+	running    map[int]*scheduledTask
+	discarded  map[int]time.Time
+	caps       map[int64]int
+	weights    map[int64]int
+	defaultCap int
+	nextID     int
+	seq        uint64
+	vtime      float64
+}
+
+var TaskScheduler = NewScheduler()
+
+// NewScheduler creates a scheduler configured from the environment:
+// SCHEDULER_DEFAULT_CAP is the number of tasks a user may have running at once
+// (0 means unlimited), SCHEDULER_USER_CAPS and SCHEDULER_USER_WEIGHTS override
+// it per user in the "id=value,id=value" form.
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		queues:    make(map[int64]*userQueue),
+		running:   make(map[int]*scheduledTask),
+		discarded: make(map[int]time.Time),
+		caps:      parseUserValues(os.Getenv("SCHEDULER_USER_CAPS")),
+		weights:   parseUserValues(os.Getenv("SCHEDULER_USER_WEIGHTS")),
+	}
+
+	if val := os.Getenv("SCHEDULER_DEFAULT_CAP"); val != "" {
+		defaultCap, err := strconv.Atoi(val)
+		if err != nil || defaultCap < 0 {
+			log.Printf("Invalid SCHEDULER_DEFAULT_CAP %q, using no cap\n", val)
+		} else {
+			s.defaultCap = defaultCap
+		}
+	}
+
+	return s
+}
+
+func parseUserValues(s string) map[int64]int {
+	values := make(map[int64]int)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		uid, err1 := strconv.ParseInt(strings.TrimSpace(k), 10, 64)
+		val, err2 := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err1 != nil || err2 != nil || val < 0 {
+			log.Printf("Ignoring invalid scheduler setting %q\n", pair)
+			continue
+		}
+		values[uid] = val
+	}
+	return values
+}
+
+// SetCap sets how many tasks of the user may be running at once. 0 means unlimited.
+func (s *Scheduler) SetCap(userID int64, cap int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caps[userID] = cap
+}
+
+// SetWeight sets the share of the agents the user gets relative to other users.
+func (s *Scheduler) SetWeight(userID int64, weight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weights[userID] = weight
+}
+
+// loadUserScheduling applies the caps and weights admins have set over those
+// of the environment.
+func loadUserScheduling(ctx context.Context, DB *sql.DB, s *Scheduler) error {
+	rows, err := DB.QueryContext(ctx, "SELECT id, schedulerCap, schedulerWeight FROM users WHERE schedulerCap IS NOT NULL OR schedulerWeight IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id          int64
+			cap, weight sql.NullInt64
+		)
+		if err := rows.Scan(&id, &cap, &weight); err != nil {
+			return err
+		}
+		if cap.Valid {
+			s.SetCap(id, int(cap.Int64))
+		}
+		if weight.Valid {
+			s.SetWeight(id, int(weight.Int64))
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Scheduler) capOf(userID int64) int {
+	if c, ok := s.caps[userID]; ok {
+		return c
+	}
+	return s.defaultCap
+}
+
+func (s *Scheduler) weightOf(userID int64) int {
+	if w, ok := s.weights[userID]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Solve queues the operation on behalf of the user and blocks until an agent
+// returns its result or ctx is done. It has the shape of calc.Solver once the
+// context, owner, priority and time of the operation are bound.
+func (s *Scheduler) Solve(ctx context.Context, ownerID int64, priority int, op rune, arg1, arg2 float64, t time.Duration) (float64, error) {
+	st := &scheduledTask{
+		ownerID:  ownerID,
+		priority: priority,
+		result:   make(chan task.TaskResult, 1),
+	}
+
+	// the agent must not take longer than the expression has left
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < t {
+			t = max(left, time.Millisecond)
+		}
+	}
+
+	s.mu.Lock()
+	st.task = task.Task{TaskID: s.nextID, Arg1: arg1, Arg2: arg2, Operation: op, OperationTime: int(t.Milliseconds())}
+	st.seq = s.seq
+	s.nextID++
+	s.seq++
+
+	q, ok := s.queues[ownerID]
+	if !ok {
+		q = &userQueue{}
+		s.queues[ownerID] = q
+	}
+	if q.tasks.Len() == 0 && q.running == 0 && q.pass < s.vtime {
+		// an idle user doesn't get to bank credit for the time it was away
+		q.pass = s.vtime
+	}
+	heap.Push(&q.tasks, st)
+	s.mu.Unlock()
+
+	select {
+	case tr := <-st.result:
+		if tr.Error != "" {
+			return 0, errors.New(tr.Error)
+		}
+		return tr.Result, nil
+	case <-ctx.Done():
+		s.withdraw(st)
+		return 0, ctx.Err()
+	}
+}
+
+// withdraw takes the task out of the queue. If an agent is already computing
+// it, its result will be discarded; discarded holds when the task was
+// withdrawn.
+func (s *Scheduler) withdraw(st *scheduledTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queues[st.ownerID]
+	if _, ok := s.running[st.task.TaskID]; ok {
+		delete(s.running, st.task.TaskID)
+		s.sweepDiscarded()
+		s.discarded[st.task.TaskID] = time.Now()
+		q.running--
+	} else if q != nil {
+		for i, queued := range q.tasks {
+			if queued == st {
+				heap.Remove(&q.tasks, i)
+				break
+			}
+		}
+	}
+	if q != nil && q.tasks.Len() == 0 && q.running == 0 {
+		delete(s.queues, st.ownerID)
+	}
+}
+
+// sweepDiscarded forgets the withdrawn tasks whose agents had more than the
+// longest operation time to return them. s.mu must be held.
+func (s *Scheduler) sweepDiscarded() {
+	var longest time.Duration
+	for _, t := range CurrentTimings().Operations {
+		longest = max(longest, t)
+	}
+	for id, withdrawn := range s.discarded {
+		if time.Since(withdrawn) > longest {
+			delete(s.discarded, id)
+		}
+	}
+}
+
+// Next picks the task that should be computed next, if there is one.
+func (s *Scheduler) Next() (task.Task, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		next   *userQueue
+		nextID int64
+	)
+	for uid, q := range s.queues {
+		if q.tasks.Len() == 0 {
+			continue
+		}
+		if c := s.capOf(uid); c > 0 && q.running >= c {
+			continue
+		}
+		if next == nil || q.pass < next.pass || (q.pass == next.pass && uid < nextID) {
+			next, nextID = q, uid
+		}
+	}
+	if next == nil {
+		return task.Task{}, false
+	}
+
+	st := heap.Pop(&next.tasks).(*scheduledTask)
+	s.vtime = next.pass
+	next.pass += 1 / float64(s.weightOf(nextID))
+	next.running++
+	s.running[st.task.TaskID] = st
+
+	return st.task, true
+}
+
+// Complete hands the result computed by an agent back to the waiting expression.
+func (s *Scheduler) Complete(tr task.TaskResult) error {
+	s.mu.Lock()
+	st, ok := s.running[tr.TaskID]
+	if !ok {
+		_, discarded := s.discarded[tr.TaskID]
+		delete(s.discarded, tr.TaskID)
+		s.mu.Unlock()
+		if discarded {
+			return ErrTaskCancelled
+		}
+		return ErrUnknownTask
+	}
+	delete(s.running, tr.TaskID)
+	q := s.queues[st.ownerID]
+	q.running--
+	if q.tasks.Len() == 0 && q.running == 0 {
+		delete(s.queues, st.ownerID)
+	}
+	s.mu.Unlock()
+
+	st.result <- tr
+	return nil
+}
+
+// Stats reports the queue depth of every user that has pending or running tasks.
+func (s *Scheduler) Stats() []QueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]QueueStats, 0, len(s.queues))
+	for uid, q := range s.queues {
+		stats = append(stats, QueueStats{
+			UserID:  uid,
+			Queued:  q.tasks.Len(),
+			Running: q.running,
+			Cap:     s.capOf(uid),
+			Weight:  s.weightOf(uid),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].UserID < stats[j].UserID })
+	return stats
+}
@@ -0,0 +1,136 @@
+package application
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Barsenick/calculator/internal/application/task"
+)
+
+func waitQueued(t *testing.T, s *Scheduler, n int) {
+	t.Helper()
+	for range 100 {
+		queued := 0
+		for _, st := range s.Stats() {
+			queued += st.Queued
+		}
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %v queued tasks", n)
+}
+
+func TestSchedulerFairSharing(t *testing.T) {
+	s := NewScheduler()
+	s.SetWeight(2, 2)
+
+	for range 6 {
+		go s.Solve(context.Background(), 1, 0, '+', 1, 1, time.Second)
+	}
+	waitQueued(t, s, 6)
+	for range 6 {
+		go s.Solve(context.Background(), 2, 0, '+', 1, 1, time.Second)
+	}
+	waitQueued(t, s, 12)
+
+	served := map[int64]int{}
+	for range 6 {
+		next, ok := s.Next()
+		if !ok {
+			t.Fatal("expected a task")
+		}
+		served[s.running[next.TaskID].ownerID]++
+	}
+
+	if served[1] != 2 || served[2] != 4 {
+		t.Fatalf("expected a 2:4 split, got %v", served)
+	}
+}
+
+func TestSchedulerPriorityAndCap(t *testing.T) {
+	s := NewScheduler()
+	s.SetCap(1, 1)
+
+	go s.Solve(context.Background(), 1, 0, '+', 1, 1, time.Second)
+	waitQueued(t, s, 1)
+	res := make(chan float64)
+	go func() {
+		r, _ := s.Solve(context.Background(), 1, 5, '*', 2, 3, time.Second)
+		res <- r
+	}()
+	waitQueued(t, s, 2)
+
+	next, ok := s.Next()
+	if !ok || next.Operation != '*' {
+		t.Fatalf("expected the high priority task first, got %v", next)
+	}
+	if _, ok := s.Next(); ok {
+		t.Fatal("expected the cap to hold back the second task")
+	}
+
+	if err := s.Complete(task.TaskResult{TaskID: next.TaskID, Result: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-res; r != 6 {
+		t.Fatalf("expected 6, got %v", r)
+	}
+	if _, ok := s.Next(); !ok {
+		t.Fatal("expected the remaining task after the running one completed")
+	}
+	if err := s.Complete(task.TaskResult{TaskID: 1000}); err != ErrUnknownTask {
+		t.Fatalf("expected ErrUnknownTask, got %v", err)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := NewScheduler()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := s.Solve(ctx, 1, 0, '+', 1, 1, time.Second)
+			errs <- err
+		}()
+	}
+	waitQueued(t, s, 2)
+
+	next, _ := s.Next()
+	cancel()
+	for range 2 {
+		if err := <-errs; err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	}
+
+	if stats := s.Stats(); len(stats) != 0 {
+		t.Fatalf("expected an empty queue, got %v", stats)
+	}
+	if err := s.Complete(task.TaskResult{TaskID: next.TaskID}); err != ErrTaskCancelled {
+		t.Fatalf("expected ErrTaskCancelled, got %v", err)
+	}
+
+	// agents that never answer are forgotten after the longest operation time
+	s.mu.Lock()
+	s.discarded[next.TaskID] = time.Now().Add(-time.Hour)
+	s.mu.Unlock()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := s.Solve(ctx, 1, 0, '+', 1, 1, time.Second)
+		errs <- err
+	}()
+	waitQueued(t, s, 1)
+	last, _ := s.Next()
+	cancel()
+	<-errs
+
+	if err := s.Complete(task.TaskResult{TaskID: next.TaskID}); err != ErrUnknownTask {
+		t.Fatalf("expected ErrUnknownTask, got %v", err)
+	}
+	if err := s.Complete(task.TaskResult{TaskID: last.TaskID}); err != ErrTaskCancelled {
+		t.Fatalf("expected ErrTaskCancelled, got %v", err)
+	}
+}
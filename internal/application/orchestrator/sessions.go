@@ -0,0 +1,526 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Barsenick/calculator/pkg/client"
+	"github.com/google/uuid"
+)
+
+// Logging in starts a session. The session hands out short-lived access
+// tokens (JWTs whose sid claim names the session) in exchange for its refresh
+// token, which changes with every refresh and is only stored hashed. Revoking
+// the session makes its access tokens invalid at once.
+
+var (
+	AccessTokenTTL  = envMilliseconds("JWT_ACCESS_TTL_MS", 15*60*1000)
+	RefreshTokenTTL = envMilliseconds("JWT_REFRESH_TTL_MS", 30*24*60*60*1000)
+)
+
+// a refresh token that was just replaced is still accepted this long, for
+// requests that raced the refresh
+const refreshGracePeriod = 30 * time.Second
+
+const (
+	TokenCookie   = "token"
+	RefreshCookie = "refresh_token"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was used twice, the session is revoked")
+)
+
+type Session struct {
+	client.Session
+	OwnerID int64
+	// Revoked is when the session was revoked, 0 if it wasn't.
+	Revoked int64
+
+	refreshHash         string
+	previousRefreshHash string
+}
+
+type (
+	RefreshRequest = client.RefreshRequest
+	LogoutRequest  = client.LogoutRequest
+)
+
+func createSessionsTable(ctx context.Context, DB *sql.DB) error {
+	const sessionsTable = `
+	CREATE TABLE IF NOT EXISTS sessions(
+		id TEXT PRIMARY KEY,
+		ownerID INTEGER,
+		refreshHash TEXT UNIQUE,
+		previousRefreshHash TEXT,
+		userAgent TEXT,
+		ip TEXT,
+		created INTEGER,
+		lastUsed INTEGER,
+		expires INTEGER,
+		revoked INTEGER DEFAULT 0,
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	if _, err := DB.ExecContext(ctx, sessionsTable); err != nil {
+		return err
+	}
+
+	if _, err := DB.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS sessions_previous ON sessions(previousRefreshHash)"); err != nil {
+		return err
+	}
+
+	return Revoked.load(ctx, DB)
+}
+
+// revocationList holds the sessions revoked recently enough that access
+// tokens issued before the revocation may not have expired yet.
+type revocationList struct {
+	m  map[string]time.Time
+	mu sync.Mutex
+}
+
+var Revoked = revocationList{m: make(map[string]time.Time)}
+
+func (rl *revocationList) load(ctx context.Context, DB *sql.DB) error {
+	since := time.Now().Add(-AccessTokenTTL).Unix()
+	rows, err := DB.QueryContext(ctx, "SELECT id, revoked FROM sessions WHERE revoked >= ?", since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for rows.Next() {
+		var (
+			id      string
+			revoked int64
+		)
+		if err := rows.Scan(&id, &revoked); err != nil {
+			return err
+		}
+		rl.m[id] = time.Unix(revoked, 0)
+	}
+	return rows.Err()
+}
+
+func (rl *revocationList) Add(ids ...string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	for id, revoked := range rl.m {
+		if now.Sub(revoked) > AccessTokenTTL {
+			delete(rl.m, id)
+		}
+	}
+	for _, id := range ids {
+		rl.m[id] = now
+	}
+}
+
+func (rl *revocationList) Contains(id string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	_, ok := rl.m[id]
+	return ok
+}
+
+func newRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashSecret(token), nil
+}
+
+// hashSecret is how refresh tokens and API keys are stored. They are random
+// and long, so a fast hash is enough.
+func hashSecret(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientIP(r *http.Request) string {
+	if i := strings.LastIndexByte(r.RemoteAddr, ':'); i > 0 {
+		return strings.Trim(r.RemoteAddr[:i], "[]")
+	}
+	return r.RemoteAddr
+}
+
+// startSession logs the user in on behalf of the request.
+func startSession(ctx context.Context, r *http.Request, userID int64) (RegistrationResponse, error) {
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return RegistrationResponse{}, err
+	}
+
+	now := time.Now()
+	s := Session{
+		Session: client.Session{
+			ID:        uuid.NewString(),
+			UserAgent: r.UserAgent(),
+			IP:        clientIP(r),
+			Created:   now.Unix(),
+			LastUsed:  now.Unix(),
+			Expires:   now.Add(RefreshTokenTTL).Unix(),
+		},
+		OwnerID:     userID,
+		refreshHash: hash,
+	}
+
+	_, err = DB.ExecContext(ctx, `
+	INSERT INTO sessions (id, ownerID, refreshHash, userAgent, ip, created, lastUsed, expires) values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, s.ID, s.OwnerID, s.refreshHash, s.UserAgent, s.IP, s.Created, s.LastUsed, s.Expires)
+	if err != nil {
+		return RegistrationResponse{}, err
+	}
+
+	return sessionTokens(s, refresh)
+}
+
+func sessionTokens(s Session, refresh string) (RegistrationResponse, error) {
+	token, err := generateToken(s.OwnerID, s.ID)
+	if err != nil {
+		return RegistrationResponse{}, err
+	}
+	return RegistrationResponse{
+		Status:       "200 OK",
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// refreshSession swaps the refresh token for a new one and an access token.
+// A replaced refresh token revokes the session, as it means that someone else
+// has a copy of it, unless it was replaced just now by a concurrent request;
+// then only an access token is returned.
+func refreshSession(ctx context.Context, refresh string) (RegistrationResponse, error) {
+	hash := hashSecret(refresh)
+	now := time.Now()
+
+	s, err := selectSession(ctx, DB, "refreshHash = ? OR previousRefreshHash = ?", hash, hash)
+	if err == sql.ErrNoRows || (err == nil && (s.Revoked != 0 || s.Expires < now.Unix())) {
+		return RegistrationResponse{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return RegistrationResponse{}, err
+	}
+
+	if s.refreshHash != hash {
+		if now.Sub(time.Unix(s.LastUsed, 0)) <= refreshGracePeriod {
+			return sessionTokens(s, "")
+		}
+		if err := revokeSessions(ctx, DB, s.OwnerID, s.ID); err != nil {
+			return RegistrationResponse{}, err
+		}
+		log.Printf("Refresh token of session %s was reused, the session is revoked\n", s.ID)
+		return RegistrationResponse{}, ErrRefreshTokenReused
+	}
+
+	newRefresh, newHash, err := newRefreshToken()
+	if err != nil {
+		return RegistrationResponse{}, err
+	}
+
+	// the condition on refreshHash makes one of two concurrent refreshes lose
+	result, err := DB.ExecContext(ctx, `
+	UPDATE sessions SET refreshHash = $1, previousRefreshHash = $2, lastUsed = $3, expires = $4 WHERE id = $5 AND refreshHash = $2
+	`, newHash, hash, now.Unix(), now.Add(RefreshTokenTTL).Unix(), s.ID)
+	if err != nil {
+		return RegistrationResponse{}, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return sessionTokens(s, "")
+	}
+
+	return sessionTokens(s, newRefresh)
+}
+
+const sessionColumns = "id, ownerID, COALESCE(refreshHash, ''), COALESCE(previousRefreshHash, ''), COALESCE(userAgent, ''), COALESCE(ip, ''), created, lastUsed, expires, revoked"
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.OwnerID, &s.refreshHash, &s.previousRefreshHash, &s.UserAgent, &s.IP, &s.Created, &s.LastUsed, &s.Expires, &s.Revoked)
+	return s, err
+}
+
+func selectSession(ctx context.Context, DB *sql.DB, where string, args ...any) (Session, error) {
+	return scanSession(DB.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE "+where, args...))
+}
+
+// getActiveSessions lists the sessions of the user which can still be refreshed.
+func getActiveSessions(ctx context.Context, DB *sql.DB, userID int64) ([]Session, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE ownerID = ? AND revoked = 0 AND expires > ? ORDER BY lastUsed DESC", userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// revokeSessions ends the given sessions of the user, or all of them if none
+// is given.
+func revokeSessions(ctx context.Context, DB *sql.DB, userID int64, ids ...string) error {
+	query := "SELECT id FROM sessions WHERE ownerID = ? AND revoked = 0"
+	args := []any{userID}
+	if len(ids) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	var revoked []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		revoked = append(revoked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(revoked) == 0 {
+		return sql.ErrNoRows
+	}
+
+	args = []any{time.Now().Unix()}
+	for _, id := range revoked {
+		args = append(args, id)
+	}
+	if _, err := DB.ExecContext(ctx, "UPDATE sessions SET revoked = ? WHERE id IN (?"+strings.Repeat(", ?", len(revoked)-1)+")", args...); err != nil {
+		return err
+	}
+
+	Revoked.Add(revoked...)
+	return nil
+}
+
+// sessionID returns the session of the access token the request is made
+// with, if it is valid.
+func sessionID(r *http.Request) string {
+	p, _ := requestPrincipal(r)
+	return p.SessionID
+}
+
+func setSessionCookies(w http.ResponseWriter, r *http.Request, tokens RegistrationResponse) {
+	http.SetCookie(w, &http.Cookie{Name: TokenCookie, Value: tokens.Token, Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	if tokens.RefreshToken != "" {
+		http.SetCookie(w, &http.Cookie{Name: RefreshCookie, Value: tokens.RefreshToken, Path: "/", MaxAge: int(RefreshTokenTTL.Seconds()), HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+	}
+	setCSRFCookie(w, r)
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{TokenCookie, RefreshCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	}
+	http.SetCookie(w, &http.Cookie{Name: CSRFCookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+// refreshSessionCookies renews the access token of a browser whose token
+// cookie has expired with its refresh token cookie, so that the web pages
+// don't log out every few minutes. The request carries the new token on.
+func refreshSessionCookies(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(RefreshCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	tokens, err := refreshSession(r.Context(), cookie.Value)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidRefreshToken) && !errors.Is(err, ErrRefreshTokenReused) {
+			log.Printf("Request %s failed to refresh its session: %v", w.Header().Get(RequestIDHeader), err)
+		}
+		return false
+	}
+
+	setSessionCookies(w, r, tokens)
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == TokenCookie {
+			c.Value = tokens.Token
+		}
+		r.AddCookie(c)
+	}
+	if _, err := r.Cookie(TokenCookie); err != nil {
+		r.AddCookie(&http.Cookie{Name: TokenCookie, Value: tokens.Token})
+	}
+	return true
+}
+
+func ApiRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+			generateErrorResponse(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fromCookie := false
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie(RefreshCookie); err == nil {
+			req.RefreshToken, fromCookie = cookie.Value, true
+		}
+	}
+	if req.RefreshToken == "" {
+		generateErrorResponse(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := refreshSession(r.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		if fromCookie {
+			clearSessionCookies(w)
+		}
+		generateErrorResponse(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if fromCookie {
+		setSessionCookies(w, r, tokens)
+	}
+
+	json, err := json.Marshal(tokens)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+// ApiLogoutHandler ends the session of the access token, or of the refresh
+// token if the access token has expired already.
+func ApiLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req LogoutRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+			generateErrorResponse(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var s Session
+	var err error
+	if sid := sessionID(r); sid != "" {
+		s, err = selectSession(ctx, DB, "id = ?", sid)
+	} else if cookie, cookieErr := r.Cookie(RefreshCookie); cookieErr == nil && cookie.Value != "" {
+		s, err = selectSession(ctx, DB, "refreshHash = ?", hashSecret(cookie.Value))
+	} else {
+		clearSessionCookies(w)
+		unauthorized(w)
+		return
+	}
+	if err == sql.ErrNoRows {
+		clearSessionCookies(w)
+		unauthorized(w)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if req.All {
+		err = revokeSessions(ctx, DB, s.OwnerID)
+	} else {
+		err = revokeSessions(ctx, DB, s.OwnerID, s.ID)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		internalError(w, err)
+		return
+	}
+
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ApiSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := getActiveSessions(r.Context(), DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	list := client.SessionList{Sessions: make([]client.Session, len(sessions))}
+	current := sessionID(r)
+	for i, s := range sessions {
+		list.Sessions[i] = s.Session
+		list.Sessions[i].Current = s.ID == current
+	}
+
+	json, err := json.Marshal(list)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiRevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	err := revokeSessions(r.Context(), DB, uid, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestDB points DB at a new database and signs tokens with a temporary key.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := temporaryKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousDB, previousKeys := DB, signingKeys.Load()
+	DB = db
+	signingKeys.Store(keys)
+	t.Cleanup(func() {
+		// the expressions still evaluated in the background store their
+		// outcome in db
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			Running.mu.Lock()
+			n := len(Running.m)
+			Running.mu.Unlock()
+			if n == 0 {
+				break
+			}
+		}
+		DB = previousDB
+		signingKeys.Store(previousKeys)
+		db.Close()
+	})
+}
+
+func withBearer(r *http.Request, token string) *http.Request {
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestSessionRefresh(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	uid, err := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := refreshSession(ctx, login.RefreshToken)
+	if err != nil || refreshed.RefreshToken == "" || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("expected a new refresh token, got %+v, %v", refreshed, err)
+	}
+
+	// a request that raced the refresh still gets an access token
+	raced, err := refreshSession(ctx, login.RefreshToken)
+	if err != nil || raced.Token == "" || raced.RefreshToken != "" {
+		t.Fatalf("expected only an access token, got %+v, %v", raced, err)
+	}
+
+	// later, the old refresh token gives the session away
+	if _, err := DB.ExecContext(ctx, "UPDATE sessions SET lastUsed = ?", time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refreshSession(ctx, login.RefreshToken); err != ErrRefreshTokenReused {
+		t.Fatalf("expected the reuse to be detected, got %v", err)
+	}
+	if _, err := refreshSession(ctx, refreshed.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Fatalf("expected the session to be revoked, got %v", err)
+	}
+	if _, err := getToken(withBearer(httptest.NewRequest(http.MethodGet, "/", nil), refreshed.Token), nil); err != ErrInvalidToken {
+		t.Fatalf("expected the access token of the revoked session to be refused, got %v", err)
+	}
+}
+
+func TestSessionsAPI(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	alice, _ := insertUser(ctx, DB, &User{Name: "alice", Password: "hash"})
+	bob, _ := insertUser(ctx, DB, &User{Name: "bob", Password: "hash"})
+
+	var tokens []string
+	for _, uid := range []int64{alice, alice, bob} {
+		session, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, session.Token)
+	}
+
+	sessions, err := getActiveSessions(ctx, DB, alice)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v, %v", sessions, err)
+	}
+
+	// bob can't end the sessions of alice
+	w := httptest.NewRecorder()
+	r := withBearer(httptest.NewRequest(http.MethodDelete, "/api/v1/sessions/"+sessions[0].ID, nil), tokens[2])
+	r.SetPathValue("id", sessions[0].ID)
+	ApiRevokeSessionHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ApiLogoutHandler(w, withBearer(httptest.NewRequest(http.MethodPost, "/api/v1/logout", nil), tokens[0]))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+
+	for i, valid := range []bool{false, true, true} {
+		_, err := getToken(withBearer(httptest.NewRequest(http.MethodGet, "/", nil), tokens[i]), nil)
+		if (err == nil) != valid {
+			t.Errorf("token %d: expected valid %v, got %v", i, valid, err)
+		}
+	}
+
+	if err := revokeSessions(ctx, DB, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeSessions(ctx, DB, alice); err != sql.ErrNoRows {
+		t.Fatalf("expected no sessions left, got %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Barsenick/calculator/pkg/client"
+)
+
+type Share = client.Share
+
+type ShareRequest = client.ShareRequest
+
+type ShareList = client.ShareList
+
+type SharedExpression = client.SharedExpression
+
+func createSharesTable(ctx context.Context, DB *sql.DB) error {
+	// expires is 0 for links which never expire
+	const sharesTable = `
+	CREATE TABLE IF NOT EXISTS shares(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		expressionID INTEGER,
+		hash TEXT UNIQUE,
+		createdBy INTEGER,
+		created INTEGER,
+		expires INTEGER DEFAULT 0,
+		FOREIGN KEY(expressionID) REFERENCES expressions(id),
+		FOREIGN KEY(createdBy) REFERENCES users(id)
+	);`
+
+	_, err := DB.ExecContext(ctx, sharesTable)
+	return err
+}
+
+// insertShare stores a hash of the token of the share, which is only
+// returned now.
+func insertShare(ctx context.Context, DB *sql.DB, expressionID string, createdBy int64, req ShareRequest) (Share, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Share{}, err
+	}
+
+	share := Share{ExpressionID: expressionID, Created: time.Now().Unix(), Expires: req.Expires, Token: token}
+	result, err := DB.ExecContext(ctx, `
+	INSERT INTO shares (expressionID, hash, createdBy, created, expires) values ($1, $2, $3, $4, $5)
+	`, expressionID, hashSecret(token), createdBy, share.Created, share.Expires)
+	if err != nil {
+		return Share{}, err
+	}
+	share.ID, err = result.LastInsertId()
+	return share, err
+}
+
+// getShares returns the shares of the expression which haven't expired.
+func getShares(ctx context.Context, DB *sql.DB, expressionID string) ([]Share, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT id, expressionID, COALESCE((SELECT login FROM users WHERE users.id = shares.createdBy), ''), created, expires FROM shares
+	WHERE expressionID = ? AND (expires = 0 OR expires > ?) ORDER BY id`, expressionID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var share Share
+		if err := rows.Scan(&share.ID, &share.ExpressionID, &share.CreatedBy, &share.Created, &share.Expires); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func deleteShare(ctx context.Context, DB *sql.DB, expressionID, id string) (bool, error) {
+	result, err := DB.ExecContext(ctx, "DELETE FROM shares WHERE id = $1 AND expressionID = $2", id, expressionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// selectSharedExpression returns sql.ErrNoRows unless the token belongs to a
+// share which hasn't been revoked or expired.
+func selectSharedExpression(ctx context.Context, DB *sql.DB, token string) (SharedExpression, error) {
+	var id string
+	err := DB.QueryRowContext(ctx, "SELECT expressionID FROM shares WHERE hash = $1 AND (expires = 0 OR expires > $2)", hashSecret(token), time.Now().Unix()).Scan(&id)
+	if err != nil {
+		return SharedExpression{}, err
+	}
+
+	expr, err := selectExpression(ctx, DB, id)
+	if err != nil {
+		return SharedExpression{}, err
+	}
+	trace, err := selectTrace(ctx, DB, id)
+	if err != nil {
+		return SharedExpression{}, err
+	}
+	if trace == nil {
+		trace = []TraceStep{}
+	}
+
+	return SharedExpression{
+		Status:   expr.Status,
+		Result:   expr.Result,
+		Source:   expr.Source,
+		Created:  expr.Created,
+		Finished: expr.Finished,
+		Trace:    trace,
+	}, nil
+}
+
+// sharedExpression loads the expression of the path for sharing it, which
+// its creator and the admins of its workspace may do. If not, the error is
+// already written to w.
+func sharedExpression(ctx context.Context, w http.ResponseWriter, r *http.Request, uid int64) (Expression, bool) {
+	expr, ok := workspaceExpression(ctx, w, r, uid, WorkspaceMember)
+	if !ok {
+		return expr, false
+	}
+	if expr.OwnerID != uid {
+		if _, ok := requireRole(ctx, w, expr.WorkspaceID, uid, WorkspaceAdmin, "expression not found"); !ok {
+			return expr, false
+		}
+	}
+	return expr, true
+}
+
+// ApiSharesHandler lists the share links of the expression or creates one.
+func ApiSharesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		expr, ok := workspaceExpression(ctx, w, r, uid, WorkspaceViewer)
+		if !ok {
+			return
+		}
+		shares, err := getShares(ctx, DB, expr.ID)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		json, err := json.Marshal(ShareList{Shares: shares})
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		fmt.Fprint(w, string(json))
+		return
+	}
+
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+	if req.Expires != 0 && req.Expires <= time.Now().Unix() {
+		generateErrorResponse(w, "expires is in the past", http.StatusBadRequest)
+		return
+	}
+
+	expr, ok := sharedExpression(ctx, w, r, uid)
+	if !ok {
+		return
+	}
+
+	share, err := insertShare(ctx, DB, expr.ID, uid, req)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if user, err := selectUserByID(ctx, DB, uid); err == nil {
+		share.CreatedBy = user.Name
+	}
+	share.URL = publicURL() + "/share/" + url.PathEscape(share.Token)
+
+	json, err := json.Marshal(share)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(json))
+}
+
+func ApiRevokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	expr, ok := sharedExpression(ctx, w, r, uid)
+	if !ok {
+		return
+	}
+
+	deleted, err := deleteShare(ctx, DB, expr.ID, r.PathValue("share"))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !deleted {
+		generateErrorResponse(w, "share not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SharePageHandler shows the expression of a share link to anyone, as a
+// read-only page or, with ?format=json or "Accept: application/json", as a
+// SharedExpression.
+func SharePageHandler(w http.ResponseWriter, r *http.Request) {
+	// the link is the secret, so it is neither cached, indexed nor sent
+	// along to the pages linked from here
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	asJSON := r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+
+	expr, err := selectSharedExpression(r.Context(), DB, r.PathValue("token"))
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		internalError(w, err)
+		return
+	}
+
+	if asJSON {
+		if !found {
+			generateErrorResponse(w, "share not found", http.StatusNotFound)
+			return
+		}
+		json, err := json.Marshal(expr)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(json))
+		return
+	}
+
+	tmpl, err := template.ParseFiles("../../html_templates/html/share.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Found      bool
+		Expression SharedExpression
+		Result     string
+	}
+	if found {
+		data.Found = true
+		data.Expression = expr
+		data.Result = trimResult(expr.Result)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// trimResult removes the trailing zeros of a numeric result like the
+// expression page does.
+func trimResult(result string) string {
+	if _, err := strconv.ParseFloat(result, 64); err != nil || !strings.Contains(result, ".") {
+		return result
+	}
+	return strings.TrimSuffix(strings.TrimRight(result, "0"), ".")
+}
@@ -0,0 +1,161 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShares(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	token := func(name string) (int64, string) {
+		uid, err := insertUser(ctx, DB, &User{Name: name, Password: "hash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uid, s.Token
+	}
+	aliceID, alice := token("alice")
+	_, bob := token("bob")
+	_, carol := token("carol")
+
+	handler := NewRouter()
+	request := func(method, path, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			withBearer(r, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// bob is a member and carol an admin of the workspace of alice
+	w := request(http.MethodPost, "/api/v1/workspaces", alice, `{"name": "Team"}`)
+	var ws Workspace
+	if err := json.Unmarshal(w.Body.Bytes(), &ws); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("unexpected workspace %d %s", w.Code, w.Body)
+	}
+	for login, role := range map[string]string{bob: WorkspaceMember, carol: WorkspaceAdmin} {
+		invite, err := insertInvite(ctx, DB, ws.ID, aliceID, InviteRequest{Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := request(http.MethodPost, "/api/v1/invites/accept", login, `{"token": "`+invite.Token+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("unexpected answer %d %s", w.Code, w.Body)
+		}
+	}
+
+	expr := Expression{Status: "201", Result: "pending", Source: "2+2*2", Label: "secret label", OwnerID: aliceID, WorkspaceID: ws.ID}
+	id, err := insertExpression(ctx, DB, &expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr.ID = fmt.Sprint(id)
+	expr.Status, expr.Result, expr.Finished = "200", "6.000000", time.Now().Unix()
+	expr.Trace = []TraceStep{{Operation: "*", Arg1: 2, Arg2: 2, Result: 4}, {Operation: "+", Arg1: 2, Arg2: 4, Result: 6}}
+	if _, err := modifyExpression(ctx, DB, &expr); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateExpressionAnnotations(ctx, DB, &expr); err != nil {
+		t.Fatal(err)
+	}
+	shares := "/api/v1/expressions/" + expr.ID + "/shares"
+
+	w = request(http.MethodGet, "/api/v1/expressions/"+expr.ID, bob, "")
+	var got Expression
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got.Trace) != 2 || got.Trace[1] != expr.Trace[1] {
+		t.Fatalf("expected the trace, got %d %s", w.Code, w.Body)
+	}
+
+	// only the creator of the expression and the admins share it
+	if w := request(http.MethodPost, shares, bob, `{}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected members not to share the expressions of others, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, shares, alice, fmt.Sprintf(`{"expires": %d}`, time.Now().Add(-time.Hour).Unix())); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an expiry in the past to be refused, got %d", w.Code)
+	}
+	t.Setenv("PUBLIC_URL", "")
+	w = request(http.MethodPost, shares, alice, `{}`)
+	var share Share
+	if err := json.Unmarshal(w.Body.Bytes(), &share); err != nil || w.Code != http.StatusCreated || share.Token == "" || share.URL != "/share/"+share.Token {
+		t.Fatalf("unexpected share %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodPost, shares, carol, `{}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected admins to share, got %d", w.Code)
+	}
+
+	w = request(http.MethodGet, shares, bob, "")
+	var list ShareList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Shares) != 2 || list.Shares[0].Token != "" || list.Shares[0].CreatedBy != "alice" {
+		t.Fatalf("unexpected shares %d %s", w.Code, w.Body)
+	}
+
+	// the link works without logging in and keeps the label private
+	w = request(http.MethodGet, "/share/"+share.Token+"?format=json", "", "")
+	var shared SharedExpression
+	if err := json.Unmarshal(w.Body.Bytes(), &shared); err != nil || w.Code != http.StatusOK || shared.Result != "6.000000" || shared.Source != "2+2*2" || len(shared.Trace) != 2 {
+		t.Fatalf("unexpected shared expression %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "secret label") || w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Fatalf("expected the label to stay private, got %s", w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/share/"+share.Token, nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"trace":[`) {
+		t.Fatalf("expected JSON for Accept: application/json, got %d %s", w.Code, w.Body)
+	}
+
+	expired, err := insertShare(ctx, DB, expr.ID, aliceID, ShareRequest{Expires: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{expired.Token, "unknown"} {
+		if w := request(http.MethodGet, "/share/"+token+"?format=json", "", ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", token, w.Code)
+		}
+	}
+
+	if w := request(http.MethodDelete, fmt.Sprintf("%s/%d", shares, share.ID), bob, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected members not to revoke, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, fmt.Sprintf("%s/%d", shares, share.ID), alice, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected alice to revoke, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/share/"+share.Token+"?format=json", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the revoked link to stop working, got %d", w.Code)
+	}
+
+	// running the expression again starts a new trace
+	if _, err := resetExpression(ctx, DB, &expr); err != nil {
+		t.Fatal(err)
+	}
+	if trace, err := selectTrace(ctx, DB, expr.ID); err != nil || trace != nil {
+		t.Fatalf("expected the trace to be reset, got %v, %v", trace, err)
+	}
+
+	if err := deleteExpression(ctx, DB, expr.ID); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM shares WHERE expressionID = $1", expr.ID).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("expected the shares to be deleted with the expression, %d are left", n)
+	}
+	if _, err := selectExpression(ctx, DB, expr.ID); err != sql.ErrNoRows {
+		t.Fatalf("expected the expression to be gone, got %v", err)
+	}
+}
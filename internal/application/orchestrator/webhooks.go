@@ -0,0 +1,452 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Calculator-Signature"
+	EventHeader     = "X-Calculator-Event"
+)
+
+var (
+	ErrInvalidWebhookURL = errors.New("webhook url must be an absolute http or https url")
+	ErrPrivateWebhookURL = errors.New("webhooks can't be delivered to loopback, private or link-local addresses")
+
+	// WebhookAttempts is how many times a delivery is tried before giving up,
+	// the pause between the attempts starts at WebhookBackoff and doubles.
+	WebhookAttempts = 5
+	WebhookBackoff  = time.Second
+
+	// WebhookAllowPrivate lets webhooks reach loopback, private and
+	// link-local addresses, e.g. receivers next to the server. Otherwise
+	// anyone could make the server probe its own network and read the
+	// answers from the deliveries.
+	WebhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// a proxy would be dialed instead of the receiver
+			Proxy: nil,
+			// the address is checked after resolving the host, so that a
+			// name can't point somewhere else than it did when it was checked
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookAddress}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		// a redirect could lead anywhere, receivers answer themselves
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+type Webhook struct {
+	ID      int64  `json:"id"`
+	URL     string `json:"url"`
+	OwnerID int64  `json:"-"`
+}
+
+type WebhookRequest struct {
+	URL string `json:"url"`
+}
+
+type WebhooksResponse struct {
+	Secret   string    `json:"secret"`
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type WebhookDelivery struct {
+	ID           int64  `json:"id"`
+	ExpressionID string `json:"expression_id"`
+	URL          string `json:"url"`
+	Attempt      int    `json:"attempt"`
+	StatusCode   int    `json:"status_code"`
+	Error        string `json:"error,omitempty"`
+	Created      int64  `json:"created"`
+}
+
+type WebhookDeliveries struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+func createWebhooksTables(ctx context.Context, DB *sql.DB) error {
+	const webhooksTable = `
+	CREATE TABLE IF NOT EXISTS webhooks(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ownerID TEXT,
+		url TEXT,
+		FOREIGN KEY(ownerID) REFERENCES users(id)
+	);`
+
+	const deliveriesTable = `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		expressionID INTEGER,
+		url TEXT,
+		attempt INTEGER,
+		statusCode INTEGER,
+		error TEXT,
+		created INTEGER,
+		FOREIGN KEY(expressionID) REFERENCES expressions(id)
+	);`
+
+	if _, err := DB.ExecContext(ctx, webhooksTable); err != nil {
+		return err
+	}
+
+	if _, err := DB.ExecContext(ctx, deliveriesTable); err != nil {
+		return err
+	}
+
+	return addColumnIfMissing(ctx, DB, "users", "webhookSecret", "TEXT")
+}
+
+// validateWebhookURL refuses the urls which can't work. Names are only
+// resolved when delivering, see checkWebhookAddress.
+func validateWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	if WebhookAllowPrivate {
+		return nil
+	}
+	if host := u.Hostname(); host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateWebhookURL
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && privateIP(ip) {
+		return ErrPrivateWebhookURL
+	}
+	return nil
+}
+
+// privateIP reports whether ip belongs to the server or its network rather
+// than to the internet.
+func privateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 0 {
+		return true
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// checkWebhookAddress is the Control of the dialer of webhookClient, which
+// gets the resolved address.
+func checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	if WebhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+		return ErrPrivateWebhookURL
+	}
+	return nil
+}
+
+func insertWebhook(ctx context.Context, DB *sql.DB, hook *Webhook) (int64, error) {
+	result, err := DB.ExecContext(ctx, "INSERT INTO webhooks (ownerID, url) values ($1, $2)", hook.OwnerID, hook.URL)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func deleteWebhook(ctx context.Context, DB *sql.DB, id string, ownerID int64) (int64, error) {
+	result, err := DB.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1 AND ownerID = $2", id, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func getUserWebhooks(ctx context.Context, DB *sql.DB, userID int64) ([]Webhook, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT id, url, ownerID FROM webhooks WHERE ownerID = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.OwnerID); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, rows.Err()
+}
+
+// userWebhookSecret returns the key the user's deliveries are signed with,
+// creating it on first use.
+func userWebhookSecret(ctx context.Context, DB *sql.DB, userID int64) (string, error) {
+	var secret sql.NullString
+	err := DB.QueryRowContext(ctx, "SELECT webhookSecret FROM users WHERE id = $1", userID).Scan(&secret)
+	if err != nil {
+		return "", err
+	}
+	if secret.Valid && secret.String != "" {
+		return secret.String, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// don't overwrite a secret another request has just created
+	_, err = DB.ExecContext(ctx, "UPDATE users SET webhookSecret = $1 WHERE id = $2 AND webhookSecret IS NULL", hex.EncodeToString(b), userID)
+	if err != nil {
+		return "", err
+	}
+	err = DB.QueryRowContext(ctx, "SELECT webhookSecret FROM users WHERE id = $1", userID).Scan(&secret)
+	return secret.String, err
+}
+
+func insertWebhookDelivery(ctx context.Context, DB *sql.DB, d *WebhookDelivery) error {
+	_, err := DB.ExecContext(ctx, `
+	INSERT INTO webhook_deliveries (expressionID, url, attempt, statusCode, error, created) values ($1, $2, $3, $4, $5, $6)
+	`, d.ExpressionID, d.URL, d.Attempt, d.StatusCode, d.Error, d.Created)
+	return err
+}
+
+func getWebhookDeliveries(ctx context.Context, DB *sql.DB, expressionID string) ([]WebhookDelivery, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT id, expressionID, url, attempt, statusCode, COALESCE(error, ''), created FROM webhook_deliveries
+	WHERE expressionID = ? ORDER BY id`, expressionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.ExpressionID, &d.URL, &d.Attempt, &d.StatusCode, &d.Error, &d.Created); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Sign returns the value of the signature header for the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks sends the finished expression to its callback url and to the
+// webhooks registered by its owner.
+func notifyWebhooks(expr Expression, callbackURL string) {
+	ctx := context.TODO()
+
+	hooks, err := getUserWebhooks(ctx, DB, expr.OwnerID)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	urls := make([]string, 0, len(hooks)+1)
+	if callbackURL != "" {
+		urls = append(urls, callbackURL)
+	}
+	for _, hook := range hooks {
+		urls = append(urls, hook.URL)
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	secret, err := userWebhookSecret(ctx, DB, expr.OwnerID)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	body, err := json.Marshal(expr)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	for _, u := range urls {
+		go deliverWebhook(ctx, DB, u, secret, expr.ID, body)
+	}
+}
+
+// deliverWebhook posts the body to the url until it is accepted or the
+// attempts run out, logging every attempt.
+func deliverWebhook(ctx context.Context, DB *sql.DB, target, secret, expressionID string, body []byte) bool {
+	backoff := WebhookBackoff
+	for attempt := 1; attempt <= WebhookAttempts; attempt++ {
+		d := WebhookDelivery{ExpressionID: expressionID, URL: target, Attempt: attempt, Created: time.Now().Unix()}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set(EventHeader, "expression.finished")
+			request.Header.Set(SignatureHeader, Sign(secret, body))
+
+			response, err := webhookClient.Do(request)
+			if err != nil {
+				d.Error = err.Error()
+			} else {
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+				d.StatusCode = response.StatusCode
+				if response.StatusCode < 200 || response.StatusCode > 299 {
+					d.Error = response.Status
+				}
+			}
+		}
+
+		if err := insertWebhookDelivery(ctx, DB, &d); err != nil {
+			log.Println(err.Error())
+		}
+		if d.Error == "" {
+			return true
+		}
+		if attempt == WebhookAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	log.Printf("Giving up delivering expression %s to %s\n", expressionID, target)
+	return false
+}
+
+func ApiWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	// the secret signs the deliveries, so it is managed like the other
+	// credentials
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		secret, err := userWebhookSecret(ctx, DB, uid)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		hooks, err := getUserWebhooks(ctx, DB, uid)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		json, err := json.Marshal(WebhooksResponse{Secret: secret, Webhooks: hooks})
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		fmt.Fprint(w, string(json))
+
+	case http.MethodPost:
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhookURL(req.URL); err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hook := Webhook{URL: req.URL, OwnerID: uid}
+		id, err := insertWebhook(ctx, DB, &hook)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		hook.ID = id
+		json, err := json.Marshal(hook)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, string(json))
+
+	}
+}
+
+func ApiDeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := deleteWebhook(context.TODO(), DB, r.PathValue("id"), uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if n == 0 {
+		generateErrorResponse(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ApiWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	expr, ok := workspaceExpression(ctx, w, r, uid, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	deliveries, err := getWebhookDeliveries(ctx, DB, expr.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(WebhookDeliveries{Deliveries: deliveries})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
@@ -0,0 +1,208 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliverWebhook(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	WebhookBackoff = time.Millisecond
+	allowPrivateWebhooks(t)
+
+	const secret = "test-secret"
+	body := []byte(`{"id":"1","status":"200","result":"4.000000"}`)
+
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := io.ReadAll(r.Body)
+		if string(got) != string(body) {
+			t.Errorf("unexpected body %s", got)
+		}
+		if sig := r.Header.Get(SignatureHeader); sig != Sign(secret, got) {
+			t.Errorf("unexpected signature %q", sig)
+		}
+		// fail the first attempt to exercise the retries
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	if !deliverWebhook(context.Background(), db, receiver.URL, secret, "1", body) {
+		t.Fatal("expected the delivery to succeed")
+	}
+
+	deliveries, err := getWebhookDeliveries(context.Background(), db, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 logged attempts, got %v", deliveries)
+	}
+	if deliveries[0].StatusCode != http.StatusServiceUnavailable || deliveries[0].Error == "" {
+		t.Fatalf("expected the first attempt to fail, got %+v", deliveries[0])
+	}
+	if deliveries[1].StatusCode != http.StatusOK || deliveries[1].Error != "" {
+		t.Fatalf("expected the second attempt to succeed, got %+v", deliveries[1])
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	WebhookBackoff = time.Millisecond
+	allowPrivateWebhooks(t)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	if deliverWebhook(context.Background(), db, receiver.URL, "secret", "2", []byte("{}")) {
+		t.Fatal("expected the delivery to fail")
+	}
+
+	deliveries, err := getWebhookDeliveries(context.Background(), db, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != WebhookAttempts {
+		t.Fatalf("expected %v logged attempts, got %v", WebhookAttempts, len(deliveries))
+	}
+}
+
+// allowPrivateWebhooks lets the webhooks reach the receivers of httptest,
+// which listen on loopback.
+func allowPrivateWebhooks(t *testing.T) {
+	WebhookAllowPrivate = true
+	t.Cleanup(func() { WebhookAllowPrivate = false })
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	WebhookBackoff = time.Millisecond
+
+	for _, u := range []string{"http://localhost/hook", "http://127.0.0.1:8080/internal/task", "http://10.0.0.1/", "http://169.254.169.254/latest/meta-data", "http://[::1]/", "http://0.0.0.0/"} {
+		if err := validateWebhookURL(u); err != ErrPrivateWebhookURL {
+			t.Errorf("%s: expected %v, got %v", u, ErrPrivateWebhookURL, err)
+		}
+	}
+	if err := validateWebhookURL("https://example.com/hook"); err != nil {
+		t.Fatalf("expected a public url to be accepted, got %v", err)
+	}
+
+	// names resolving to loopback are refused when dialing
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+
+	if deliverWebhook(context.Background(), db, receiver.URL, "secret", "3", []byte("{}")) {
+		t.Fatal("expected the delivery to loopback to fail")
+	}
+	if calls.Load() != 0 {
+		t.Fatal("expected the receiver on loopback not to be called")
+	}
+	deliveries, err := getWebhookDeliveries(context.Background(), db, "3")
+	if err != nil || len(deliveries) == 0 || !strings.Contains(deliveries[0].Error, ErrPrivateWebhookURL.Error()) {
+		t.Fatalf("expected the deliveries to be refused, got %+v, %v", deliveries, err)
+	}
+}
+
+func TestWebhookRedirect(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	WebhookBackoff = time.Millisecond
+	allowPrivateWebhooks(t)
+
+	var calls atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer target.Close()
+	receiver := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer receiver.Close()
+
+	if deliverWebhook(context.Background(), db, receiver.URL, "secret", "4", []byte("{}")) {
+		t.Fatal("expected a redirect to fail the delivery")
+	}
+	if calls.Load() != 0 {
+		t.Fatal("expected the redirect not to be followed")
+	}
+}
+
+func TestWebhooksHandler(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	token := func(name string) string {
+		uid, err := insertUser(ctx, DB, &User{Name: name, Password: "hash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Token
+	}
+	alice, bob := token("alice"), token("bob")
+
+	handler := NewRouter()
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), token))
+		return w
+	}
+
+	w := request(http.MethodPost, "/api/v1/webhooks", alice, `{"url": "https://example.com/hook"}`)
+	var hook Webhook
+	if err := json.Unmarshal(w.Body.Bytes(), &hook); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("unexpected webhook %d %s", w.Code, w.Body)
+	}
+	path := fmt.Sprintf("/api/v1/webhooks/%d", hook.ID)
+
+	if w := request(http.MethodDelete, path, bob, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the webhooks of others not to be found, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, path, alice, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected the webhook to be removed, got %d %s", w.Code, w.Body)
+	}
+	w = request(http.MethodGet, "/api/v1/webhooks", alice, "")
+	var list WebhooksResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK || len(list.Webhooks) != 0 {
+		t.Fatalf("expected no webhooks, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodDelete, path, alice, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a removed webhook not to be found, got %d", w.Code)
+	}
+}
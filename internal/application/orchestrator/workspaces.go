@@ -0,0 +1,1120 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Barsenick/calculator/pkg/client"
+)
+
+type Workspace = client.Workspace
+
+type WorkspaceList = client.WorkspaceList
+
+type WorkspaceRequest = client.WorkspaceRequest
+
+type Member = client.Member
+
+type MemberUpdate = client.MemberUpdate
+
+type WorkspaceSettings = client.WorkspaceSettings
+
+type InviteRequest = client.InviteRequest
+
+type Invite = client.Invite
+
+type InviteList = client.InviteList
+
+type InviteAcceptRequest = client.InviteAcceptRequest
+
+const (
+	WorkspaceOwner  = client.WorkspaceOwner
+	WorkspaceAdmin  = client.WorkspaceAdmin
+	WorkspaceMember = client.WorkspaceMember
+	WorkspaceViewer = client.WorkspaceViewer
+)
+
+// workspaceRoles ranks the roles, each role can do what the lower ones can.
+var workspaceRoles = map[string]int{
+	WorkspaceViewer: 1,
+	WorkspaceMember: 2,
+	WorkspaceAdmin:  3,
+	WorkspaceOwner:  4,
+}
+
+const (
+	// WorkspaceHeader selects the workspace of an API request, the web pages
+	// keep the one chosen in the switcher in WorkspaceCookie. Without either,
+	// requests go to the personal workspace of the user.
+	WorkspaceHeader = "X-Workspace-ID"
+	WorkspaceCookie = "workspace"
+
+	personalWorkspaceName  = "Personal"
+	MaxWorkspaceNameLength = 100
+	WorkspaceInviteTTL     = 7 * 24 * time.Hour
+)
+
+// Results have DefaultPrecision decimal places unless the workspace or the
+// request asks for another precision, -1 meaning as many as needed.
+const (
+	DefaultPrecision = 6
+	MaxPrecision     = 15
+
+	// settingPrecision is stored next to the timings in workspace_settings
+	settingPrecision = "PRECISION"
+)
+
+var (
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	ErrPersonalWorkspace = errors.New("personal workspaces can't be shared, left or deleted")
+	ErrLastOwner         = errors.New("the workspace needs an owner, make someone else owner first")
+	ErrAlreadyMember     = errors.New("already a member of the workspace")
+	ErrInvalidInvite     = errors.New("the invite is invalid, used or expired")
+	ErrInviteEmail       = errors.New("the invite is for another email")
+	ErrInvalidPrecision  = fmt.Errorf("precision must be between -1 and %d", MaxPrecision)
+)
+
+func createWorkspacesTables(ctx context.Context, DB *sql.DB) error {
+	// personalUserID is the user of a personal workspace, NULL for the
+	// shared ones
+	const workspacesTable = `
+	CREATE TABLE IF NOT EXISTS workspaces(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		personalUserID INTEGER UNIQUE,
+		created INTEGER,
+		FOREIGN KEY(personalUserID) REFERENCES users(id)
+	);`
+
+	const membersTable = `
+	CREATE TABLE IF NOT EXISTS workspace_members(
+		workspaceID INTEGER,
+		userID INTEGER,
+		role TEXT NOT NULL,
+		joined INTEGER,
+		PRIMARY KEY(workspaceID, userID),
+		FOREIGN KEY(workspaceID) REFERENCES workspaces(id),
+		FOREIGN KEY(userID) REFERENCES users(id)
+	);`
+
+	const settingsTable = `
+	CREATE TABLE IF NOT EXISTS workspace_settings(
+		workspaceID INTEGER,
+		name TEXT,
+		value INTEGER,
+		PRIMARY KEY(workspaceID, name),
+		FOREIGN KEY(workspaceID) REFERENCES workspaces(id)
+	);`
+
+	const invitesTable = `
+	CREATE TABLE IF NOT EXISTS workspace_invites(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		workspaceID INTEGER,
+		hash TEXT UNIQUE,
+		role TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		createdBy INTEGER,
+		created INTEGER,
+		expires INTEGER,
+		used INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(workspaceID) REFERENCES workspaces(id)
+	);`
+
+	for _, table := range []string{workspacesTable, membersTable, settingsTable, invitesTable} {
+		if _, err := DB.ExecContext(ctx, table); err != nil {
+			return err
+		}
+	}
+
+	return migrateToWorkspaces(ctx, DB)
+}
+
+// migrateToWorkspaces moves the expressions and batches of databases from
+// before workspaces to the personal workspaces of their owners.
+func migrateToWorkspaces(ctx context.Context, DB *sql.DB) error {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT DISTINCT ownerID FROM expressions WHERE workspaceID IS NULL AND ownerID IS NOT NULL
+	UNION SELECT DISTINCT ownerID FROM batches WHERE workspaceID IS NULL AND ownerID IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	var owners []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		owners = append(owners, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range owners {
+		if _, err := personalWorkspace(ctx, DB, id); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"expressions", "batches"} {
+		q := fmt.Sprintf("UPDATE %[1]s SET workspaceID = (SELECT id FROM workspaces WHERE personalUserID = %[1]s.ownerID) WHERE workspaceID IS NULL", table)
+		if _, err := DB.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// personalWorkspace returns the personal workspace of the user, which is
+// created when it is first needed.
+func personalWorkspace(ctx context.Context, DB *sql.DB, userID int64) (int64, error) {
+	var id int64
+	err := DB.QueryRowContext(ctx, "SELECT id FROM workspaces WHERE personalUserID = $1", userID).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// concurrent requests of a new user mustn't create two of them
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO workspaces (name, personalUserID, created) values ($1, $2, $3) ON CONFLICT(personalUserID) DO NOTHING", personalWorkspaceName, userID, now); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM workspaces WHERE personalUserID = $1", userID).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO workspace_members (workspaceID, userID, role, joined) values ($1, $2, $3, $4)", id, userID, WorkspaceOwner, now); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func insertWorkspace(ctx context.Context, DB *sql.DB, name string, ownerID int64) (Workspace, error) {
+	ws := Workspace{Name: name, Role: WorkspaceOwner, Created: time.Now().Unix()}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return ws, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO workspaces (name, created) values ($1, $2)", ws.Name, ws.Created)
+	if err != nil {
+		return ws, err
+	}
+	if ws.ID, err = result.LastInsertId(); err != nil {
+		return ws, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO workspace_members (workspaceID, userID, role, joined) values ($1, $2, $3, $4)", ws.ID, ownerID, WorkspaceOwner, ws.Created); err != nil {
+		return ws, err
+	}
+
+	return ws, tx.Commit()
+}
+
+func getUserWorkspaces(ctx context.Context, DB *sql.DB, userID int64) ([]Workspace, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT w.id, w.name, w.personalUserID IS NOT NULL, m.role, w.created FROM workspace_members m
+	JOIN workspaces w ON w.id = m.workspaceID
+	WHERE m.userID = ? ORDER BY w.personalUserID IS NULL, w.name COLLATE NOCASE, w.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var ws Workspace
+		if err := rows.Scan(&ws.ID, &ws.Name, &ws.Personal, &ws.Role, &ws.Created); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+func getWorkspaceMembers(ctx context.Context, DB *sql.DB, workspaceID int64) ([]Member, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT m.userID, u.login, m.role, m.joined FROM workspace_members m
+	JOIN users u ON u.id = m.userID
+	WHERE m.workspaceID = ? ORDER BY m.joined, m.userID`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Login, &m.Role, &m.Joined); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// membership is the role of a user in a workspace.
+type membership struct {
+	WorkspaceID int64
+	UserID      int64
+	Role        string
+	Name        string
+	Personal    bool
+	Created     int64
+}
+
+// can tells whether the member has at least role.
+func (m membership) can(role string) bool {
+	return workspaceRoles[m.Role] >= workspaceRoles[role]
+}
+
+func (m membership) workspace() Workspace {
+	return Workspace{ID: m.WorkspaceID, Name: m.Name, Personal: m.Personal, Role: m.Role, Created: m.Created}
+}
+
+// selectMembership returns sql.ErrNoRows if the user isn't a member of the
+// workspace.
+func selectMembership(ctx context.Context, DB *sql.DB, workspaceID, userID int64) (membership, error) {
+	m := membership{WorkspaceID: workspaceID, UserID: userID}
+	err := DB.QueryRowContext(ctx, `
+	SELECT m.role, w.name, w.personalUserID IS NOT NULL, w.created FROM workspace_members m
+	JOIN workspaces w ON w.id = m.workspaceID
+	WHERE m.workspaceID = $1 AND m.userID = $2`, workspaceID, userID).Scan(&m.Role, &m.Name, &m.Personal, &m.Created)
+	return m, err
+}
+
+// activeWorkspace returns the membership of the user in the workspace the
+// request is made for, see WorkspaceHeader. A workspace cookie of a
+// workspace the user has left falls back to the personal workspace, an
+// unknown header is ErrWorkspaceNotFound.
+func activeWorkspace(ctx context.Context, r *http.Request, userID int64) (membership, error) {
+	if header := r.Header.Get(WorkspaceHeader); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			return membership{}, ErrWorkspaceNotFound
+		}
+		m, err := selectMembership(ctx, DB, id, userID)
+		if err == sql.ErrNoRows {
+			return m, ErrWorkspaceNotFound
+		}
+		return m, err
+	}
+
+	if cookie, err := r.Cookie(WorkspaceCookie); err == nil {
+		if id, err := strconv.ParseInt(cookie.Value, 10, 64); err == nil {
+			if m, err := selectMembership(ctx, DB, id, userID); err != sql.ErrNoRows {
+				return m, err
+			}
+		}
+	}
+
+	id, err := personalWorkspace(ctx, DB, userID)
+	if err != nil {
+		return membership{}, err
+	}
+	return selectMembership(ctx, DB, id, userID)
+}
+
+// requireWorkspace is requireUser for the requests working in the active
+// workspace, in which the user needs at least role. If the user can't, the
+// error is already written to w.
+func requireWorkspace(w http.ResponseWriter, r *http.Request, role string) (membership, bool) {
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return membership{}, false
+	}
+
+	m, err := activeWorkspace(r.Context(), r, uid)
+	if errors.Is(err, ErrWorkspaceNotFound) {
+		generateErrorResponse(w, err.Error(), http.StatusNotFound)
+		return m, false
+	}
+	if err != nil {
+		internalError(w, err)
+		return m, false
+	}
+	if !m.can(role) {
+		generateErrorResponse(w, fmt.Sprintf("the %s role is required in this workspace", role), http.StatusForbidden)
+		return m, false
+	}
+	return m, true
+}
+
+// requireRole makes sure the user has at least role in the workspace. Users
+// who aren't members get notFound, as if there was nothing to find.
+func requireRole(ctx context.Context, w http.ResponseWriter, workspaceID, userID int64, role, notFound string) (membership, bool) {
+	m, err := selectMembership(ctx, DB, workspaceID, userID)
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, notFound, http.StatusNotFound)
+		return m, false
+	}
+	if err != nil {
+		internalError(w, err)
+		return m, false
+	}
+	if !m.can(role) {
+		generateErrorResponse(w, fmt.Sprintf("the %s role is required in this workspace", role), http.StatusForbidden)
+		return m, false
+	}
+	return m, true
+}
+
+// pathWorkspace is requireRole for the workspace of the path.
+func pathWorkspace(w http.ResponseWriter, r *http.Request, role string) (membership, bool) {
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return membership{}, false
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		generateErrorResponse(w, ErrWorkspaceNotFound.Error(), http.StatusNotFound)
+		return membership{}, false
+	}
+	return requireRole(r.Context(), w, id, uid, role, ErrWorkspaceNotFound.Error())
+}
+
+// soleMemberWorkspaces returns the workspaces nobody but the user is a
+// member of.
+func soleMemberWorkspaces(ctx context.Context, DB *sql.DB, userID int64) ([]int64, error) {
+	rows, err := DB.QueryContext(ctx, `
+	SELECT workspaceID FROM workspace_members WHERE userID = $1
+	AND workspaceID NOT IN (SELECT workspaceID FROM workspace_members WHERE userID != $1)`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// deleteWorkspace removes the workspace with its expressions, after stopping
+// those which are pending.
+func deleteWorkspace(ctx context.Context, DB *sql.DB, id int64) error {
+	rows, err := DB.QueryContext(ctx, "SELECT id FROM expressions WHERE workspaceID = $1 AND status = '201'", id)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for rows.Next() {
+		var exprID string
+		if err := rows.Scan(&exprID); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, exprID)
+	}
+	rows.Close()
+	for _, exprID := range pending {
+		Running.Cancel(exprID)
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM webhook_deliveries WHERE expressionID IN (SELECT id FROM expressions WHERE workspaceID = $1)",
+		"DELETE FROM shares WHERE expressionID IN (SELECT id FROM expressions WHERE workspaceID = $1)",
+		"DELETE FROM expressions WHERE workspaceID = $1",
+		"DELETE FROM batches WHERE workspaceID = $1",
+		"DELETE FROM workspace_settings WHERE workspaceID = $1",
+		"DELETE FROM workspace_invites WHERE workspaceID = $1",
+		"DELETE FROM workspace_members WHERE workspaceID = $1",
+		"DELETE FROM workspaces WHERE id = $1",
+	} {
+		if _, err := tx.ExecContext(ctx, q, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// updateMemberRole changes the role of a member, or removes the member if
+// role is empty. The last owner can neither be demoted nor removed.
+func updateMemberRole(ctx context.Context, DB *sql.DB, workspaceID, userID int64, role string) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRowContext(ctx, "SELECT role FROM workspace_members WHERE workspaceID = $1 AND userID = $2", workspaceID, userID).Scan(&current); err != nil {
+		return err
+	}
+	if current == WorkspaceOwner && role != WorkspaceOwner {
+		var owners int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM workspace_members WHERE workspaceID = $1 AND role = $2", workspaceID, WorkspaceOwner).Scan(&owners); err != nil {
+			return err
+		}
+		if owners == 1 {
+			return ErrLastOwner
+		}
+	}
+
+	if role == "" {
+		_, err = tx.ExecContext(ctx, "DELETE FROM workspace_members WHERE workspaceID = $1 AND userID = $2", workspaceID, userID)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE workspace_members SET role = $1 WHERE workspaceID = $2 AND userID = $3", role, workspaceID, userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// workspaceConfig is what the settings of a workspace make of those of the
+// server.
+type workspaceConfig struct {
+	Timings   *Timings
+	Precision int
+}
+
+// selectWorkspaceConfig applies the settings of the workspace over those of
+// the server. The timeouts stay within those of the server, which admins
+// may have lowered since the workspace was set up.
+func selectWorkspaceConfig(ctx context.Context, DB *sql.DB, workspaceID int64) (workspaceConfig, error) {
+	server := CurrentTimings()
+	t := *server
+	cfg := workspaceConfig{Timings: &t, Precision: DefaultPrecision}
+
+	rows, err := DB.QueryContext(ctx, "SELECT name, value FROM workspace_settings WHERE workspaceID = $1", workspaceID)
+	if err != nil {
+		return cfg, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			name  string
+			value int64
+		)
+		if err := rows.Scan(&name, &value); err != nil {
+			return cfg, err
+		}
+		switch name {
+		case settingPrecision:
+			cfg.Precision = int(value)
+		case timingDefaultTimeout, timingMaxTimeout, timingMaxWait:
+			setTiming(&t, name, time.Duration(value)*time.Millisecond)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return cfg, err
+	}
+
+	t.MaxTimeout = min(t.MaxTimeout, server.MaxTimeout)
+	t.MaxWait = min(t.MaxWait, server.MaxWait)
+	t.DefaultTimeout = min(t.DefaultTimeout, t.MaxTimeout)
+	return cfg, nil
+}
+
+func (cfg workspaceConfig) settings() WorkspaceSettings {
+	return WorkspaceSettings{
+		DefaultTimeoutMS: cfg.Timings.DefaultTimeout.Milliseconds(),
+		MaxTimeoutMS:     cfg.Timings.MaxTimeout.Milliseconds(),
+		MaxWaitMS:        cfg.Timings.MaxWait.Milliseconds(),
+		Precision:        &cfg.Precision,
+	}
+}
+
+// setWorkspaceSettings stores the settings given in s.
+func setWorkspaceSettings(ctx context.Context, DB *sql.DB, workspaceID int64, s WorkspaceSettings) (workspaceConfig, error) {
+	cfg, err := selectWorkspaceConfig(ctx, DB, workspaceID)
+	if err != nil {
+		return cfg, err
+	}
+
+	server := CurrentTimings()
+	changed := map[string]int64{}
+	set := func(name, field string, ms int64, limit time.Duration) error {
+		if ms < 0 || time.Duration(ms)*time.Millisecond > limit {
+			return fmt.Errorf("%s must be between 1 and %d", field, limit.Milliseconds())
+		}
+		if ms > 0 {
+			changed[name] = ms
+			setTiming(cfg.Timings, name, time.Duration(ms)*time.Millisecond)
+		}
+		return nil
+	}
+	if err := set(timingDefaultTimeout, "default_timeout_ms", s.DefaultTimeoutMS, server.MaxTimeout); err != nil {
+		return cfg, err
+	}
+	if err := set(timingMaxTimeout, "max_timeout_ms", s.MaxTimeoutMS, server.MaxTimeout); err != nil {
+		return cfg, err
+	}
+	if err := set(timingMaxWait, "max_wait_ms", s.MaxWaitMS, server.MaxWait); err != nil {
+		return cfg, err
+	}
+	if cfg.Timings.DefaultTimeout > cfg.Timings.MaxTimeout {
+		return cfg, errors.New("the default timeout can't be longer than the maximum timeout")
+	}
+	if s.Precision != nil {
+		if *s.Precision < -1 || *s.Precision > MaxPrecision {
+			return cfg, ErrInvalidPrecision
+		}
+		changed[settingPrecision] = int64(*s.Precision)
+		cfg.Precision = *s.Precision
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return cfg, err
+	}
+	defer tx.Rollback()
+	for name, value := range changed {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO workspace_settings (workspaceID, name, value) VALUES ($1, $2, $3) ON CONFLICT(workspaceID, name) DO UPDATE SET value = excluded.value", workspaceID, name, value); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, tx.Commit()
+}
+
+// formatResult writes the result with the precision of its request.
+func formatResult(res float64, precision *int) string {
+	if precision == nil {
+		return strconv.FormatFloat(res, 'f', DefaultPrecision, 64)
+	}
+	return strconv.FormatFloat(res, 'f', *precision, 64)
+}
+
+// insertInvite stores a hash of the token of the invite, which is only
+// returned now.
+func insertInvite(ctx context.Context, DB *sql.DB, workspaceID, createdBy int64, req InviteRequest) (Invite, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Invite{}, err
+	}
+
+	now := time.Now()
+	invite := Invite{Role: req.Role, Email: req.Email, Created: now.Unix(), Expires: now.Add(WorkspaceInviteTTL).Unix(), Token: token}
+	result, err := DB.ExecContext(ctx, `
+	INSERT INTO workspace_invites (workspaceID, hash, role, email, createdBy, created, expires) values ($1, $2, $3, $4, $5, $6, $7)
+	`, workspaceID, hashSecret(token), invite.Role, invite.Email, createdBy, invite.Created, invite.Expires)
+	if err != nil {
+		return Invite{}, err
+	}
+	invite.ID, err = result.LastInsertId()
+	return invite, err
+}
+
+// getWorkspaceInvites returns the invites which can still be accepted.
+func getWorkspaceInvites(ctx context.Context, DB *sql.DB, workspaceID int64) ([]Invite, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT id, role, email, created, expires FROM workspace_invites WHERE workspaceID = ? AND used = 0 AND expires > ? ORDER BY id", workspaceID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		if err := rows.Scan(&invite.ID, &invite.Role, &invite.Email, &invite.Created, &invite.Expires); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func deleteInvite(ctx context.Context, DB *sql.DB, workspaceID int64, id string) (bool, error) {
+	result, err := DB.ExecContext(ctx, "DELETE FROM workspace_invites WHERE id = $1 AND workspaceID = $2 AND used = 0", id, workspaceID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// acceptInvite makes the user a member of the workspace of the invite and
+// uses the invite up.
+func acceptInvite(ctx context.Context, DB *sql.DB, token string, user User) (int64, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id, workspaceID int64
+		role, email     string
+	)
+	err = tx.QueryRowContext(ctx, "SELECT id, workspaceID, role, email FROM workspace_invites WHERE hash = $1 AND used = 0 AND expires > $2", hashSecret(token), time.Now().Unix()).
+		Scan(&id, &workspaceID, &role, &email)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidInvite
+	}
+	if err != nil {
+		return 0, err
+	}
+	if email != "" && !strings.EqualFold(email, user.Email) {
+		return 0, ErrInviteEmail
+	}
+
+	result, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO workspace_members (workspaceID, userID, role, joined) values ($1, $2, $3, $4)", workspaceID, user.ID, role, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrAlreadyMember
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE workspace_invites SET used = $1 WHERE id = $2", time.Now().Unix(), id); err != nil {
+		return 0, err
+	}
+
+	return workspaceID, tx.Commit()
+}
+
+// validWorkspaceName trims the name, which mustn't be empty or too long.
+func validWorkspaceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxWorkspaceNameLength {
+		return "", fmt.Errorf("name must be between 1 and %d characters long", MaxWorkspaceNameLength)
+	}
+	return name, nil
+}
+
+func ApiWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req WorkspaceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		name, err := validWorkspaceName(req.Name)
+		if err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ws, err := insertWorkspace(ctx, DB, name, uid)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+
+		json, err := json.Marshal(ws)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, string(json))
+		return
+	}
+
+	// the personal workspace is always listed, even before it is used
+	if _, err := personalWorkspace(ctx, DB, uid); err != nil {
+		internalError(w, err)
+		return
+	}
+	workspaces, err := getUserWorkspaces(ctx, DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(WorkspaceList{Workspaces: workspaces})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	role := WorkspaceViewer
+	switch r.Method {
+	case http.MethodPatch:
+		role = WorkspaceAdmin
+	case http.MethodDelete:
+		role = WorkspaceOwner
+	}
+	m, ok := pathWorkspace(w, r, role)
+	if !ok {
+		return
+	}
+	ws := m.workspace()
+
+	switch r.Method {
+	case http.MethodPatch:
+		var req WorkspaceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		name, err := validWorkspaceName(req.Name)
+		if err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := DB.ExecContext(ctx, "UPDATE workspaces SET name = $1 WHERE id = $2", name, ws.ID); err != nil {
+			internalError(w, err)
+			return
+		}
+		ws.Name = name
+
+	case http.MethodDelete:
+		if ws.Personal {
+			generateErrorResponse(w, ErrPersonalWorkspace.Error(), http.StatusConflict)
+			return
+		}
+		if err := deleteWorkspace(ctx, DB, ws.ID); err != nil {
+			internalError(w, err)
+			return
+		}
+		log.Printf("Request %s deleted the workspace %d\n", w.Header().Get(RequestIDHeader), ws.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	members, err := getWorkspaceMembers(ctx, DB, ws.ID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	ws.Members = members
+
+	json, err := json.Marshal(ws)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+// ApiWorkspaceMemberHandler changes the role of a member or removes it.
+// Everybody may leave, admins manage the members and only owners may touch
+// owners. The user of the request is also found under "me".
+func ApiWorkspaceMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	// the pages don't know the ID of their user, they leave with "me"
+	target := uid
+	if r.PathValue("user") != "me" {
+		id, err := strconv.ParseInt(r.PathValue("user"), 10, 64)
+		if err != nil {
+			generateErrorResponse(w, "member not found", http.StatusNotFound)
+			return
+		}
+		target = id
+	}
+
+	role := WorkspaceAdmin
+	if r.Method == http.MethodDelete && target == uid {
+		role = WorkspaceViewer
+	}
+	m, ok := pathWorkspace(w, r, role)
+	if !ok {
+		return
+	}
+	if m.Personal {
+		generateErrorResponse(w, ErrPersonalWorkspace.Error(), http.StatusConflict)
+		return
+	}
+
+	member, err := selectMembership(ctx, DB, m.WorkspaceID, target)
+	if err == sql.ErrNoRows {
+		generateErrorResponse(w, "member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	newRole := ""
+	if r.Method == http.MethodPatch {
+		var req MemberUpdate
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		if _, ok := workspaceRoles[req.Role]; !ok {
+			generateErrorResponse(w, fmt.Sprintf("role must be %s, %s, %s or %s", WorkspaceOwner, WorkspaceAdmin, WorkspaceMember, WorkspaceViewer), http.StatusBadRequest)
+			return
+		}
+		newRole = req.Role
+	}
+	if target != uid && (member.Role == WorkspaceOwner || newRole == WorkspaceOwner) && !m.can(WorkspaceOwner) {
+		generateErrorResponse(w, fmt.Sprintf("the %s role is required in this workspace", WorkspaceOwner), http.StatusForbidden)
+		return
+	}
+	if target == uid && !m.can(newRole) {
+		generateErrorResponse(w, "members can't raise their own role", http.StatusForbidden)
+		return
+	}
+
+	err = updateMemberRole(ctx, DB, m.WorkspaceID, target, newRole)
+	if errors.Is(err, ErrLastOwner) {
+		generateErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if newRole == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	members, err := getWorkspaceMembers(ctx, DB, m.WorkspaceID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	i := slices.IndexFunc(members, func(m Member) bool { return m.UserID == target })
+	if i < 0 {
+		generateErrorResponse(w, "member not found", http.StatusNotFound)
+		return
+	}
+	json, err := json.Marshal(members[i])
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+func ApiWorkspaceSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	role := WorkspaceViewer
+	if r.Method == http.MethodPatch {
+		role = WorkspaceAdmin
+	}
+	m, ok := pathWorkspace(w, r, role)
+	if !ok {
+		return
+	}
+
+	var (
+		cfg workspaceConfig
+		err error
+	)
+	if r.Method == http.MethodPatch {
+		var req WorkspaceSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+			return
+		}
+		if cfg, err = setWorkspaceSettings(ctx, DB, m.WorkspaceID, req); err != nil {
+			generateErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if cfg, err = selectWorkspaceConfig(ctx, DB, m.WorkspaceID); err != nil {
+		internalError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(cfg.settings())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
+
+// ApiWorkspaceInvitesHandler lists the pending invites of the workspace or
+// creates one. An invite with an email is sent there.
+func ApiWorkspaceInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	m, ok := pathWorkspace(w, r, WorkspaceAdmin)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		invites, err := getWorkspaceInvites(ctx, DB, m.WorkspaceID)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		json, err := json.Marshal(InviteList{Invites: invites})
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		fmt.Fprint(w, string(json))
+		return
+	}
+
+	if m.Personal {
+		generateErrorResponse(w, ErrPersonalWorkspace.Error(), http.StatusConflict)
+		return
+	}
+
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = WorkspaceMember
+	}
+	if _, ok := workspaceRoles[req.Role]; !ok {
+		generateErrorResponse(w, fmt.Sprintf("role must be %s, %s, %s or %s", WorkspaceOwner, WorkspaceAdmin, WorkspaceMember, WorkspaceViewer), http.StatusBadRequest)
+		return
+	}
+	if !m.can(req.Role) {
+		generateErrorResponse(w, "invites can't give a higher role than your own", http.StatusForbidden)
+		return
+	}
+	if req.Email != "" {
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			generateErrorResponse(w, "invalid email", http.StatusBadRequest)
+			return
+		}
+		if publicURL() == "" {
+			generateErrorResponse(w, "invites are only emailed if PUBLIC_URL is set", http.StatusConflict)
+			return
+		}
+	}
+
+	invite, err := insertInvite(ctx, DB, m.WorkspaceID, m.UserID, req)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	invite.URL = publicURL() + "/settings#invite=" + url.QueryEscape(invite.Token)
+
+	if invite.Email != "" {
+		email := Email{
+			To:      invite.Email,
+			Subject: fmt.Sprintf("You are invited to the calculator workspace %s", m.Name),
+			Body: fmt.Sprintf("You are invited to join the workspace %s as %s. Log in and open this link within %v to join:\n\n%s\n",
+				m.Name, invite.Role, WorkspaceInviteTTL, invite.URL),
+		}
+		go func() {
+			if err := Mail.Send(context.Background(), email); err != nil {
+				log.Printf("Sending the invite %d failed: %v\n", invite.ID, err)
+			}
+		}()
+	}
+
+	json, err := json.Marshal(invite)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(json))
+}
+
+func ApiRevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	m, ok := pathWorkspace(w, r, WorkspaceAdmin)
+	if !ok {
+		return
+	}
+
+	deleted, err := deleteInvite(r.Context(), DB, m.WorkspaceID, r.PathValue("invite"))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !deleted {
+		generateErrorResponse(w, "invite not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ApiAcceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	var req InviteAcceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		generateErrorResponse(w, "Invalid ClientRequest body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := selectUserByID(ctx, DB, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	workspaceID, err := acceptInvite(ctx, DB, req.Token, user)
+	switch {
+	case errors.Is(err, ErrInvalidInvite):
+		generateErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrInviteEmail):
+		generateErrorResponse(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, ErrAlreadyMember):
+		generateErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		internalError(w, err)
+		return
+	}
+
+	m, err := selectMembership(ctx, DB, workspaceID, uid)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	json, err := json.Marshal(m.workspace())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	fmt.Fprint(w, string(json))
+}
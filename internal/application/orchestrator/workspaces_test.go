@@ -0,0 +1,201 @@
+package application
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Barsenick/calculator/pkg/client"
+)
+
+func TestWorkspaces(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	token := func(name string) (int64, string) {
+		uid, err := insertUser(ctx, DB, &User{Name: name, Password: "hash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := startSession(ctx, httptest.NewRequest(http.MethodPost, "/api/v1/login", nil), uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uid, s.Token
+	}
+	_, alice := token("alice")
+	bobID, bob := token("bob")
+	_, carol := token("carol")
+	_, dave := token("dave")
+
+	handler := NewRouter()
+	request := func(method, path, token string, workspace int64, body string) *httptest.ResponseRecorder {
+		r := withBearer(httptest.NewRequest(method, path, strings.NewReader(body)), token)
+		if workspace != 0 {
+			r.Header.Set(WorkspaceHeader, fmt.Sprint(workspace))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(http.MethodPost, "/api/v1/workspaces", alice, 0, `{"name": " Team "}`)
+	var ws Workspace
+	if err := json.Unmarshal(w.Body.Bytes(), &ws); err != nil || w.Code != http.StatusCreated || ws.Name != "Team" || ws.Role != WorkspaceOwner {
+		t.Fatalf("unexpected workspace %d %s", w.Code, w.Body)
+	}
+	team := fmt.Sprintf("/api/v1/workspaces/%d", ws.ID)
+
+	invite := func(role string) string {
+		w := request(http.MethodPost, team+"/invites", alice, 0, `{"role": "`+role+`"}`)
+		var invite Invite
+		if err := json.Unmarshal(w.Body.Bytes(), &invite); err != nil || w.Code != http.StatusCreated || invite.Token == "" || !strings.Contains(invite.URL, invite.Token) {
+			t.Fatalf("unexpected invite %d %s", w.Code, w.Body)
+		}
+		return invite.Token
+	}
+	bobInvite := invite(WorkspaceMember)
+	if w := request(http.MethodPost, "/api/v1/invites/accept", bob, 0, `{"token": "`+bobInvite+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected bob to join, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodPost, "/api/v1/invites/accept", dave, 0, `{"token": "`+bobInvite+`"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a used invite to be refused, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/api/v1/invites/accept", bob, 0, `{"token": "`+invite(WorkspaceAdmin)+`"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected members not to join again, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/api/v1/invites/accept", carol, 0, `{"token": "`+invite(WorkspaceViewer)+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected carol to join, got %d %s", w.Code, w.Body)
+	}
+	t.Setenv("PUBLIC_URL", "")
+	if w := request(http.MethodPost, team+"/invites", alice, 0, `{"email": "someone@example.com"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected no emailed invites without PUBLIC_URL, got %d", w.Code)
+	}
+	emailInvite, err := insertInvite(ctx, DB, ws.ID, 1, InviteRequest{Role: WorkspaceMember, Email: "someone@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := request(http.MethodPost, "/api/v1/invites/accept", dave, 0, `{"token": "`+emailInvite.Token+`"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the invite of another email to be refused, got %d", w.Code)
+	}
+
+	// members share the expressions, viewers only read them and the others
+	// don't know they exist
+	w = request(http.MethodPost, "/api/v1/calculate", alice, ws.ID, `{"expression": "1+1"}`)
+	var calc client.CalculateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &calc); err != nil || calc.ID == 0 {
+		t.Fatalf("unexpected answer %d %s", w.Code, w.Body)
+	}
+	expr := fmt.Sprintf("/api/v1/expressions/%d", calc.ID)
+
+	w = request(http.MethodGet, "/api/v1/expressions", bob, ws.ID, "")
+	var list Expressions
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Expressions) != 1 || list.Expressions[0].CreatedBy != "alice" || list.Expressions[0].WorkspaceID != ws.ID {
+		t.Fatalf("expected bob to see the expression of alice, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodGet, "/api/v1/expressions", bob, 0, ""); !strings.Contains(w.Body.String(), `"expressions":[]`) {
+		t.Fatalf("expected the personal workspace of bob to be empty, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodGet, expr, carol, 0, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected viewers to read the expression, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/api/v1/calculate", carol, ws.ID, `{"expression": "1+1"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers not to calculate, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, expr+"/cancel", carol, 0, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers not to cancel, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, expr, dave, 0, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the expression to be hidden from others, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/api/v1/expressions", dave, ws.ID, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the workspace to be hidden from others, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, team, dave, 0, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the workspace to be hidden from others, got %d", w.Code)
+	}
+
+	// the workspace cookie of the pages falls back to the personal workspace
+	r := withBearer(httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil), dave)
+	r.AddCookie(&http.Cookie{Name: WorkspaceCookie, Value: fmt.Sprint(ws.ID)})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"expressions":[]`) {
+		t.Fatalf("expected the personal workspace of dave, got %d %s", w.Code, w.Body)
+	}
+
+	// the workspace always keeps an owner
+	if w := request(http.MethodDelete, team+"/members/me", alice, 0, ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected the last owner not to leave, got %d", w.Code)
+	}
+	if w := request(http.MethodPatch, team+fmt.Sprintf("/members/%d", bobID), bob, 0, `{"role": "owner"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected bob not to make himself owner, got %d", w.Code)
+	}
+	w = request(http.MethodPatch, team+fmt.Sprintf("/members/%d", bobID), alice, 0, `{"role": "owner"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"login":"bob"`) {
+		t.Fatalf("expected bob to become owner, got %d %s", w.Code, w.Body)
+	}
+	if w := request(http.MethodDelete, team+"/members/me", alice, 0, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected alice to leave, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, expr, alice, 0, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected alice to lose the workspace, got %d", w.Code)
+	}
+
+	// settings
+	if w := request(http.MethodPatch, team+"/settings", carol, 0, `{"precision": 2}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers not to change the settings, got %d", w.Code)
+	}
+	for _, body := range []string{`{"precision": 16}`, `{"max_timeout_ms": 999999999999}`, `{"default_timeout_ms": -1}`} {
+		if w := request(http.MethodPatch, team+"/settings", bob, 0, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	w = request(http.MethodPatch, team+"/settings", bob, 0, `{"precision": 2, "default_timeout_ms": 500, "max_timeout_ms": 1000}`)
+	var settings WorkspaceSettings
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil || settings.Precision == nil || *settings.Precision != 2 || settings.MaxTimeoutMS != 1000 || settings.DefaultTimeoutMS != 500 {
+		t.Fatalf("unexpected settings %d %s", w.Code, w.Body)
+	}
+	cfg, err := selectWorkspaceConfig(ctx, DB, ws.ID)
+	if err != nil || cfg.Precision != 2 || cfg.Timings.MaxTimeout.Milliseconds() != 1000 {
+		t.Fatalf("unexpected config %+v, %v", cfg, err)
+	}
+	if got := formatResult(1.0/3, &cfg.Precision); got != "0.33" {
+		t.Fatalf("expected 2 decimal places, got %s", got)
+	}
+	if got := formatResult(1.0/3, nil); got != "0.333333" {
+		t.Fatalf("expected the default precision, got %s", got)
+	}
+	if w := request(http.MethodPost, "/api/v1/calculate", bob, ws.ID, `{"expression": "1+1", "timeout_ms": 2000}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the timeout of the workspace to apply, got %d", w.Code)
+	}
+
+	// personal workspaces can't be shared or deleted
+	w = request(http.MethodGet, "/api/v1/workspaces", bob, 0, "")
+	var workspaces WorkspaceList
+	if err := json.Unmarshal(w.Body.Bytes(), &workspaces); err != nil || len(workspaces.Workspaces) != 2 || !workspaces.Workspaces[0].Personal {
+		t.Fatalf("unexpected workspaces %d %s", w.Code, w.Body)
+	}
+	personal := fmt.Sprintf("/api/v1/workspaces/%d", workspaces.Workspaces[0].ID)
+	if w := request(http.MethodPost, personal+"/invites", bob, 0, `{}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected no invites to personal workspaces, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, personal, bob, 0, ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected the personal workspace to stay, got %d", w.Code)
+	}
+
+	if w := request(http.MethodDelete, team, carol, 0, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers not to delete the workspace, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, team, bob, 0, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected bob to delete the workspace, got %d", w.Code)
+	}
+	if _, err := selectExpression(ctx, DB, fmt.Sprint(calc.ID)); err != sql.ErrNoRows {
+		t.Fatalf("expected the expressions of the workspace to be gone, got %v", err)
+	}
+}
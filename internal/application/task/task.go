@@ -0,0 +1,31 @@
+// Package task holds what the orchestrator and the agents exchange: the
+// orchestrator splits expressions into tasks of a single operation, the
+// agents compute them and send back the results.
+package task
+
+import "errors"
+
+// Port the orchestrator listens on and the agents connect to.
+const Port = ":8080"
+
+// AgentHeader identifies the agent in its requests, so that the
+// orchestrator can tell the agents apart.
+const AgentHeader = "X-Agent-ID"
+
+// ErrTimeout is reported by an agent that didn't compute the operation within
+// its OperationTime.
+var ErrTimeout = errors.New("timeouted")
+
+type Task struct {
+	TaskID        int     `json:"id"`
+	Arg1          float64 `json:"arg1"`
+	Arg2          float64 `json:"arg2"`
+	Operation     rune    `json:"operation"`
+	OperationTime int     `json:"operation_time"`
+}
+
+type TaskResult struct {
+	TaskID int     `json:"id"`
+	Result float64 `json:"result"`
+	Error  string  `json:"error,omitempty"`
+}
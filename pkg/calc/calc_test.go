@@ -0,0 +1,85 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		opts       []Option
+		expected   float64
+		err        error
+	}{
+		{"1-2*3+4", nil, -1, nil},
+		{"2^3^2", nil, 512, nil},
+		{"2x3", nil, 6, nil},
+		{"2 X (1,5 + 0.5)", nil, 4, nil},
+		{"x", nil, 0, Err422},
+		{"2x", []Option{WithVariable("x", 4)}, 0, Err422},
+		{"2*x", []Option{WithVariable("x", 4)}, 8, nil},
+		{"r^2", []Option{WithVariables(map[string]float64{"r": 3})}, 9, nil},
+		{"y+1", nil, 0, Err422},
+		{"max(1,5, 2)", []Option{WithMath()}, 5, nil},
+		{"max((1,5), 1)", []Option{WithMath()}, 1.5, nil},
+		{"2*pi", []Option{WithMath()}, 2 * math.Pi, nil},
+		{"sqrt(0-1)", []Option{WithMath()}, 0, Err422},
+		{"sqrt()", []Option{WithMath()}, 0, Err422},
+		{"double(4)", []Option{WithFunction("double", func(args ...float64) (float64, error) { return 2 * args[0], nil })}, 8, nil},
+		{"double(4)", nil, 0, Err422},
+		{"10/3", []Option{WithPrecision(2)}, 3.33, nil},
+		{"2(3)", nil, 0, Err422},
+		{"1..2", nil, 0, Err422},
+		{"1e9", nil, 0, Err422},
+		{"1" + strings.Repeat("0", 400), nil, 0, Err500},
+		{"0^(0-1)", nil, 0, Err422},
+	}
+
+	for _, test := range tests {
+		res, err := Evaluate(test.expression, test.opts...)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%q: expected %v, got %v, %v", test.expression, test.err, res, err)
+			}
+			continue
+		}
+		if err != nil || math.Abs(res-test.expected) > 1e-9 {
+			t.Errorf("%q: expected %v, got %v, %v", test.expression, test.expected, res, err)
+		}
+	}
+}
+
+func TestEvaluateSolver(t *testing.T) {
+	var ops []rune
+	solve := func(op rune, arg1, arg2 float64) (float64, error) {
+		ops = append(ops, op)
+		return SolveLocally(op, arg1, arg2)
+	}
+
+	res, err := Evaluate("(1+2)*3^2-4/2", WithSolver(solve))
+	if err != nil || res != 25 {
+		t.Fatalf("expected 25, got %v, %v", res, err)
+	}
+	if string(ops) != "+^*/-" {
+		t.Fatalf("unexpected order of operations %q", string(ops))
+	}
+
+	failing := errors.New("agent failed")
+	_, err = Evaluate("1+1", WithSolver(func(rune, float64, float64) (float64, error) { return 0, failing }))
+	if err != failing {
+		t.Fatalf("expected the error of the solver, got %v", err)
+	}
+}
+
+func TestEvaluateNesting(t *testing.T) {
+	deep := ""
+	for range maxDepth + 1 {
+		deep = "(" + deep
+	}
+	if _, err := Evaluate(deep + "1"); !errors.Is(err, Err422) {
+		t.Fatalf("expected the nesting to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// how deep parentheses, powers and calls may be nested
+const maxDepth = 200
+
+// parser is a recursive descent parser which computes the expression while
+// parsing it:
+//
+//	sum     = product { ("+" | "-") product }
+//	product = power { ("*" | "/" | "x") power }
+//	power   = primary [ "^" power ]
+//	primary = number | "(" sum ")" | name | name "(" [ sum { "," sum } ] ")"
+//
+// In the arguments of a call a comma separates the arguments, elsewhere it
+// is the decimal point.
+type parser struct {
+	src   string
+	pos   int
+	depth int
+	opts  *options
+}
+
+func stripSpaces(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func (p *parser) parse() (float64, error) {
+	if p.src == "" {
+		return 0, fmt.Errorf("%w: empty expression", Err422)
+	}
+
+	res, err := p.sum(false)
+	if err != nil {
+		return 0, err
+	}
+	if p.pos < len(p.src) {
+		return 0, p.unexpected()
+	}
+	return res, nil
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) unexpected() error {
+	if p.pos >= len(p.src) {
+		return fmt.Errorf("%w: unexpected end of expression", Err422)
+	}
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return fmt.Errorf("%w: unexpected %q", Err422, r)
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return fmt.Errorf("%w: the expression is nested too deeply", Err422)
+	}
+	return nil
+}
+
+func (p *parser) sum(inCall bool) (float64, error) {
+	left, err := p.product(inCall)
+	for err == nil {
+		op := rune(p.peek())
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+
+		var right float64
+		if right, err = p.product(inCall); err == nil {
+			left, err = p.opts.solver(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *parser) product(inCall bool) (float64, error) {
+	left, err := p.power(inCall)
+	for err == nil {
+		op := rune(p.peek())
+		switch {
+		case op == '*' || op == '/':
+			p.pos++
+		case p.isTimes():
+			p.pos++
+			op = '*'
+		default:
+			return left, nil
+		}
+
+		var right float64
+		if right, err = p.power(inCall); err == nil {
+			left, err = p.opts.solver(op, left, right)
+		}
+	}
+	return left, err
+}
+
+// isTimes tells whether the next name is x used as the multiplication sign.
+func (p *parser) isTimes() bool {
+	name := p.src[p.pos : p.pos+nameLength(p.src[p.pos:])]
+	if name != "x" && name != "X" {
+		return false
+	}
+	_, isVariable := p.opts.variables[name]
+	return !isVariable
+}
+
+func (p *parser) power(inCall bool) (float64, error) {
+	base, err := p.primary(inCall)
+	if err != nil || p.peek() != '^' {
+		return base, err
+	}
+	p.pos++
+
+	if err := p.enter(); err != nil {
+		return 0, err
+	}
+	exp, err := p.power(inCall)
+	p.depth--
+	if err != nil {
+		return 0, err
+	}
+	return p.opts.solver('^', base, exp)
+}
+
+func (p *parser) primary(inCall bool) (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		if err := p.enter(); err != nil {
+			return 0, err
+		}
+		res, err := p.sum(false)
+		p.depth--
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, p.unexpected()
+		}
+		p.pos++
+		return res, nil
+	case isDigit(c) || c == '.' || (c == ',' && !inCall):
+		return p.number(inCall)
+	case nameLength(p.src[p.pos:]) > 0:
+		return p.name()
+	}
+	return 0, p.unexpected()
+}
+
+func (p *parser) number(inCall bool) (float64, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.' || (p.src[p.pos] == ',' && !inCall)) {
+		p.pos++
+	}
+
+	num := strings.ReplaceAll(p.src[start:p.pos], ",", ".")
+	res, err := strconv.ParseFloat(num, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("%w: %s is out of range", Err500, num)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid number %s", Err422, num)
+	}
+	return res, nil
+}
+
+func (p *parser) name() (float64, error) {
+	name := p.src[p.pos : p.pos+nameLength(p.src[p.pos:])]
+	p.pos += len(name)
+
+	if p.peek() != '(' {
+		if value, ok := p.opts.variables[name]; ok {
+			return value, nil
+		}
+		return 0, fmt.Errorf("%w: unknown variable %s", Err422, name)
+	}
+
+	fn, ok := p.opts.functions[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown function %s", Err422, name)
+	}
+
+	p.pos++
+	if err := p.enter(); err != nil {
+		return 0, err
+	}
+	defer func() { p.depth-- }()
+
+	var args []float64
+	for p.peek() != ')' {
+		if len(args) > 0 {
+			if p.peek() != ',' {
+				return 0, p.unexpected()
+			}
+			p.pos++
+		}
+
+		arg, err := p.sum(true)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+
+	res, err := fn(args...)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return res, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// nameLength is the length of the name s starts with. Names are made of
+// ASCII letters and underscores, so that 2x3 is 2 times 3.
+func nameLength(s string) int {
+	n := 0
+	for n < len(s) && (s[n] == '_' || (s[n]|0x20 >= 'a' && s[n]|0x20 <= 'z')) {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,494 @@
+// Package client is a Go client of the calculator API, see
+// /api/v1/openapi.json for the full description of the API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrStillPending = errors.New("the expression is still pending")
+
+// MFARequiredError is returned by Login if the user has two-factor
+// authentication, LoginMFA completes the login with Token.
+type MFARequiredError struct {
+	Token string
+}
+
+func (e *MFARequiredError) Error() string {
+	return "a two-factor authentication code is required"
+}
+
+type Client struct {
+	// BaseURL is the address of the orchestrator, e.g. http://localhost:8080.
+	BaseURL string
+	// Token is sent as a bearer token, Register and Login set it.
+	Token string
+	// RefreshToken replaces an expired Token once the server refuses it,
+	// Register and Login set it and every refresh changes it.
+	RefreshToken string
+	// APIKey is sent instead of Token if it is set.
+	APIKey string
+	// Workspace is the ID of the workspace the expressions are sent to and
+	// read from, the personal workspace of the user if 0.
+	Workspace  int64
+	HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// do sends the request and decodes the JSON answer into out, unless out is
+// nil. Answers of 400 and above are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	resp, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return resp, decodeError(resp)
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("decoding the answer of %s %s: %w", method, path, err)
+		}
+	}
+	return resp, nil
+}
+
+// send sends the request, and once more with a new token if the server
+// refuses the token and the client has a refresh token. The 401 answers of
+// the login endpoints are about the credentials, not the token.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	resp, err := c.sendOnce(ctx, method, path, query, body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.RefreshToken == "" || c.APIKey != "" {
+		return resp, err
+	}
+	switch path {
+	case "/api/v1/login", "/api/v1/login/mfa", "/api/v1/register", "/api/v1/token/refresh", "/api/v1/password/reset", "/api/v1/password/reset/confirm":
+		return resp, nil
+	}
+
+	if _, err := c.Refresh(ctx); err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return c.sendOnce(ctx, method, path, query, body)
+}
+
+func (c *Client) sendOnce(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := c.newRequest(ctx, method, path, query, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.HTTPClient.Do(req)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Workspace != 0 {
+		req.Header.Set("X-Workspace-ID", strconv.FormatInt(c.Workspace, 10))
+	}
+	return req, nil
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, apiErr); err != nil || apiErr.Code == "" {
+		apiErr.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(resp.StatusCode)), " ", "_")
+		apiErr.Message = strings.TrimSpace(string(b))
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return apiErr
+}
+
+// Register creates the user and logs in as it.
+func (c *Client) Register(ctx context.Context, login, password string) (string, error) {
+	return c.authenticate(ctx, "/api/v1/register", login, password)
+}
+
+// Login gets a token of the user and uses it for the next requests.
+func (c *Client) Login(ctx context.Context, login, password string) (string, error) {
+	return c.authenticate(ctx, "/api/v1/login", login, password)
+}
+
+func (c *Client) authenticate(ctx context.Context, path, login, password string) (string, error) {
+	var resp TokenResponse
+	if _, err := c.do(ctx, http.MethodPost, path, nil, Credentials{Login: login, Password: password}, &resp); err != nil {
+		return "", err
+	}
+	if resp.Status == StatusMFARequired {
+		return "", &MFARequiredError{Token: resp.MFAToken}
+	}
+	c.Token, c.RefreshToken = resp.Token, resp.RefreshToken
+	return resp.Token, nil
+}
+
+// LoginMFA completes a login with the token of a MFARequiredError and a
+// TOTP or recovery code.
+func (c *Client) LoginMFA(ctx context.Context, mfaToken, code string) (string, error) {
+	var resp TokenResponse
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/login/mfa", nil, MFALoginRequest{MFAToken: mfaToken, Code: code}, &resp); err != nil {
+		return "", err
+	}
+	c.Token, c.RefreshToken = resp.Token, resp.RefreshToken
+	return resp.Token, nil
+}
+
+// Refresh swaps the refresh token for a new one and a new access token.
+func (c *Client) Refresh(ctx context.Context) (string, error) {
+	var resp TokenResponse
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/token/refresh", nil, RefreshRequest{RefreshToken: c.RefreshToken}, &resp); err != nil {
+		return "", err
+	}
+	c.Token = resp.Token
+	if resp.RefreshToken != "" {
+		c.RefreshToken = resp.RefreshToken
+	}
+	return resp.Token, nil
+}
+
+// Logout ends the session of the client, or every session of the user if
+// all is true, and forgets the tokens.
+func (c *Client) Logout(ctx context.Context, all bool) error {
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/logout", nil, LogoutRequest{All: all}, nil)
+	if err == nil {
+		c.Token, c.RefreshToken = "", ""
+	}
+	return err
+}
+
+// Sessions lists the sessions of the user which haven't ended.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var resp SessionList
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/sessions", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+// RevokeSession ends a session of the user, logging out wherever it is used.
+func (c *Client) RevokeSession(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/v1/sessions/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+// ChangePassword sets a new password of the user. The other sessions of
+// the user end, the one of the client goes on.
+func (c *Client) ChangePassword(ctx context.Context, current, password string) error {
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/password/change", nil, PasswordChangeRequest{CurrentPassword: current, NewPassword: password}, nil)
+	return err
+}
+
+// RequestPasswordReset has a reset link sent to the email of the user. It
+// succeeds whether or not the user exists.
+func (c *Client) RequestPasswordReset(ctx context.Context, login string) error {
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/password/reset", nil, PasswordResetRequest{Login: login}, nil)
+	return err
+}
+
+// ResetPassword sets a new password with the token of a reset link, ending
+// every session of the user.
+func (c *Client) ResetPassword(ctx context.Context, token, password string) error {
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/password/reset/confirm", nil, PasswordResetConfirmRequest{Token: token, NewPassword: password}, nil)
+	return err
+}
+
+// MFAStatus reports whether the user has two-factor authentication.
+func (c *Client) MFAStatus(ctx context.Context) (*MFAStatus, error) {
+	var status MFAStatus
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/mfa", nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// EnrollTOTP creates a TOTP secret of the user, VerifyTOTP enables it.
+func (c *Client) EnrollTOTP(ctx context.Context) (*MFAEnrollment, error) {
+	var enrollment MFAEnrollment
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/mfa/totp", nil, nil, &enrollment); err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+// VerifyTOTP enables two-factor authentication with a code of the enrolled
+// secret and returns the recovery codes.
+func (c *Client) VerifyTOTP(ctx context.Context, code string) ([]string, error) {
+	var resp RecoveryCodes
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/mfa/totp/verify", nil, MFACodeRequest{Code: code}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off, code is a TOTP or
+// recovery code.
+func (c *Client) DisableTOTP(ctx context.Context, code string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/v1/mfa/totp", nil, MFACodeRequest{Code: code}, nil)
+	return err
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, code is a TOTP code.
+func (c *Client) RegenerateRecoveryCodes(ctx context.Context, code string) ([]string, error) {
+	var resp RecoveryCodes
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/mfa/recovery-codes", nil, MFACodeRequest{Code: code}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Codes, nil
+}
+
+// CreateAPIKey creates an API key of the user. Its Key is only returned
+// now, the server keeps nothing but a hash of it.
+func (c *Client) CreateAPIKey(ctx context.Context, req APIKeyRequest) (*APIKey, error) {
+	var key APIKey
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/apikeys", nil, req, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// APIKeys lists the API keys of the user which can still be used.
+func (c *Client) APIKeys(ctx context.Context) ([]APIKey, error) {
+	var resp APIKeyList
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/apikeys", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.APIKeys, nil
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id int64) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/v1/apikeys/"+strconv.FormatInt(id, 10), nil, nil, nil)
+	return err
+}
+
+// Workspaces lists the workspaces the user is a member of, the personal
+// one first.
+func (c *Client) Workspaces(ctx context.Context) ([]Workspace, error) {
+	var resp WorkspaceList
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/workspaces", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Workspaces, nil
+}
+
+// CreateWorkspace creates a workspace the user is the owner of.
+func (c *Client) CreateWorkspace(ctx context.Context, name string) (*Workspace, error) {
+	var ws Workspace
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/workspaces", nil, WorkspaceRequest{Name: name}, &ws); err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// Invite creates an invite to the workspace, whose Token is only returned
+// now.
+func (c *Client) Invite(ctx context.Context, workspace int64, req InviteRequest) (*Invite, error) {
+	var invite Invite
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/workspaces/"+strconv.FormatInt(workspace, 10)+"/invites", nil, req, &invite); err != nil {
+		return nil, err
+	}
+	invite.URL = c.absoluteURL(invite.URL)
+	return &invite, nil
+}
+
+// AcceptInvite makes the user a member of the workspace of the invite.
+func (c *Client) AcceptInvite(ctx context.Context, token string) (*Workspace, error) {
+	var ws Workspace
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/invites/accept", nil, InviteAcceptRequest{Token: token}, &ws); err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// Calculate queues the expression and returns its ID.
+func (c *Client) Calculate(ctx context.Context, req CalculateRequest) (string, error) {
+	var resp CalculateResponse
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/calculate", nil, req, &resp); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(resp.ID, 10), nil
+}
+
+// CalculateAndWait queues the expression and lets the server wait up to
+// wait for the result. If the expression doesn't finish in time, the
+// returned expression has only the ID and the error is ErrStillPending.
+func (c *Client) CalculateAndWait(ctx context.Context, req CalculateRequest, wait time.Duration) (*Expression, error) {
+	var raw json.RawMessage
+	resp, err := c.do(ctx, http.MethodPost, "/api/v1/calculate", url.Values{"wait": {wait.String()}}, req, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusAccepted {
+		var id CalculateResponse
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return nil, err
+		}
+		return &Expression{ID: strconv.FormatInt(id.ID, 10), Status: StatusPending, Result: "pending"}, ErrStillPending
+	}
+
+	var expr Expression
+	if err := json.Unmarshal(raw, &expr); err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+// List returns a page of the user's expressions.
+func (c *Client) List(ctx context.Context, opts ListOptions) (*ExpressionList, error) {
+	var list ExpressionList
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/expressions", opts.values(), nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *Client) Get(ctx context.Context, id string) (*Expression, error) {
+	var expr Expression
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/expressions/"+url.PathEscape(id), nil, nil, &expr); err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+// Cancel stops the evaluation of a pending expression.
+func (c *Client) Cancel(ctx context.Context, id string) (*Expression, error) {
+	var expr Expression
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/expressions/"+url.PathEscape(id)+"/cancel", nil, nil, &expr); err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+// Share creates a share link of the expression.
+func (c *Client) Share(ctx context.Context, id string, req ShareRequest) (*Share, error) {
+	var share Share
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/expressions/"+url.PathEscape(id)+"/shares", nil, req, &share); err != nil {
+		return nil, err
+	}
+	share.URL = c.absoluteURL(share.URL)
+	return &share, nil
+}
+
+// absoluteURL prefixes the links of an orchestrator without PUBLIC_URL,
+// which are only paths, with BaseURL.
+func (c *Client) absoluteURL(u string) string {
+	if strings.HasPrefix(u, "/") {
+		return c.BaseURL + u
+	}
+	return u
+}
+
+// Shares returns the share links of the expression which still work.
+func (c *Client) Shares(ctx context.Context, id string) ([]Share, error) {
+	var list ShareList
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/expressions/"+url.PathEscape(id)+"/shares", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Shares, nil
+}
+
+// RevokeShare makes the share link stop working.
+func (c *Client) RevokeShare(ctx context.Context, id string, share int64) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/v1/expressions/"+url.PathEscape(id)+"/shares/"+strconv.FormatInt(share, 10), nil, nil, nil)
+	return err
+}
+
+// Export downloads the expressions matching opts as csv, jsonl or xlsx. The
+// caller has to close the returned body.
+func (c *Client) Export(ctx context.Context, format string, opts ListOptions) (io.ReadCloser, error) {
+	query := opts.values()
+	if format != "" {
+		query.Set("format", format)
+	}
+
+	resp, err := c.send(ctx, http.MethodGet, "/api/v1/expressions/export", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Wait polls the expression every interval until it isn't pending anymore.
+func (c *Client) Wait(ctx context.Context, id string, interval time.Duration) (*Expression, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expr, err := c.Get(ctx, id)
+		if err != nil || !expr.Pending() {
+			return expr, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return expr, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	if o.Limit > 0 {
+		v.Set("limit", strconv.Itoa(o.Limit))
+	}
+	for name, val := range map[string]string{"cursor": o.Cursor, "status": o.Status, "from": o.From, "to": o.To, "q": o.Query, "order": o.Order} {
+		if val != "" {
+			v.Set(name, val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v1/login":
+			var creds Credentials
+			json.NewDecoder(r.Body).Decode(&creds)
+			if creds.Password != "secret" {
+				w.Header().Set("X-Request-ID", "req-1")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"code":"unauthorized","message":"Invalid password","request_id":"req-1"}`))
+				return
+			}
+			w.Write([]byte(`{"status":"200 OK","token":"tok","refresh_token":"r1"}`))
+		case "POST /api/v1/token/refresh":
+			var req RefreshRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.RefreshToken != "r1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"status":"200 OK","token":"tok","refresh_token":"r2"}`))
+		case "POST /api/v1/calculate":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var req CalculateRequest
+			if json.NewDecoder(r.Body).Decode(&req); req.Expression != "2+2" {
+				t.Errorf("unexpected expression %q", req.Expression)
+			}
+			if r.URL.Query().Get("wait") != "" {
+				w.WriteHeader(http.StatusAccepted)
+			}
+			w.Write([]byte(`{"id":7}`))
+		case "GET /api/v1/expressions/7":
+			w.Write([]byte(`{"id":"7","status":"200","result":"4.000000","expression":"2+2"}`))
+		case "POST /api/v1/expressions/7/cancel":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"code":"conflict","message":"expression is not pending","request_id":"req-2"}`))
+		case "GET /api/v1/expressions/export":
+			w.Write([]byte("id,expression\n7,2+2\n"))
+		case "GET /api/v1/expressions":
+			if got := r.URL.Query().Get("status"); got != "ok" {
+				t.Errorf("unexpected status filter %q", got)
+			}
+			w.Write([]byte(`{"expressions":[{"id":"7","status":"200","result":"4.000000"}],"next_cursor":"Nw"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := New(server.URL + "/")
+
+	_, err := c.Login(ctx, "alice", "wrong")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "unauthorized" || apiErr.RequestID != "req-1" {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+
+	if token, err := c.Login(ctx, "alice", "secret"); err != nil || token != "tok" || c.Token != "tok" || c.RefreshToken != "r1" {
+		t.Fatalf("unexpected login %q, %v", token, err)
+	}
+
+	// an expired token is refreshed and the request sent again
+	c.Token = "expired"
+	id, err := c.Calculate(ctx, CalculateRequest{Expression: "2+2"})
+	if err != nil || id != "7" || c.Token != "tok" || c.RefreshToken != "r2" {
+		t.Fatalf("unexpected calculate %q, %v", id, err)
+	}
+
+	expr, err := c.CalculateAndWait(ctx, CalculateRequest{Expression: "2+2"}, time.Second)
+	if err != ErrStillPending || expr.ID != "7" || !expr.Pending() {
+		t.Fatalf("expected a pending expression, got %+v, %v", expr, err)
+	}
+
+	expr, err = c.Wait(ctx, "7", time.Millisecond)
+	if err != nil || expr.Result != "4.000000" || expr.Source != "2+2" {
+		t.Fatalf("unexpected expression %+v, %v", expr, err)
+	}
+
+	list, err := c.List(ctx, ListOptions{Status: "ok"})
+	if err != nil || len(list.Expressions) != 1 || list.NextCursor != "Nw" {
+		t.Fatalf("unexpected list %+v, %v", list, err)
+	}
+
+	if _, err := c.Cancel(ctx, "7"); !errors.As(err, &apiErr) || apiErr.Code != "conflict" {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	body, err := c.Export(ctx, "csv", ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if b, _ := io.ReadAll(body); string(b) != "id,expression\n7,2+2\n" {
+		t.Fatalf("unexpected export %q", b)
+	}
+
+	if _, err := c.Get(ctx, "8"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
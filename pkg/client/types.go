@@ -0,0 +1,339 @@
+package client
+
+import "fmt"
+
+// Statuses of an expression.
+const (
+	StatusPending   = "201"
+	StatusOK        = "200"
+	StatusInvalid   = "422"
+	StatusInternal  = "500"
+	StatusCancelled = "cancelled"
+	StatusTimeout   = "timeout"
+)
+
+type Credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Email is optional and only read on registration, password reset links
+	// are sent to it.
+	Email string `json:"email,omitempty"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordResetRequest asks for a reset link to be sent to the email of the
+// user.
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// StatusMFARequired is the Status of a login that has to be completed with
+// a code at /api/v1/login/mfa.
+const StatusMFARequired = "mfa_required"
+
+type TokenResponse struct {
+	Status string `json:"status"`
+	// Token is the access token, valid for ExpiresIn seconds.
+	Token string `json:"token,omitempty"`
+	// RefreshToken gets a new access token from /api/v1/token/refresh. It
+	// changes with every refresh and is empty if it didn't.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	// MFAToken is returned instead of the tokens if the user has
+	// two-factor authentication, it expires after ExpiresIn seconds.
+	MFAToken string `json:"mfa_token,omitempty"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is a TOTP code or a recovery code.
+	Code string `json:"code"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// MFAEnrollment is a TOTP secret which is enabled once a code of it is
+// verified. QRPNG is a PNG of URI.
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRPNG  []byte `json:"qr_png"`
+}
+
+// RecoveryCodes log in once each when the authenticator is lost.
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+type MFAStatus struct {
+	TOTPEnabled       bool `json:"totp_enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	// All ends every session of the user instead of the current one.
+	All bool `json:"all,omitempty"`
+}
+
+// Session is a login of the user, which lasts until it is revoked or isn't
+// refreshed for a while. Times are Unix seconds.
+type Session struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	Created   int64  `json:"created"`
+	LastUsed  int64  `json:"last_used"`
+	Expires   int64  `json:"expires"`
+	// Current is true for the session the request is made with.
+	Current bool `json:"current"`
+}
+
+type SessionList struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// Scopes of API keys. ScopeCalculate evaluates expressions, with the
+// calculate, batch, import and rerun requests, and ScopeRead allows the GET
+// requests. A key without scopes can do anything its user can, except
+// managing API keys, sessions and webhooks.
+const (
+	ScopeCalculate = "calculate"
+	ScopeRead      = "read"
+)
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes,omitempty"`
+	// Expires is the Unix time the key stops working at, never if 0.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// APIKey is sent as "Authorization: ApiKey <key>". Key is only returned when
+// the key is created; Prefix, its start, tells the keys apart later.
+type APIKey struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Prefix   string   `json:"prefix"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created"`
+	Expires  int64    `json:"expires,omitempty"`
+	LastUsed int64    `json:"last_used,omitempty"`
+	Key      string   `json:"key,omitempty"`
+}
+
+type APIKeyList struct {
+	APIKeys []APIKey `json:"api_keys"`
+}
+
+// Roles of the members of a workspace. Viewers read its expressions,
+// members also calculate, admins manage the members, invites and settings
+// and owners may also delete the workspace.
+const (
+	WorkspaceOwner  = "owner"
+	WorkspaceAdmin  = "admin"
+	WorkspaceMember = "member"
+	WorkspaceViewer = "viewer"
+)
+
+// Workspace holds expressions shared by its members. Every user has a
+// personal workspace nobody else can join. Role is the role of the user the
+// workspace is listed for; Members are only returned for a single workspace.
+type Workspace struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Personal bool     `json:"personal"`
+	Role     string   `json:"role"`
+	Created  int64    `json:"created"`
+	Members  []Member `json:"members,omitempty"`
+}
+
+type WorkspaceList struct {
+	Workspaces []Workspace `json:"workspaces"`
+}
+
+type WorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+// Member is a user of a workspace and its role there.
+type Member struct {
+	UserID int64  `json:"user_id"`
+	Login  string `json:"login"`
+	Role   string `json:"role"`
+	Joined int64  `json:"joined"`
+}
+
+type MemberUpdate struct {
+	Role string `json:"role"`
+}
+
+// WorkspaceSettings apply to the expressions of a workspace. The timeouts
+// can't be longer than those of the server, zero values of a change leave
+// the setting as it is.
+type WorkspaceSettings struct {
+	DefaultTimeoutMS int64 `json:"default_timeout_ms,omitempty"`
+	MaxTimeoutMS     int64 `json:"max_timeout_ms,omitempty"`
+	MaxWaitMS        int64 `json:"max_wait_ms,omitempty"`
+	// Precision is the number of decimal places of the results, -1 for as
+	// many as needed.
+	Precision *int `json:"precision,omitempty"`
+}
+
+// InviteRequest invites someone to a workspace. With an Email, the link is
+// sent there and only a user with that email may accept it.
+type InviteRequest struct {
+	Role  string `json:"role,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// Invite is accepted with its Token, which is only returned when the invite
+// is created. URL is the link to the web page accepting it.
+type Invite struct {
+	ID      int64  `json:"id"`
+	Role    string `json:"role"`
+	Email   string `json:"email,omitempty"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+	Token   string `json:"token,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+type InviteList struct {
+	Invites []Invite `json:"invites"`
+}
+
+type InviteAcceptRequest struct {
+	Token string `json:"token"`
+}
+
+// ShareRequest creates a share link. Expires is the Unix time the link
+// stops working at, never if 0.
+type ShareRequest struct {
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Share is a link anyone can open without logging in to see the source, the
+// result and the trace of an expression. Token and URL are only returned
+// when the share is created.
+type Share struct {
+	ID           int64  `json:"id"`
+	ExpressionID string `json:"expression_id"`
+	CreatedBy    string `json:"created_by,omitempty"`
+	Created      int64  `json:"created"`
+	Expires      int64  `json:"expires,omitempty"`
+	Token        string `json:"token,omitempty"`
+	URL          string `json:"url,omitempty"`
+}
+
+type ShareList struct {
+	Shares []Share `json:"shares"`
+}
+
+// SharedExpression is what a share link shows of an expression, its label
+// and notes stay private.
+type SharedExpression struct {
+	Status   string      `json:"status"`
+	Result   string      `json:"result"`
+	Source   string      `json:"expression"`
+	Created  int64       `json:"created"`
+	Finished int64       `json:"finished,omitempty"`
+	Trace    []TraceStep `json:"trace"`
+}
+
+type CalculateRequest struct {
+	Expression  string `json:"expression"`
+	Priority    int    `json:"priority,omitempty"`
+	TimeoutMS   int    `json:"timeout_ms,omitempty"`
+	Sync        bool   `json:"sync,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Precision is the number of decimal places of the result, -1 for as
+	// many as needed. The workspace decides if it is nil.
+	Precision *int `json:"precision,omitempty"`
+}
+
+type CalculateResponse struct {
+	ID int64 `json:"id"`
+}
+
+type Expression struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Result   string `json:"result"`
+	Source   string `json:"expression"`
+	Created  int64  `json:"created"`
+	Finished int64  `json:"finished,omitempty"`
+	Label    string `json:"label"`
+	Notes    string `json:"notes"`
+	// WorkspaceID is the workspace the expression belongs to and CreatedBy
+	// the login of the member who sent it.
+	WorkspaceID int64  `json:"workspace_id,omitempty"`
+	CreatedBy   string `json:"created_by,omitempty"`
+	// Trace is only returned for a single expression.
+	Trace []TraceStep `json:"trace,omitempty"`
+}
+
+// TraceStep is an operation computed while evaluating an expression, in the
+// order they were computed.
+type TraceStep struct {
+	Operation string  `json:"operation"`
+	Arg1      float64 `json:"arg1"`
+	Arg2      float64 `json:"arg2"`
+	Result    float64 `json:"result"`
+}
+
+// Pending reports whether the expression is still being evaluated.
+func (e Expression) Pending() bool {
+	return e.Status == StatusPending
+}
+
+type ExpressionList struct {
+	Expressions []Expression `json:"expressions"`
+	NextCursor  string       `json:"next_cursor,omitempty"`
+}
+
+// ListOptions narrows down the expressions of List and Export. Zero values
+// are left out of the query.
+type ListOptions struct {
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+	// Status is a comma separated list of pending, ok, error, cancelled and timeout.
+	Status string
+	// From and To are RFC 3339 times or YYYY-MM-DD dates.
+	From  string
+	To    string
+	Query string
+	// Order is asc or desc.
+	Order string
+}
+
+// Error is the body of every error of the API.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Details    any    `json:"details,omitempty"`
+	RequestID  string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}